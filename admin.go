@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// systemShard keeps data shared by all teams, like admins and teams
+	// managed at runtime, so no team can have this name.
+	systemShard     = "system"
+	teamsBucketName = "system_teams"
+	maxAdmins       = 10
+	teamMaxSize     = 64 << 10
+)
+
+// roleAdmin manages teams of the server, admins are kept in the system shard
+// and have no role in teams.
+const roleAdmin role = "admin"
+
+// teamRecord is a team created or changed at runtime, it overrides the team of
+// the same name in teams.json. A deleted record hides the team of the file.
+type teamRecord struct {
+	Name    string    `json:"name"`
+	Team    *team     `json:"team,omitempty"`
+	Deleted bool      `json:"deleted"`
+	Updated time.Time `json:"updated"`
+}
+
+type teamConfigStore interface {
+	list() ([]*teamRecord, error)
+	put(rec *teamRecord) error
+}
+
+type boltTeamConfigStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltTeamConfigStore(db *bolt.DB) (*boltTeamConfigStore, error) {
+	s := new(boltTeamConfigStore)
+	s.db = db
+	s.bucket = []byte(teamsBucketName)
+	if err := createBucket(s.db, s.bucket); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltTeamConfigStore) list() ([]*teamRecord, error) {
+	records := make([]*teamRecord, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, v []byte) error {
+			rec := new(teamRecord)
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *boltTeamConfigStore) put(rec *teamRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(rec.Name), buf)
+	})
+}
+
+// teamStatus is a team as listed to admins.
+type teamStatus struct {
+	*team
+	// Source is file for teams of teams.json and admin for teams changed at runtime.
+	Source  string `json:"source"`
+	Running bool   `json:"running"`
+}
+
+const (
+	teamSourceFile  = "file"
+	teamSourceAdmin = "admin"
+)
+
+// teamCatalog merges teams of teams.json with teams managed by admins and
+// applies the result to the fleet, the file is only a bootstrap source.
+type teamCatalog struct {
+	path  string
+	store teamConfigStore
+	fleet *teamFleet
+	clock *clock
+
+	mux  sync.Mutex
+	file map[string]*team
+}
+
+func newTeamCatalog(path string, store teamConfigStore, fleet *teamFleet, c *clock) *teamCatalog {
+	return &teamCatalog{path: path, store: store, fleet: fleet, clock: c, file: make(map[string]*team)}
+}
+
+// reload reads teams.json and applies it, the running teams are kept if the
+// file or the merged teams are invalid.
+func (c *teamCatalog) reload() error {
+	file, err := readTeams(c.path)
+	if err != nil {
+		return fmt.Errorf("keeping the running teams, %v", err)
+	}
+	return c.load(file)
+}
+
+// load applies teams of the file merged with teams managed by admins.
+func (c *teamCatalog) load(file map[string]*team) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	teams, err := c.merge(file, nil)
+	if err != nil {
+		return fmt.Errorf("keeping the running teams, %v", err)
+	}
+	c.file = file
+	c.fleet.apply(teams)
+	return nil
+}
+
+// merge returns teams of the file overridden by stored records and rec, which
+// is about to be stored.
+func (c *teamCatalog) merge(file map[string]*team, rec *teamRecord) (map[string]*team, error) {
+	records, err := c.store.list()
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		records = append(records, rec)
+	}
+	// Teams are validated in place, so the running ones are left untouched.
+	teams := make(map[string]*team, len(file))
+	for name, t := range file {
+		teams[name] = t.clone()
+	}
+	for _, r := range records {
+		if r.Deleted || r.Team == nil {
+			delete(teams, r.Name)
+			continue
+		}
+		teams[r.Name] = r.Team
+	}
+	if err := validateTeams(teams); err != nil {
+		return nil, newClientError(err.Error())
+	}
+	if c.fleet.tenants == nil {
+		for _, t := range teams {
+			if t.Port == 0 && !t.Suspended {
+				return nil, newClientError(fmt.Sprintf("team %s has no port", t.Name))
+			}
+		}
+	}
+	return teams, nil
+}
+
+// save stores the record and applies the teams unless they are invalid.
+func (c *teamCatalog) save(rec *teamRecord) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	rec.Updated = c.clock.Now()
+	teams, err := c.merge(c.file, rec)
+	if err != nil {
+		return err
+	}
+	if err := c.store.put(rec); err != nil {
+		return err
+	}
+	c.fleet.apply(teams)
+	return nil
+}
+
+// get returns the current settings of the team, nil if there is no such team.
+func (c *teamCatalog) get(name string) (*team, error) {
+	teams, err := c.teams()
+	if err != nil {
+		return nil, err
+	}
+	return teams[name], nil
+}
+
+func (c *teamCatalog) teams() (map[string]*team, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.merge(c.file, nil)
+}
+
+func (c *teamCatalog) list() ([]*teamStatus, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	records, err := c.store.list()
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]bool, len(records))
+	for _, r := range records {
+		managed[r.Name] = true
+	}
+	teams, err := c.merge(c.file, nil)
+	if err != nil {
+		return nil, err
+	}
+	running := c.fleet.running()
+
+	list := make([]*teamStatus, 0, len(teams))
+	for _, name := range sortedTeamNames(teams) {
+		st := &teamStatus{team: teams[name], Source: teamSourceFile, Running: running[name]}
+		if managed[name] {
+			st.Source = teamSourceAdmin
+		}
+		list = append(list, st)
+	}
+	return list, nil
+}
+
+type adminEndpoints struct {
+	catalog *teamCatalog
+	auth    *auth
+	// auditStore keeps actions of admins in the system shard.
+	auditStore auditStore
+	guard      *loginGuard
+	template   *templateMgr
+	upgrader   *websocket.Upgrader
+	drainer    *drainer
+	// dashboard pushes summaries of teams to open dashboards.
+	dashboard *dashboardTopic
+}
+
+func newAdminEndpoints(catalog *teamCatalog, admins userStore, audit auditStore, templates *templateMgr, origins *originPolicy, c *clock) *adminEndpoints {
+	h := new(adminEndpoints)
+	h.catalog = catalog
+	h.auditStore = audit
+	h.guard = newLoginGuard(c)
+	h.auth = newAuth(admins, nil, h.guard)
+	h.template = templates
+	h.upgrader = &websocket.Upgrader{CheckOrigin: origins.check}
+	h.drainer = newDrainer()
+	h.dashboard = newDashboardTopic(catalog, dashboardCheckPeriod)
+	return h
+}
+
+func newAdminRouter(h *adminEndpoints, opts *teamServerOpts) http.Handler {
+	r := mux.NewRouter()
+
+	r.Use(metricMiddleware("", probePaths))
+	r.Use(connLimitMiddleware(newConnLimit(defaultQuotaConnections), probePaths))
+	r.Use(securityMiddleware(opts.origins))
+
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", newFsWrapper(opts.staticDir, 1*time.Hour)))
+
+	r.HandleFunc("/", h.pageAdminHandler).Methods("GET")
+	r.HandleFunc("/admin/auth", h.authHandler).Methods("POST")
+	r.HandleFunc("/admin/teams", h.teamsHandler).Methods("GET")
+	r.HandleFunc("/admin/teams/save", h.teamsSaveHandler).Methods("POST")
+	r.HandleFunc("/admin/teams/suspend", h.teamsSuspendHandler).Methods("POST")
+	r.HandleFunc("/admin/teams/resume", h.teamsSuspendHandler).Methods("POST")
+	r.HandleFunc("/admin/teams/remove", h.teamsRemoveHandler).Methods("POST")
+	r.HandleFunc("/admin/audit", h.auditHandler).Methods("GET")
+	r.HandleFunc("/admin/backup", h.backupHandler).Methods("GET")
+
+	r.HandleFunc("/dashboard", h.pageDashboardHandler).Methods("GET")
+	r.HandleFunc("/dashboard/teams", h.dashboardHandler).Methods("GET")
+	r.HandleFunc("/dashboard/changes", h.dashboardSocketHandler).Methods("GET")
+
+	addProbeRoutes(r, h.readiness)
+	return logRequests(r, "", probePaths)
+}
+
+// authenticate returns the principal if it is an admin.
+func (h *adminEndpoints) authenticate(r *http.Request) (*principal, error) {
+	return h.authorize(r, r.Header.Get("authorization"), roleAdmin)
+}
+
+// authorize returns the principal of the token if it has one of the roles,
+// the log of the request is tagged with the user.
+func (h *adminEndpoints) authorize(r *http.Request, token string, roles ...role) (*principal, error) {
+	p, err := h.auth.authenticate(token, remoteIP(r))
+	if err != nil {
+		return nil, err
+	}
+	setRequestUser(r, p.user.Name)
+	for _, want := range roles {
+		if p.user.Role == want {
+			return p, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// shutdown closes open dashboards waiting for them up to the timeout.
+func (h *adminEndpoints) shutdown(timeout time.Duration) {
+	if !h.drainer.drain(timeout) {
+		logs.warn("dashboards are still open", "after", timeout.String())
+	}
+	h.dashboard.close()
+}
+
+func (h *adminEndpoints) pageAdminHandler(w http.ResponseWriter, r *http.Request) {
+	h.template.render(w, &page{Name: "admin.html", Team: "Admin"}, r.Header.Get("If-None-Match"))
+}
+
+func (h *adminEndpoints) authHandler(w http.ResponseWriter, r *http.Request) {
+	n := queryKeySingular(r, "name")
+	c := queryKeySingular(r, "passcode")
+	if len(n) == 0 || len(c) == 0 {
+		writeAPIError(w, newClientError("name and passcode are required"))
+		return
+	}
+
+	t, err := h.auth.login(n, c, remoteIP(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("authorization", t)
+}
+
+func (h *adminEndpoints) teamsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := h.authenticate(r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	list, err := h.catalog.list()
+	if err != nil {
+		writeAPIError(w, &systemError{err: err, msg: "admin: failed to list teams"})
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// teamsSaveHandler creates a team or replaces settings of an existing one,
+// omitted settings get defaults.
+func (h *adminEndpoints) teamsSaveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, err := h.authenticate(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	t := new(team)
+	if err := json.NewDecoder(io.LimitReader(r.Body, teamMaxSize)).Decode(t); err != nil {
+		writeAPIError(w, newClientError("team is invalid JSON"))
+		return
+	}
+	if len(t.Name) == 0 {
+		writeAPIError(w, newClientError("team name is required"))
+		return
+	}
+	action := "team.save"
+	if existing, err := h.catalog.get(t.Name); err == nil && existing == nil {
+		action = "team.create"
+	}
+	err = h.catalog.save(&teamRecord{Name: t.Name, Team: t})
+	h.audit(r, p, action, t.Name, err)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+// teamsSuspendHandler stops or starts a team keeping its settings and data.
+func (h *adminEndpoints) teamsSuspendHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	name := queryKeySingular(r, "name")
+	t, err := h.catalog.get(name)
+	if err != nil {
+		writeAPIError(w, &systemError{err: err, msg: "admin: failed to get team " + name})
+		return
+	}
+	if t == nil {
+		writeAPIError(w, newClientError(fmt.Sprintf("team %q doesn't exist", name)))
+		return
+	}
+
+	changed := *t
+	changed.Suspended = filepath.Base(r.URL.Path) == "suspend"
+	err = h.catalog.save(&teamRecord{Name: name, Team: &changed})
+	h.audit(r, p, "team."+filepath.Base(r.URL.Path), name, err)
+	if err != nil {
+		writeAPIError(w, err)
+	}
+}
+
+// teamsRemoveHandler stops the team, its data is kept in the storage.
+func (h *adminEndpoints) teamsRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	name := queryKeySingular(r, "name")
+	if t, err := h.catalog.get(name); err != nil || t == nil {
+		writeAPIError(w, newClientError(fmt.Sprintf("team %q doesn't exist", name)))
+		return
+	}
+	err = h.catalog.save(&teamRecord{Name: name, Deleted: true})
+	h.audit(r, p, "team.remove", name, err)
+	if err != nil {
+		writeAPIError(w, err)
+	}
+}
+
+// audit logs an action of the admin and records it in the audit of the system shard.
+func (h *adminEndpoints) audit(r *http.Request, p *principal, action string, target string, err error) {
+	e := &auditEntry{
+		Actor:  p.user.Name,
+		Action: action,
+		Target: target,
+		IP:     remoteIP(r),
+		Result: auditResultOK,
+	}
+	l := requestLogger(r).with("admin", p.user.Name, "action", action, "target", target)
+	if err != nil {
+		e.Result = auditResultFailed
+		e.Error = err.Error()
+		l.warn("admin action failed", "err", err)
+	} else {
+		l.info("admin action")
+	}
+	if err := h.auditStore.append(e); err != nil {
+		l.error("audit failed to record", "err", err)
+	}
+}
+
+// auditHandler lists actions of admins, filters and pages are the same as of
+// the audit of a team.
+func (h *adminEndpoints) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.authenticate(r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	f, err := auditFilterOf(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAuditPage(w, h.auditStore, f)
+}
+
+// backupHandler streams a consistent snapshot of the storage of a running
+// team. Teams share a storage unless -db_per_team is set, then the snapshot
+// holds every team of it, so only admins get it.
+func (h *adminEndpoints) backupHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	name := queryKeySingular(r, "name")
+	t := h.catalog.fleet.handler(name)
+	if t == nil {
+		writeAPIError(w, newClientError(fmt.Sprintf("team %q isn't running", name)))
+		return
+	}
+
+	store := t.config.storage
+	file := backupName(strings.ToLower(name), storageKindOf(store), h.catalog.clock.Now())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+	// The status is sent with the first bytes, failures can only be logged.
+	if _, err := store.backup(w); err != nil {
+		requestLogger(r).error("backup failed to stream", "team", name, "err", err)
+		h.audit(r, p, "storage.backup", name, err)
+		return
+	}
+	h.audit(r, p, "storage.backup", name, nil)
+}
+
+// adminCommand creates or changes an admin or a coach, servers must be stopped.
+func adminCommand(args []string, dbdir string) error {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	name := flags.String("name", "", "Admin name")
+	passcode := flags.String("passcode", "", "Admin passcode")
+	remove := flags.Bool("remove", false, "Remove the admin")
+	r := flags.String("role", string(roleAdmin), "Role, admin manages teams, coach only watches the dashboard")
+	flags.Parse(args)
+
+	if err := validateUsername(*name); err != nil {
+		return err
+	}
+	if role(*r) != roleAdmin && role(*r) != roleCoach {
+		return fmt.Errorf("role must be %s or %s", roleAdmin, roleCoach)
+	}
+	if !*remove {
+		if err := validatePasscode(*passcode); err != nil {
+			return err
+		}
+	}
+	store, err := openSystemStorage(*storageKind, dbdir)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	admins, err := store.users(systemShard, maxAdmins)
+	if err != nil {
+		return err
+	}
+
+	if *remove {
+		if err := admins.delete(*name); err != nil {
+			return err
+		}
+		fmt.Printf("admin %s removed\n", *name)
+		return nil
+	}
+	// An existing admin is replaced, so a new passcode or role takes effect.
+	u := newUser(*name, role(*r))
+	u.setPasscode(*passcode)
+	if err := admins.create(u); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s saved\n", *r, *name)
+	return nil
+}
+
+// openSystemStorage opens the storage of the system shard, it is the storage
+// teams share unless each team has own one.
+func openSystemStorage(kind string, dbdir string) (storage, error) {
+	return openStorage(kind, filepath.Join(dbdir, dbPath))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminTeams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teams.json")
+
+	fleet, tenants, s := newTestFleet(t, dir)
+	defer s.close()
+	defer fleet.stopAll()
+	records, err := s.teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := newTeamCatalog(path, records, fleet, new(clock))
+	if err := catalog.load(writeTestTeams(t, path, `{"alpha": {"port": 8001}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	admins, err := s.users(systemShard, maxAdmins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := newUser("root", roleAdmin)
+	root.setPasscode("secret")
+	if err := admins.create(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := admins.create(newUser("voter", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+	audit, err := s.audit(systemShard, new(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newAdminEndpoints(catalog, admins, audit, loadTestTemplates(t, &page{}), newOriginPolicy(nil), new(clock))
+	router := newAdminRouter(h, &teamServerOpts{origins: newOriginPolicy(nil), staticDir: staticDir})
+
+	serve := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("authorization", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	running := func(name string) bool {
+		return serveTestTenant(tenants, "localhost", "/t/"+name+"/session").Code != http.StatusNotFound
+	}
+
+	assertStatus(t, serve("GET", "/", "", ""), http.StatusOK)
+	assertStatus(t, serve("GET", "/admin/teams", "", ""), http.StatusUnauthorized)
+	w := serve("POST", "/admin/auth?name=voter&passcode=voter", "", "")
+	assertStatus(t, w, http.StatusOK)
+	voter := w.Header().Get("authorization")
+	assertStatus(t, serve("GET", "/admin/teams", voter, ""), http.StatusForbidden)
+
+	w = serve("POST", "/admin/auth?name=root&passcode=secret", "", "")
+	assertStatus(t, w, http.StatusOK)
+	token := w.Header().Get("authorization")
+
+	assertStatus(t, serve("POST", "/admin/teams/save", token, `{"name": "gamma", "preference": {"max_fib": 8}}`), http.StatusOK)
+	if !running("gamma") {
+		t.Fatal("expected created team to be running")
+	}
+	assertStatus(t, serve("POST", "/admin/teams/save", token, `{"name": "gamma", "port": 80}`), http.StatusBadRequest)
+	// Names are paths of storages and tenants, whatever the mode.
+	for _, name := range []string{"system", "System", "../../tmp/x", "a b", ""} {
+		assertStatus(t, serve("POST", "/admin/teams/save", token, `{"name": "`+name+`"}`), http.StatusBadRequest)
+	}
+
+	// A backup holds every team sharing the storage, so only admins get it.
+	assertStatus(t, serve("GET", "/admin/backup?name=gamma", voter, ""), http.StatusForbidden)
+	assertStatus(t, serve("GET", "/admin/backup?name=beta", token, ""), http.StatusBadRequest)
+	w = serve("GET", "/admin/backup?name=gamma", token, "")
+	assertStatus(t, w, http.StatusOK)
+	if d := w.Header().Get("Content-Disposition"); !strings.Contains(d, "gamma") || !strings.Contains(d, ".db") {
+		t.Fatalf("expected attachment of a bolt database of gamma, got %q", d)
+	}
+	snapshot := filepath.Join(dir, "snapshot.db")
+	if err := ioutil.WriteFile(snapshot, w.Body.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := openBoltStorage(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredAdmins, err := restored.users(systemShard, maxAdmins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := restoredAdmins.get("root"); u == nil {
+		t.Fatal("expected admins of the shared storage in the snapshot")
+	}
+	restored.close()
+
+	assertStatus(t, serve("POST", "/admin/teams/suspend?name=gamma", token, ""), http.StatusOK)
+	if running("gamma") {
+		t.Fatal("expected suspended team to be stopped")
+	}
+	assertStatus(t, serve("POST", "/admin/teams/resume?name=gamma", token, ""), http.StatusOK)
+	if !running("gamma") {
+		t.Fatal("expected resumed team to be running")
+	}
+
+	// Teams of the file are removed by admins too.
+	assertStatus(t, serve("POST", "/admin/teams/remove?name=alpha", token, ""), http.StatusOK)
+	if running("alpha") {
+		t.Fatal("expected removed team to be stopped")
+	}
+	assertStatus(t, serve("POST", "/admin/teams/remove?name=alpha", token, ""), http.StatusBadRequest)
+
+	// Actions of admins are kept in the audit of the system shard.
+	w = serve("GET", "/admin/audit?actor=root", token, "")
+	assertStatus(t, w, http.StatusOK)
+	var page struct {
+		Entries []*auditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range page.Entries {
+		actions = append([]string{e.Action + " " + e.Target + " " + e.Result}, actions...)
+	}
+	want := []string{"team.create gamma ok", "team.save gamma failed", "team.create system failed", "team.create System failed",
+		"team.create ../../tmp/x failed", "team.create a b failed", "storage.backup gamma ok", "team.suspend gamma ok", "team.resume gamma ok", "team.remove alpha ok"}
+	if strings.Join(actions, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("expected audit %v, got %v", want, actions)
+	}
+
+	w = serve("GET", "/admin/teams", token, "")
+	assertStatus(t, w, http.StatusOK)
+	var list []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0]["name"] != "gamma" || list[0]["source"] != teamSourceAdmin || list[0]["running"] != true {
+		t.Fatalf("expected gamma managed by admins only, got %v", list)
+	}
+
+	// Changes are kept over restarts, the file is only a bootstrap source.
+	fleet.stopAll()
+	catalog = newTeamCatalog(path, records, fleet, new(clock))
+	if err := catalog.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if running("alpha") || !running("gamma") {
+		t.Fatal("expected stored changes to override the file")
+	}
+	if gamma := fleet.teams["gamma"].team; gamma.Preference.MaxFib != 8 {
+		t.Fatalf("expected gamma settings to be kept, got %+v", gamma.Preference)
+	}
+}
+
+func TestAdminCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin_cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := adminCommand([]string{"-name", "bob", "-passcode", "secret"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	// An invalid passcode is refused before the existing admin is touched.
+	if err := adminCommand([]string{"-name", "bob", "-passcode", "a,b"}, dir); err == nil {
+		t.Fatal("expected an invalid passcode to be refused")
+	}
+	if err := adminCommand([]string{"-name", "bob", "-passcode", "other", "-role", string(roleCoach)}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSystemStorage(*storageKind, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	admins, err := s.users(systemShard, maxAdmins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := admins.get("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob == nil || bob.Role != roleCoach || !bob.checkPasscode("other") {
+		t.Fatalf("expected bob to be replaced, got %+v", bob)
+	}
+}
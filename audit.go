@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const auditBucketName = "audit"
+
+const (
+	auditResultOK     = "ok"
+	auditResultDenied = "denied"
+	auditResultFailed = "failed"
+)
+
+type auditEntry struct {
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	IP     string    `json:"ip"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (e *auditEntry) csv() []string {
+	return []string{
+		fmt.Sprintf("%d", e.ID), e.Time.Format(time.RFC3339), e.Actor,
+		e.Action, e.Target, e.IP, e.Result, e.Error,
+	}
+}
+
+var auditCSVHeader = []string{"id", "time", "actor", "action", "target", "ip", "result", "error"}
+
+// auditFilter selects entries, zero fields match everything.
+type auditFilter struct {
+	Actor  string
+	Action string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Before int
+	Limit  int
+}
+
+func (f *auditFilter) match(e *auditEntry) bool {
+	if len(f.Actor) > 0 && f.Actor != e.Actor {
+		return false
+	}
+	// Action matches by prefix, so "session" selects every session action.
+	if len(f.Action) > 0 && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if len(f.Result) > 0 && f.Result != e.Result {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// auditStore is an append only log of privileged and session changing actions.
+type auditStore interface {
+	// append assigns an id and, unless set, a time to the entry.
+	append(e *auditEntry) error
+	// list returns matching entries newest first. Pagination continues from
+	// the id of the last returned entry through filter.Before.
+	list(f *auditFilter) ([]*auditEntry, error)
+	// each calls fn for every matching entry newest first until fn returns false.
+	each(f *auditFilter, fn func(e *auditEntry) bool) error
+}
+
+func listAuditEntries(s auditStore, f *auditFilter) ([]*auditEntry, error) {
+	entries := make([]*auditEntry, 0)
+	err := s.each(f, func(e *auditEntry) bool {
+		entries = append(entries, e)
+		return f.Limit <= 0 || len(entries) < f.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type boltAuditStore struct {
+	db     *bolt.DB
+	bucket []byte
+	clock  *clock
+}
+
+func newBoltAuditStore(db *bolt.DB, shard string, c *clock) (*boltAuditStore, error) {
+	s := new(boltAuditStore)
+	s.db = db
+	s.clock = c
+	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, auditBucketName))
+	if err := createBucket(s.db, s.bucket); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltAuditStore) append(e *auditEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = int(id)
+		if e.Time.IsZero() {
+			e.Time = s.clock.Now()
+		}
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(e.ID), buf)
+	})
+}
+
+func (s *boltAuditStore) list(f *auditFilter) ([]*auditEntry, error) {
+	return listAuditEntries(s, f)
+}
+
+func (s *boltAuditStore) each(f *auditFilter, fn func(e *auditEntry) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+
+		var k, v []byte
+		if f.Before > 0 {
+			k, v = c.Seek(itob(f.Before))
+			if k != nil {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Last()
+			}
+		} else {
+			k, v = c.Last()
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			e := new(auditEntry)
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			if !f.match(e) {
+				continue
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+type auditPage struct {
+	Entries []*auditEntry `json:"entries"`
+	Next    int           `json:"next"`
+}
+
+func TestAuditTrail(t *testing.T) {
+	voter := &testerModel{"auditee", "auditee", "voter"}
+	addVoter(t, voter)
+	defer testHandler.userStore.delete(voter.Name)
+
+	// A voter is not allowed to add users.
+	r, err := http.NewRequest("POST", "/users/add?name=intruder&role=voter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("authorization", signinUser(t, voter))
+	w := httptest.NewRecorder()
+	http.HandlerFunc(testHandler.usersAddHandler).ServeHTTP(w, r)
+	assertStatus(t, w, http.StatusForbidden)
+
+	fetch := func(user *testerModel, query string, status int) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", "/audit?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("authorization", signinUser(t, user))
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.auditHandler).ServeHTTP(w, r)
+		assertStatus(t, w, status)
+		return w
+	}
+	fetch(voter, "", http.StatusForbidden)
+
+	var page auditPage
+	w = fetch(master, "action=users.add&limit=1", http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Next == 0 {
+		t.Fatalf("expected a single entry and a next page, got %d entries, next %d", len(page.Entries), page.Next)
+	}
+	e := page.Entries[0]
+	if e.Actor != voter.Name || e.Target != "intruder" || e.Result != auditResultDenied {
+		t.Fatalf("unexpected latest entry %+v", e)
+	}
+
+	w = fetch(master, "action=users.add&actor=master&before="+strconv.Itoa(e.ID), http.StatusOK)
+	page = auditPage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	before := e.ID
+	for _, e := range page.Entries {
+		if e.ID >= before {
+			t.Fatal("entries must be ordered newest first and older than the cursor")
+		}
+		before = e.ID
+		if e.Actor != master.Name {
+			t.Fatalf("filter by actor returned %s", e.Actor)
+		}
+		found = found || (e.Target == voter.Name && e.Result == auditResultOK)
+	}
+	if !found {
+		t.Fatal("addition of the voter is missing in the audit trail")
+	}
+
+	w = fetch(master, "format=csv&result=denied", http.StatusOK)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 2 || rows[0][0] != "id" {
+		t.Fatalf("csv export must have a header and entries, got %v", rows)
+	}
+	for _, row := range rows[1:] {
+		if row[6] != auditResultDenied {
+			t.Fatalf("csv export ignored the result filter, got %v", row)
+		}
+	}
+
+	fetch(master, "since=yesterday", http.StatusBadRequest)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const backupTimeFormat = "20060102T150405Z"
+
+// Scheduled backups, disabled unless the directory is set.
+var (
+	backupDir      = flag.String("backup_dir", "", "Directory of scheduled backups, they are disabled if empty")
+	backupInterval = flag.Duration("backup_interval", 24*time.Hour, "Period of scheduled backups")
+	backupKeep     = flag.Int("backup_keep", 7, "Number of scheduled backups kept per storage")
+)
+
+func (s *boltStorage) backup(w io.Writer) (int64, error) {
+	var n int64
+	// A read transaction sees a consistent snapshot while writers go on.
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func (s *sqliteStorage) backup(w io.Writer) (int64, error) {
+	dir, err := ioutil.TempDir("", "scoreboard-backup")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.sqlite")
+	if _, err := s.db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// snapshotSchemaVersion checks that the file is a storage of the kind,
+// which can be migrated by this build, and returns its schema version.
+func snapshotSchemaVersion(kind string, path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+
+	var version, latest int
+	switch kind {
+	case storageBolt:
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+		if err != nil {
+			return 0, fmt.Errorf("%s is not a bolt database: %v", path, err)
+		}
+		defer db.Close()
+		db.View(func(tx *bolt.Tx) error {
+			version = boltSchemaVersion(tx)
+			return nil
+		})
+		latest = latestBoltSchemaVersion()
+	case storageSqlite:
+		db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro", path))
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		var tables int
+		if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables); err != nil {
+			return 0, fmt.Errorf("%s is not a sqlite database: %v", path, err)
+		}
+		if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+			return 0, err
+		}
+		latest = latestSqliteSchemaVersion()
+	default:
+		return 0, fmt.Errorf("unknown storage %q", kind)
+	}
+
+	if version > latest {
+		return 0, fmt.Errorf("snapshot schema version %d is newer than %d supported by this build", version, latest)
+	}
+	return version, nil
+}
+
+// backupName returns a file name of a snapshot, names sort by time.
+func backupName(label string, kind string, t time.Time) string {
+	return storageFile(kind, fmt.Sprintf("%s-%s", label, t.UTC().Format(backupTimeFormat)))
+}
+
+func writeBackup(s storage, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := s.backup(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pruneBackups removes all but the newest keep backups of the label.
+func pruneBackups(dir string, label string, kind string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, storageFile(kind, label+"-*")))
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// backupLabels names every distinct storage after its team, or after the
+// shared database.
+func backupLabels(stores teamStorages, perTeam bool) map[storage]string {
+	labels := make(map[storage]string)
+	for name, s := range stores {
+		if perTeam {
+			labels[s] = strings.ToLower(name)
+		} else {
+			labels[s] = dbPath
+		}
+	}
+	return labels
+}
+
+// scheduleBackups writes snapshots of every storage into the directory each
+// interval until stop is closed.
+func scheduleBackups(labels map[storage]string, kind string, dir string, interval time.Duration, keep int, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for s, label := range labels {
+				path := filepath.Join(dir, backupName(label, kind, now))
+				if err := writeBackup(s, path); err != nil {
+					logs.error("backup failed to write", "path", path, "err", err)
+					continue
+				}
+				if err := pruneBackups(dir, label, kind, keep); err != nil {
+					logs.error("backup failed to prune", "label", label, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// backupCommand writes a snapshot of the storage of a team, the shared
+// storage is used unless -db_per_team is set.
+func backupCommand(args []string, dbdir string, teams map[string]*team) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	teamName := flags.String("team", "", "Team of the storage, required with -db_per_team")
+	out := flags.String("out", "", "Snapshot path, defaults to a timestamped file in the current directory")
+	flags.Parse(args)
+
+	name := *teamName
+	if len(name) == 0 && !*databasePerTeam {
+		name = sortedTeamNames(teams)[0]
+	}
+	if _, ok := teams[name]; !ok {
+		return fmt.Errorf("unknown team %q", name)
+	}
+
+	stores, _, err := openTeamStorages(*storageKind, dbdir, *databasePerTeam, teams, false)
+	if err != nil {
+		return err
+	}
+	defer stores.close()
+	s := stores[name]
+	label := backupLabels(stores, *databasePerTeam)[s]
+
+	path := *out
+	if len(path) == 0 {
+		path = backupName(label, *storageKind, time.Now())
+	}
+	if err := writeBackup(s, path); err != nil {
+		return err
+	}
+	fmt.Printf("backup written to %s\n", path)
+	return nil
+}
+
+// checkStorageUnused returns an error while a server may hold the storage.
+// Opening a bolt file fails while it is locked. Sqlite doesn't lock the file,
+// but its last connection removes the write ahead log on a clean close, so the
+// log left next to the file means the database is open or wasn't shut down.
+// Replacing the file then would apply pages of the log to the snapshot.
+func checkStorageUnused(kind string, path string) error {
+	file := storageFile(kind, path)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+	if kind == storageSqlite {
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if _, err := os.Stat(file + suffix); err == nil {
+				return fmt.Errorf("storage is in use or wasn't shut down, %s exists, stop servers before restoring", file+suffix)
+			}
+		}
+		return nil
+	}
+	s, err := openStorage(kind, path)
+	if err != nil {
+		return fmt.Errorf("storage is in use, stop servers before restoring: %v", err)
+	}
+	s.close()
+	return nil
+}
+
+// restoreCommand replaces the storage file with a snapshot, servers must be stopped.
+func restoreCommand(args []string, dbdir string, teams map[string]*team) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	teamName := flags.String("team", "", "Team of the storage, required with -db_per_team")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-team name] <snapshot>")
+	}
+	snapshot := flags.Arg(0)
+
+	target := filepath.Join(dbdir, dbPath)
+	if *databasePerTeam {
+		if _, ok := teams[*teamName]; !ok {
+			return fmt.Errorf("unknown team %q", *teamName)
+		}
+		target = teamStoragePath(dbdir, *teamName)
+	}
+
+	version, err := snapshotSchemaVersion(*storageKind, snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err := checkStorageUnused(*storageKind, target); err != nil {
+		return err
+	}
+	target = storageFile(*storageKind, target)
+	src, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := target + ".restoring"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return err
+	}
+	fmt.Printf("restored %s from %s with schema version %d\n", target, snapshot, version)
+	return nil
+}
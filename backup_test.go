@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		name := backupName("team", storageBolt, start.Add(time.Duration(i)*time.Hour))
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(dir, backupName("other", storageBolt, start))
+	if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneBackups(dir, "team", storageBolt, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := os.Stat(filepath.Join(dir, backupName("team", storageBolt, start.Add(time.Duration(i)*time.Hour))))
+		if kept := err == nil; kept != (i >= 3) {
+			t.Fatalf("backup %d kept %v, wanted only the newest 2", i, kept)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatal("backups of other storages must be kept")
+	}
+}
+
+func TestRestoreSqliteInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	*storageKind = storageSqlite
+
+	s, err := openStorage(storageSqlite, filepath.Join(dir, dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.migrate(&migrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.users("team", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.create(newUser("va", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(dir, "snapshot.sqlite")
+	if err := writeBackup(s, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	teams := map[string]*team{"team": {Name: "team"}}
+	if err := restoreCommand([]string{snapshot}, dir, teams); err == nil || !strings.Contains(err.Error(), "-wal") {
+		t.Fatalf("expected restore of an open database to fail, got %v", err)
+	}
+	s.close()
+	if err := restoreCommand([]string{snapshot}, dir, teams); err != nil {
+		t.Fatal(err)
+	}
+}
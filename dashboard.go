@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// roleCoach watches sessions of all teams on the dashboard, coaches are kept
+// in the system shard with admins and have no role in teams.
+const roleCoach role = "coach"
+
+// dashboardCheckPeriod is how often sessions are checked for changes to push
+// to dashboard clients.
+const dashboardCheckPeriod = 1 * time.Second
+
+// teamSummary is the session of a team as shown on the dashboard.
+type teamSummary struct {
+	Team      string `json:"team"`
+	Running   bool   `json:"running"`
+	Suspended bool   `json:"suspended"`
+	// Open is true while the team has a session, the rest is of the current poll.
+	Open   bool   `json:"open"`
+	Leader string `json:"leader"`
+	Voters int    `json:"voters"`
+	Voted  int    `json:"voted"`
+	// Active is the time of the last change of the session, nil unless running.
+	Active *time.Time `json:"active,omitempty"`
+}
+
+// summary reads the session of the team.
+func (h *endpoints) summary() *teamSummary {
+	sm := &teamSummary{Team: h.team().Name, Running: true}
+	h.sessionTopic.readPartial(func(s *session) error {
+		active := s.active
+		sm.Active = &active
+		c := s.getChain()
+		if c == nil {
+			return nil
+		}
+		sm.Open = true
+		sm.Leader = c.leader.name
+		poll := c.current()
+		for voter := range poll.voters {
+			sm.Voters++
+			if poll.isVoted(voter) {
+				sm.Voted++
+			}
+		}
+		return nil
+	})
+	return sm
+}
+
+// summaries returns sessions of running teams by name.
+func (f *teamFleet) summaries() map[string]*teamSummary {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	summaries := make(map[string]*teamSummary, len(f.teams))
+	for name, ft := range f.teams {
+		summaries[name] = ft.handler.summary()
+	}
+	return summaries
+}
+
+// summaries returns every team with its session, stopped teams have none.
+func (c *teamCatalog) summaries() ([]*teamSummary, error) {
+	list, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	running := c.fleet.summaries()
+	summaries := make([]*teamSummary, 0, len(list))
+	for _, st := range list {
+		sm, ok := running[st.Name]
+		if !ok {
+			sm = &teamSummary{Team: st.Name}
+		}
+		sm.Suspended = st.Suspended
+		summaries = append(summaries, sm)
+	}
+	return summaries, nil
+}
+
+func (h *adminEndpoints) pageDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	h.template.render(w, &page{Name: "dashboard.html", Team: "Dashboard"}, r.Header.Get("If-None-Match"))
+}
+
+func (h *adminEndpoints) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := h.authorize(r, r.Header.Get("authorization"), roleAdmin, roleCoach); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	summaries, err := h.catalog.summaries()
+	if err != nil {
+		writeAPIError(w, &systemError{err: err, msg: "dashboard: failed to list teams"})
+		return
+	}
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// dashboardSocketHandler pushes the teams whenever a session changes. The
+// dashboard is read only, messages of the client are discarded.
+func (h *adminEndpoints) dashboardSocketHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authorize(r, queryKeySingular(r, "authorization"), roleAdmin, roleCoach)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if !h.drainer.enter() {
+		writeAPIError(w, errShuttingDown)
+		return
+	}
+	defer h.drainer.leave()
+
+	l := requestLogger(r).with("user", p.user.Name, "remote", r.RemoteAddr)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.warn("dashboard upgrade failed", "err", err)
+		return
+	}
+	wsStat.Inc()
+	l.info("dashboard connected")
+
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(socketReadLimit)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := newClient(p.user.Name)
+	h.dashboard.enter(c)
+	ping := time.NewTicker(webSocketPingPeriod)
+	reason := "closed"
+	defer func() {
+		h.dashboard.leave(c)
+		ping.Stop()
+		conn.Close()
+		wsStat.Dec()
+		l.info("dashboard disconnected", "reason", reason)
+	}()
+
+	for {
+		select {
+		case msg := <-c.msg:
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := conn.WriteJSON(msg.get(p)); err != nil {
+				reason = err.Error()
+				return
+			}
+		case <-c.gone:
+			reason = "too slow"
+			l.warn("client is too slow, disconnecting")
+			return
+		case <-closed:
+			return
+		case <-h.drainer.done():
+			reason = socketCloseRestarting
+			closeSocketRestarting(conn)
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(socketWriteWait)); err != nil {
+				reason = err.Error()
+				return
+			}
+		}
+	}
+}
+
+// dashboardSummaries is a push of the dashboard, it is the same for everybody.
+type dashboardSummaries []*teamSummary
+
+func (m dashboardSummaries) get(p *principal) interface{} {
+	return []*teamSummary(m)
+}
+
+// dashboardTopic reads summaries of teams once per check for all open
+// dashboards and pushes them when they change. Reading waits for the catalog
+// while teams are applied, it happens aside, so clients keep being served.
+type dashboardTopic struct {
+	catalog  *teamCatalog
+	clients  map[*client]bool
+	entering chan *client
+	leaving  chan *client
+	updates  chan dashboardSummaries
+	// wake asks for summaries right away, the first dashboard doesn't wait for a check.
+	wake     chan bool
+	stop     chan bool
+	stopOnce sync.Once
+	// watched is the number of clients, summaries aren't read while it is zero.
+	watched int32
+}
+
+func newDashboardTopic(catalog *teamCatalog, period time.Duration) *dashboardTopic {
+	t := new(dashboardTopic)
+	t.catalog = catalog
+	t.clients = make(map[*client]bool)
+	t.entering = make(chan *client)
+	t.leaving = make(chan *client)
+	t.updates = make(chan dashboardSummaries)
+	t.wake = make(chan bool, 1)
+	t.stop = make(chan bool)
+	go t.broadcaster()
+	go t.reader(period)
+	return t
+}
+
+func (t *dashboardTopic) enter(c *client) {
+	select {
+	case t.entering <- c:
+	case <-t.stop:
+	}
+}
+
+func (t *dashboardTopic) leave(c *client) {
+	select {
+	case t.leaving <- c:
+	case <-t.stop:
+	}
+}
+
+// close stops reading summaries and pushing them.
+func (t *dashboardTopic) close() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+func (t *dashboardTopic) broadcaster() {
+	var last dashboardSummaries
+	for {
+		select {
+		case m := <-t.updates:
+			if last != nil && reflect.DeepEqual(m, last) {
+				continue
+			}
+			last = m
+			for c := range t.clients {
+				if !c.deliver(m) {
+					delete(t.clients, c)
+					c.drop()
+				}
+			}
+		case c := <-t.entering:
+			t.clients[c] = true
+			atomic.StoreInt32(&t.watched, int32(len(t.clients)))
+			if last != nil {
+				c.deliver(last)
+			} else {
+				select {
+				case t.wake <- true:
+				default:
+				}
+			}
+		case c := <-t.leaving:
+			delete(t.clients, c)
+			atomic.StoreInt32(&t.watched, int32(len(t.clients)))
+			// Summaries aren't read without clients, the last ones get stale.
+			if len(t.clients) == 0 {
+				last = nil
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// reader reads summaries every period while dashboards are open.
+func (t *dashboardTopic) reader(period time.Duration) {
+	check := time.NewTicker(period)
+	defer check.Stop()
+	for {
+		select {
+		case <-check.C:
+		case <-t.wake:
+		case <-t.stop:
+			return
+		}
+		if atomic.LoadInt32(&t.watched) == 0 {
+			continue
+		}
+		summaries, err := t.catalog.summaries()
+		if err != nil {
+			logs.error("dashboard failed to list teams", "err", err)
+			continue
+		}
+		select {
+		case t.updates <- dashboardSummaries(summaries):
+		case <-t.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDashboard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teams.json")
+
+	fleet, _, s := newTestFleet(t, dir)
+	defer s.close()
+	defer fleet.stopAll()
+	records, err := s.teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := newTeamCatalog(path, records, fleet, new(clock))
+	if err := catalog.load(writeTestTeams(t, path, `{"alpha": {}, "beta": {"suspended": true}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	admins, err := s.users(systemShard, maxAdmins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coach := newUser("coach", roleCoach)
+	coach.setPasscode("secret")
+	if err := admins.create(coach); err != nil {
+		t.Fatal(err)
+	}
+	audit, err := s.audit(systemShard, new(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newAdminEndpoints(catalog, admins, audit, loadTestTemplates(t, &page{}), newOriginPolicy(nil), new(clock))
+	router := newAdminRouter(h, &teamServerOpts{origins: newOriginPolicy(nil), staticDir: staticDir})
+
+	serve := func(method string, path string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("authorization", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("POST", "/admin/auth?name=coach&passcode=secret", "")
+	assertStatus(t, w, http.StatusOK)
+	token := w.Header().Get("authorization")
+
+	assertStatus(t, serve("GET", "/dashboard", ""), http.StatusOK)
+	assertStatus(t, serve("GET", "/dashboard/teams", ""), http.StatusUnauthorized)
+	assertStatus(t, serve("GET", "/admin/teams", token), http.StatusForbidden)
+
+	w = serve("GET", "/dashboard/teams", token)
+	assertStatus(t, w, http.StatusOK)
+	var summaries []*teamSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || !summaries[0].Running || summaries[0].Open || summaries[0].Active == nil ||
+		summaries[1].Running || !summaries[1].Suspended {
+		t.Fatalf("expected alpha running without a session and beta suspended, got %+v %+v", summaries[0], summaries[1])
+	}
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/dashboard/changes?authorization=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readFrom := func(conn *websocket.Conn) []*teamSummary {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var summaries []*teamSummary
+		if err := conn.ReadJSON(&summaries); err != nil {
+			t.Fatal(err)
+		}
+		return summaries
+	}
+	read := func() []*teamSummary { return readFrom(conn) }
+	if summaries := read(); len(summaries) != 2 || summaries[0].Open {
+		t.Fatalf("expected the current teams first, got %+v", summaries[0])
+	}
+
+	// Changes of a session are pushed.
+	alpha := fleet.teams["alpha"].handler
+	alpha.sessionTopic.write(func(s *session, m *modelMasker) error {
+		s.setChain(newPollChain(&leader{name: "lead", clock: new(clock)}, []string{"va", "vb"}))
+		s.getChain().current().accept("va", 3)
+		return nil
+	})
+	sm := read()[0]
+	if !sm.Open || sm.Leader != "lead" || sm.Voters != 2 || sm.Voted != 1 {
+		t.Fatalf("expected the open session of alpha, got %+v", sm)
+	}
+
+	// Teams being applied hold the fleet, dashboards still get the last summaries.
+	fleet.mux.Lock()
+	other, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		fleet.mux.Unlock()
+		t.Fatal(err)
+	}
+	defer other.Close()
+	sm = readFrom(other)[0]
+	fleet.mux.Unlock()
+	if !sm.Open || sm.Leader != "lead" {
+		t.Fatalf("expected the last summaries while teams are applied, got %+v", sm)
+	}
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/casbin/casbin"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
@@ -18,14 +20,25 @@ var (
 	validUserName     = regexp.MustCompile(`^[a-zA-Z]+[a-zA-Z0-9]*$`)
 	reservedUserNames = regexp.MustCompile(`^master$`)
 	maxUsernameLength = 20
+	maxPasscodeLength = 64
 	voterSkipScore    = -2
+	auditPageSize     = 50
+	auditMaxPageSize  = 500
+	teamImportMaxSize = 32 << 20
 )
 
 type endpointsConfig struct {
 	templateMgr   *templateMgr
-	userStore     *userStore
-	linkStore     *linksStore
-	enforcer      *casbin.Enforcer
+	userStore     userStore
+	linkStore     linkStore
+	policyStore   *policyStore
+	auditStore    auditStore
+	inviteStore   inviteStore
+	pollStore     pollStore
+	snapshotStore snapshotStore
+	storage       storage
+	origins       *originPolicy
+	enforcer      *casbin.SyncedEnforcer
 	team          *team
 	clock         *clock
 	chromeExtFile string
@@ -36,60 +49,177 @@ type endpoints struct {
 	auth         *auth
 	sessionTopic *sessionTopic
 	templateMgr  *templateMgr
-	userStore    *userStore
-	linkStore    *linksStore
+	userStore    userStore
+	linkStore    linkStore
+	policyStore  *policyStore
+	auditStore   auditStore
+	inviteStore  inviteStore
 	leader       *leader
+	guard        *loginGuard
 	online       *online
-	quota        map[string]int
+	upgrader     *websocket.Upgrader
+	// drainer closes open boards on shutdown.
+	drainer *drainer
+	conns   *connLimit
+	metrics *teamMetrics
+
+	// teamMux guards the team, it is replaced on reload.
+	teamMux sync.RWMutex
 }
 
-func newEndpoints(config *endpointsConfig) *endpoints {
+// quotaUsage is a limit of the team and how much of it is used.
+type quotaUsage struct {
+	Used int `json:"used"`
+	Max  int `json:"max"`
+}
+
+// newEndpoints sets the master of the team and starts its session, which is
+// stopped by shutdown.
+func newEndpoints(config *endpointsConfig) (*endpoints, error) {
+	// set master from settings
+	users, err := config.userStore.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Role == roleMaster {
+			if err = config.userStore.delete(u.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = config.userStore.create(newUser(config.team.Master, roleMaster)); err != nil {
+		return nil, err
+	}
+
 	h := new(endpoints)
 	h.config = config
 
-	if onlineEnabledFlag {
-		// h.online = newOnline()
+	s := newSession(config.clock)
+	if config.team.Presence != nil && !config.team.Presence.Disabled {
+		h.online = newOnline(config.clock, config.team.Presence.getIdleAfter(), h.presenceChanged)
+		s.presence = h.online
 	}
 
 	h.templateMgr = config.templateMgr
-	h.sessionTopic = newSessionTopic(newSession(config.clock), notificationBufferSize)
+	h.sessionTopic = newSessionTopic(s, notificationBufferSize)
 	h.linkStore = config.linkStore
 	h.userStore = config.userStore
+	h.policyStore = config.policyStore
+	h.auditStore = config.auditStore
+	h.inviteStore = config.inviteStore
+	h.guard = newLoginGuard(config.clock)
+	h.upgrader = &websocket.Upgrader{CheckOrigin: config.origins.check}
+	h.drainer = newDrainer()
 	h.leader = &leader{
 		clock:   config.clock,
 		maxLife: config.team.getLeaderDuration(),
 	}
+	if config.snapshotStore != nil {
+		h.restoreSession()
+	}
+	// init authorization
+	h.auth = newAuth(h.userStore, h.config.enforcer, h.guard)
+
+	h.conns = newConnLimit(config.team.getQuota().Connections)
+	h.metrics = newTeamMetrics(config.team.Name)
+	runningTeams.add(h)
+	return h, nil
+}
+
+// quota returns usage of the team limits and the leader idle period in hours.
+func (h *endpoints) quota() (map[string]interface{}, error) {
 	users, err := h.userStore.list()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	// set master from settings
-	for _, u := range users {
-		if u.Role == roleMaster {
-			if err = h.userStore.delete(u.Name); err != nil {
-				log.Fatal(err)
-			}
-		}
+	links, err := h.linkStore.list()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"users":       &quotaUsage{Used: len(users), Max: h.userStore.getMaxUsers()},
+		"links":       &quotaUsage{Used: len(links), Max: h.linkStore.getMaxLinks()},
+		"connections": h.conns.usage(),
+		"leaderLife":  int(h.team().getLeaderDuration() / time.Hour),
+	}, nil
+}
+
+// team returns the current settings of the team.
+func (h *endpoints) team() *team {
+	h.teamMux.RLock()
+	defer h.teamMux.RUnlock()
+	return h.config.team
+}
+
+// reconfigure applies settings which don't need a restart, preferences and
+// the leader idle period, to the running team.
+func (h *endpoints) reconfigure(t *team) {
+	h.sessionTopic.write(func(s *session, m *modelMasker) error {
+		h.leader.maxLife = t.getLeaderDuration()
+		return nil
+	})
+
+	h.teamMux.Lock()
+	h.config.team = t
+	h.teamMux.Unlock()
+}
+
+// restoreSession reopens the session kept by the last shutdown, the snapshot
+// is deleted so a crash later doesn't bring back a stale session.
+func (h *endpoints) restoreSession() {
+	snap, err := h.config.snapshotStore.load()
+	if err != nil {
+		logs.error("session snapshot failed to load", "team", h.team().Name, "err", err)
+		return
 	}
-	master := newUser(h.config.team.Master, roleMaster)
-	if err = h.userStore.create(master); err != nil {
-		log.Fatal(err)
+	if snap == nil {
+		return
 	}
+	h.sessionTopic.write(func(s *session, m *modelMasker) error {
+		s.restore(snap, h.leader)
+		return nil
+	})
+	if err := h.config.snapshotStore.save(nil); err != nil {
+		logs.error("session snapshot failed to delete", "team", h.team().Name, "err", err)
+	}
+	logs.info("session restored", "team", h.team().Name, "time", snap.Time.Format(time.RFC3339))
+}
 
-	// init authorization
-	h.auth = &auth{store: h.userStore, enforcer: h.config.enforcer}
+// shutdown closes open boards, waiting for them up to the timeout, stops the
+// background work of the team and keeps the open session for the next start.
+func (h *endpoints) shutdown(timeout time.Duration) {
+	if !h.drainer.drain(timeout) {
+		logs.warn("boards are still open", "team", h.team().Name, "after", timeout.String())
+	}
+	h.close()
+	if h.config.snapshotStore == nil {
+		return
+	}
+	var snap *sessionSnapshot
+	h.sessionTopic.readPartial(func(s *session) error {
+		snap = s.snapshot(h.config.clock.Now())
+		return nil
+	})
+	if err := h.config.snapshotStore.save(snap); err != nil {
+		logs.error("session snapshot failed to save", "team", h.team().Name, "err", err)
+	}
+}
 
-	h.quota = make(map[string]int)
-	h.quota["links"] = h.linkStore.getMaxLinks()
-	h.quota["users"] = h.userStore.getMaxUsers()
-	h.quota["leaderLife"] = int(config.team.getLeaderDuration() / time.Hour)
-	return h
+// close stops the session broadcaster and presence of the team, it is enough to
+// undo newEndpoints of a team which never served.
+func (h *endpoints) close() {
+	h.sessionTopic.close()
+	if h.online != nil {
+		h.online.close()
+	}
+	runningTeams.remove(h)
 }
 
 func (h *endpoints) sessionHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
@@ -101,13 +231,15 @@ func (h *endpoints) sessionHandler(w http.ResponseWriter, r *http.Request) {
 func (h *endpoints) sessionOpenHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
+	h.seen(p)
 	if !p.hasPermission("session", "open") {
+		h.audit(r, p, "session.open", "", errUnauthorized)
 		writeAPIError(w, errUnauthorized)
 		return
 	}
@@ -135,51 +267,79 @@ func (h *endpoints) sessionOpenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var prevLeader string
 	model, err := h.sessionTopic.write(func(s *session, m *modelMasker) error {
 		c := s.getChain()
 		if c != nil {
 			return errSessionOpen
 		}
+		prevLeader = h.leader.name
 		h.leader.name = p.user.Name
 		s.setChain(newPollChain(h.leader, voters))
 		return nil
 	})
+	h.audit(r, p, "session.open", strings.Join(voters, " "), err)
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
+	h.metrics.sessionsOpened.Inc()
+	if prevLeader != p.user.Name {
+		h.audit(r, p, "session.leader", p.user.Name, nil)
+	}
 	json.NewEncoder(w).Encode(model.get(p))
 }
 
 func (h *endpoints) sessionCloseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	model, err := h.closeSession(r, p)
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
+	json.NewEncoder(w).Encode(model.get(p))
+}
 
+func (h *endpoints) closeSession(r *http.Request, p *principal) (*modelMasker, error) {
+	h.seen(p)
 	hasPrem := p.hasPermission("session", "close@other")
+	var leaderName string
+	var expired bool
+	var finished *pollRecord
 	model, err := h.sessionTopic.write(func(s *session, m *modelMasker) error {
 		c := s.getChain()
 		if c == nil {
 			return errSessionClosed
 		}
+		leaderName = c.leader.name
 
+		expired = c.leader.isDead() && !c.leader.is(p.user.Name)
 		close := c.leader.isDead() || c.leader.is(p.user.Name) || hasPrem
 		if !close {
 			return newClientError("you are not leader or master")
 		}
+		finished = c.record(h.config.clock.Now())
 		s.setChain(nil)
 
 		return nil
 	})
+	h.audit(r, p, "session.close", leaderName, err)
 	if err != nil {
-		writeAPIError(w, err)
-		return
+		return nil, err
 	}
-	json.NewEncoder(w).Encode(model.get(p))
+	h.metrics.sessionsClosed.Inc()
+	if expired {
+		h.metrics.leaderExpirations.Inc()
+	}
+	h.recordPoll(r, finished)
+	return model, nil
 }
 
 func (h *endpoints) sessionVoteHandler(w http.ResponseWriter, r *http.Request) {
@@ -189,18 +349,30 @@ func (h *endpoints) sessionVoteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
-	if !p.hasPermission("session", "vote") {
-		writeAPIError(w, errUnauthorized)
+	if _, err := h.vote(r, p, score); err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
-	_, err = h.sessionTopic.write(func(s *session, m *modelMasker) error {
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// vote accepts the score of the principal, voterSkipScore leaves the
+// current poll and StatusNotVoted cancels the vote.
+func (h *endpoints) vote(r *http.Request, p *principal, score int) (*modelMasker, error) {
+	h.seen(p)
+	if !p.hasPermission("session", "vote") {
+		h.audit(r, p, "session.vote", "", errUnauthorized)
+		return nil, errUnauthorized
+	}
+
+	model, err := h.sessionTopic.write(func(s *session, m *modelMasker) error {
 		c := s.getChain()
 		if c == nil {
 			return errSessionClosed
@@ -223,29 +395,38 @@ func (h *endpoints) sessionVoteHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return nil
 	})
-
-	if err != nil {
-		writeAPIError(w, err)
-		return
+	if err == nil && score != voterSkipScore && score != StatusNotVoted {
+		h.metrics.votes.Inc()
 	}
-
-	w.WriteHeader(http.StatusAccepted)
+	return model, err
 }
 
 func (h *endpoints) sessionResetHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
-	if !p.hasPermission("session", "reset") {
-		writeAPIError(w, errUnauthorized)
+	model, err := h.resetSession(r, p)
+	if err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
+	json.NewEncoder(w).Encode(model.get(p))
+}
+
+func (h *endpoints) resetSession(r *http.Request, p *principal) (*modelMasker, error) {
+	h.seen(p)
+	if !p.hasPermission("session", "reset") {
+		h.audit(r, p, "session.reset", "", errUnauthorized)
+		return nil, errUnauthorized
+	}
+
+	var finished *pollRecord
 	model, err := h.sessionTopic.write(func(s *session, m *modelMasker) error {
 		c := s.getChain()
 		if c == nil {
@@ -255,24 +436,35 @@ func (h *endpoints) sessionResetHandler(w http.ResponseWriter, r *http.Request)
 			return newClientError("You are not leader")
 		}
 		c.leader.alive()
+		finished = c.record(h.config.clock.Now())
 		c.next()
 		return nil
 	})
+	h.audit(r, p, "session.reset", "", err)
 	if err != nil {
-		writeAPIError(w, err)
-		return
+		return nil, err
 	}
-
-	json.NewEncoder(w).Encode(model.get(p))
+	h.recordPoll(r, finished)
+	return model, nil
 }
 
 func (h *endpoints) sessionUmaskHandler(w http.ResponseWriter, r *http.Request) {
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
+	model, err := h.unmaskSession(r, p)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(model.get(p))
+}
+
+func (h *endpoints) unmaskSession(r *http.Request, p *principal) (*modelMasker, error) {
+	h.seen(p)
 	model, err := h.sessionTopic.write(func(s *session, m *modelMasker) error {
 		c := s.getChain()
 		if c == nil {
@@ -286,11 +478,11 @@ func (h *endpoints) sessionUmaskHandler(w http.ResponseWriter, r *http.Request)
 		m.noop = true
 		return nil
 	})
-	if err != nil {
-		writeAPIError(w, err)
-		return
+	h.audit(r, p, "session.unmask", "", err)
+	if err == nil {
+		h.metrics.unmasks.Inc()
 	}
-	json.NewEncoder(w).Encode(model.get(p))
+	return model, err
 }
 
 func (h *endpoints) usersHandler(w http.ResponseWriter, r *http.Request) {
@@ -303,66 +495,188 @@ func (h *endpoints) usersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// Hide passcodes
 	for _, u := range users {
-		u.Passcode = ""
+		u.PasscodeHash = ""
 	}
 	json.NewEncoder(w).Encode(users)
 }
 
 func (h *endpoints) usersAddHandler(w http.ResponseWriter, r *http.Request) {
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
 	n := queryKeySingular(r, "name")
-	if len(n) == 0 || strings.Contains(n, " ") {
-		writeAPIError(w,
-			newClientError("username is invalid"))
+	if err := validateUsername(n); err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
-	if len(n) > maxUsernameLength {
+	ur := queryKeySingular(r, "role")
+	if len(ur) == 0 {
 		writeAPIError(w,
-			newClientError(fmt.Sprintf("username is too long than %d chars",
-				maxUsernameLength)))
+			newClientError("user role is invalid"))
 		return
 	}
 
-	if !validUserName.MatchString(n) {
-		writeAPIError(w,
-			newClientError("username must not be number and must contain only letters"))
+	if !p.hasPermission("users", "add@"+ur) {
+		h.audit(r, p, "users.add", n, errUnauthorized)
+		writeAPIError(w, errUnauthorized)
 		return
 	}
 
-	if reservedUserNames.MatchString(n) {
-		writeAPIError(w,
-			newClientError("username is reserved"))
+	err = h.userStore.create(newUser(n, role(ur)))
+	h.audit(r, p, "users.add", n, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *endpoints) usersInviteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
 	ur := queryKeySingular(r, "role")
 	if len(ur) == 0 {
-		writeAPIError(w,
-			newClientError("user role is invalid"))
+		writeAPIError(w, newClientError("user role is invalid"))
 		return
 	}
 
-	if !p.hasPermission("users", "add@"+ur) {
+	if !p.hasPermission("users", "invite@"+ur) {
+		h.audit(r, p, "users.invite", ur, errUnauthorized)
 		writeAPIError(w, errUnauthorized)
 		return
 	}
 
-	err = h.userStore.create(newUser(n, role(ur)))
+	ttl := defaultInviteTTL
+	if v := queryKeySingular(r, "ttl"); len(v) > 0 {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 || ttl > maxInviteTTL {
+			writeAPIError(w, newClientError(fmt.Sprintf("ttl must be a duration up to %s", maxInviteTTL)))
+			return
+		}
+	}
+
+	uses := 1
+	if v := queryKeySingular(r, "uses"); len(v) > 0 {
+		if uses, err = strconv.Atoi(v); err != nil || uses < 0 {
+			writeAPIError(w, newClientError("uses must be a number, 0 means unlimited"))
+			return
+		}
+	}
+
+	i, err := h.inviteStore.create(role(ur), p.user.Name, ttl, uses)
+	h.audit(r, p, "users.invite", ur, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeAPIError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(i)
+}
+
+func (h *endpoints) usersInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	invites, err := h.inviteStore.list()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	// Only invites to roles the principal may invite are visible.
+	visible := make([]*invite, 0, len(invites))
+	for _, i := range invites {
+		if p.hasPermission("users", "invite@"+string(i.Role)) {
+			visible = append(visible, i)
+		}
+	}
+	json.NewEncoder(w).Encode(visible)
+}
+
+func (h *endpoints) usersInviteRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	i, err := h.inviteStore.get(queryKeySingular(r, "token"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if i == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !p.hasPermission("users", "invite@"+string(i.Role)) {
+		h.audit(r, p, "users.revoke_invite", string(i.Role), errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	err = h.inviteStore.delete(i.Token)
+	h.audit(r, p, "users.revoke_invite", string(i.Role), err)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *endpoints) usersJoinHandler(w http.ResponseWriter, r *http.Request) {
+	n := queryKeySingular(r, "name")
+	if err := validateUsername(n); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	c := queryKeySingular(r, "passcode")
+	if err := validatePasscode(c); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var joinedRole role
+	err := h.inviteStore.use(queryKeySingular(r, "token"), func(i *invite) error {
+		joinedRole = i.Role
+		u := newUser(n, i.Role)
+		u.setPasscode(c)
+		// A concurrent join or add of the name must not be replaced.
+		return h.userStore.add(u)
+	})
+	h.audit(r, &principal{user: &user{Name: n}}, "users.join", string(joinedRole), err)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	t, err := h.auth.login(n, c, remoteIP(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("authorization", t)
+	w.WriteHeader(http.StatusCreated)
 }
 
 func (h *endpoints) usersRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
@@ -390,11 +704,13 @@ func (h *endpoints) usersRemoveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !p.hasPermission("users", "remove@"+string(u.Role)) {
+		h.audit(r, p, "users.remove", u.Name, errUnauthorized)
 		writeAPIError(w, errUnauthorized)
 		return
 	}
 
 	err = h.userStore.delete(u.Name)
+	h.audit(r, p, "users.remove", u.Name, err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -415,7 +731,7 @@ func (h *endpoints) usersAuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t, err := h.auth.login(n, c)
+	t, err := h.auth.login(n, c, remoteIP(r))
 	if err != nil {
 		writeAPIError(w, err)
 		return
@@ -423,8 +739,35 @@ func (h *endpoints) usersAuthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("authorization", t)
 }
 
+func (h *endpoints) usersUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if !p.hasPermission("users", "unlock") {
+		h.audit(r, p, "users.unlock", queryKeySingular(r, "name"), errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	n := queryKeySingular(r, "name")
+	if len(n) == 0 {
+		writeAPIError(w, newClientError("username is required"))
+		return
+	}
+
+	if !h.guard.unlock(n) {
+		http.NotFound(w, r)
+		return
+	}
+	h.audit(r, p, "users.unlock", n, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
 func (h *endpoints) linksRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
@@ -436,12 +779,16 @@ func (h *endpoints) linksRemoveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	target := strconv.Itoa(id)
 	if !p.hasPermission("links", "remove") {
+		h.audit(r, p, "links.remove", target, errUnauthorized)
 		writeAPIError(w, errUnauthorized)
 		return
 	}
 
-	if err := h.linkStore.deleteByID(id); err != nil {
+	err = h.linkStore.deleteByID(id)
+	h.audit(r, p, "links.remove", target, err)
+	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
@@ -451,13 +798,14 @@ func (h *endpoints) linksRemoveHandler(w http.ResponseWriter, r *http.Request) {
 func (h *endpoints) linksAddHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	p, err := h.auth.authenticate(r.Header.Get("authorization"))
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
 	if !p.hasPermission("links", "add") {
+		h.audit(r, p, "links.add", "", errUnauthorized)
 		writeAPIError(w, errUnauthorized)
 		return
 	}
@@ -472,7 +820,9 @@ func (h *endpoints) linksAddHandler(w http.ResponseWriter, r *http.Request) {
 		writeAPIError(w, err)
 		return
 	}
-	if err := h.linkStore.create(&l); err != nil {
+	err = h.linkStore.create(&l)
+	h.audit(r, p, "links.add", l.URI, err)
+	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
@@ -481,7 +831,7 @@ func (h *endpoints) linksAddHandler(w http.ResponseWriter, r *http.Request) {
 
 func (h *endpoints) linksListHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	_, err := h.auth.authenticate(r.Header.Get("authorization"))
+	_, err := h.authenticate(r, r.Header.Get("authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
@@ -496,18 +846,342 @@ func (h *endpoints) linksListHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(links)
 }
 
+func (h *endpoints) policiesListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if !p.hasPermission("policies", "list") {
+		h.audit(r, p, "policies.list", "", errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	overrides, err := h.policyStore.overrides()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policies":  h.config.enforcer.GetPolicy(),
+		"roles":     h.config.enforcer.GetGroupingPolicy(),
+		"overrides": overrides,
+	})
+}
+
+func (h *endpoints) policiesAddHandler(w http.ResponseWriter, r *http.Request) {
+	h.policiesChange(w, r, policyOpAdd)
+}
+
+func (h *endpoints) policiesRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	h.policiesChange(w, r, policyOpRemove)
+}
+
+func (h *endpoints) policiesChange(w http.ResponseWriter, r *http.Request, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if !p.hasPermission("policies", op) {
+		h.audit(r, p, "policies."+op, "", errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	var rule policyRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeAPIError(w, newClientError("malformed body"))
+		return
+	}
+	if err := rule.validate(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	enf, params := h.config.enforcer, make([]interface{}, len(rule.Rule))
+	for i, v := range rule.Rule {
+		params[i] = v
+	}
+
+	var exists bool
+	if rule.PType == "p" {
+		exists = enf.HasPolicy(params...)
+	} else {
+		exists = enf.HasGroupingPolicy(params...)
+	}
+	if exists && op == policyOpAdd {
+		writeAPIError(w, newClientError(fmt.Sprintf("rule %s already exists", rule.line())))
+		return
+	}
+	if !exists && op == policyOpRemove {
+		writeAPIError(w, newClientError(fmt.Sprintf("rule %s does not exist", rule.line())))
+		return
+	}
+
+	// Persist first, the enforcer has auto save disabled.
+	err = h.policyStore.change(&rule, op)
+	h.audit(r, p, "policies."+op, rule.line(), err)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	switch {
+	case rule.PType == "p" && op == policyOpAdd:
+		enf.AddPolicy(params...)
+	case rule.PType == "p":
+		enf.RemovePolicy(params...)
+	case op == policyOpAdd:
+		enf.AddGroupingPolicy(params...)
+	default:
+		enf.RemoveGroupingPolicy(params...)
+	}
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (h *endpoints) auditHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if !p.hasPermission("audit", "list") {
+		h.audit(r, p, "audit.list", "", errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	f, err := auditFilterOf(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if queryKeySingular(r, "format") == "csv" {
+		h.auditExport(w, r, f)
+		return
+	}
+	writeAuditPage(w, h.auditStore, f)
+}
+
+// auditFilterOf returns the filter of the query, a page is auditPageSize
+// entries unless the limit is set.
+func auditFilterOf(r *http.Request) (*auditFilter, error) {
+	f := &auditFilter{
+		Actor:  queryKeySingular(r, "actor"),
+		Action: queryKeySingular(r, "action"),
+		Result: queryKeySingular(r, "result"),
+		Limit:  auditPageSize,
+	}
+	var err error
+	for key, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := queryKeySingular(r, key); len(v) > 0 {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, newClientError(key + " must be RFC3339 time")
+			}
+		}
+	}
+	for key, n := range map[string]*int{"before": &f.Before, "limit": &f.Limit} {
+		if v := queryKeySingular(r, key); len(v) > 0 {
+			if *n, err = strconv.Atoi(v); err != nil || *n <= 0 {
+				return nil, newClientError(key + " must be a positive number")
+			}
+		}
+	}
+	if f.Limit > auditMaxPageSize {
+		f.Limit = auditMaxPageSize
+	}
+	return f, nil
+}
+
+// writeAuditPage writes matching entries with the id to list the next page before.
+func writeAuditPage(w http.ResponseWriter, store auditStore, f *auditFilter) {
+	entries, err := store.list(f)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var next int
+	if len(entries) == f.Limit {
+		next = entries[len(entries)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"next":    next,
+	})
+}
+
+// auditExport streams every matching entry as csv, page limits do not apply.
+func (h *endpoints) auditExport(w http.ResponseWriter, r *http.Request, f *auditFilter) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s-audit.csv\"", strings.ToLower(h.team().Name)))
+
+	out := csv.NewWriter(w)
+	out.Write(auditCSVHeader)
+	f.Limit = 0
+	err := h.auditStore.each(f, func(e *auditEntry) bool {
+		return out.Write(e.csv()) == nil
+	})
+	out.Flush()
+	if err != nil {
+		requestLogger(r).error("audit export failed", "err", err)
+	}
+}
+
+// recordPoll keeps the finished poll in the history, nil is ignored.
+func (h *endpoints) recordPoll(r *http.Request, rec *pollRecord) {
+	if rec == nil {
+		return
+	}
+	h.metrics.pollsCompleted.Inc()
+	pref := h.team().Preference
+	if pref != nil && rec.isOutOfBucket(fibSequence(pref.MaxFib), pref.OutOfBucketLimit) {
+		h.metrics.pollsOutOfBucket.Inc()
+	}
+	if err := h.config.pollStore.append(rec); err != nil {
+		requestLogger(r).error("poll failed to record", "poll", rec.Name, "err", err)
+	}
+}
+
+func (h *endpoints) storageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if !p.hasPermission(storageManagementObj, "usage") {
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	usage, err := h.config.storage.usage(h.team().Name)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"team":    h.team().Name,
+		"storage": storageKindOf(h.config.storage),
+		"buckets": usage,
+	})
+}
+
+func (h *endpoints) teamData() *teamData {
+	return &teamData{
+		team:     h.team(),
+		users:    h.userStore,
+		links:    h.linkStore,
+		audit:    h.auditStore,
+		polls:    h.config.pollStore,
+		policies: h.policyStore.store,
+	}
+}
+
+func (h *endpoints) teamExportHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if !p.hasPermission("team", "export") {
+		h.audit(r, p, "team.export", "", errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	doc, err := h.teamData().export(h.config.clock.Now())
+	h.audit(r, p, "team.export", "", err)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ToLower(h.team().Name)+".json"))
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (h *endpoints) teamImportHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := h.authenticate(r, r.Header.Get("authorization"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	mode := queryKeySingular(r, "mode")
+	if len(mode) == 0 {
+		mode = importModeMerge
+	}
+	if !p.hasPermission("team", "import") {
+		h.audit(r, p, "team.import", mode, errUnauthorized)
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+
+	doc := new(teamExport)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(teamImportMaxSize))).Decode(doc); err != nil {
+		writeAPIError(w, newClientError("document must be a team export"))
+		return
+	}
+
+	report, err := h.teamData().importTeam(doc, mode, p.user.Name, remoteIP(r))
+	if err == nil {
+		// Imported policy overrides are applied to the running enforcer.
+		err = h.config.enforcer.LoadPolicy()
+	}
+	h.audit(r, p, "team.import", mode, err)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// audit records an action of the principal, err decides the result of the entry.
+func (h *endpoints) audit(r *http.Request, p *principal, action string, target string, err error) {
+	e := &auditEntry{
+		Action: action,
+		Target: target,
+		IP:     remoteIP(r),
+		Result: auditResultOK,
+	}
+	if p != nil && p.user != nil {
+		e.Actor = p.user.Name
+	}
+	if err == errUnauthorized {
+		e.Result = auditResultDenied
+	} else if err != nil {
+		e.Result = auditResultFailed
+		e.Error = err.Error()
+	}
+	if err := h.auditStore.append(e); err != nil {
+		requestLogger(r).error("audit failed to record", "action", action, "actor", e.Actor, "err", err)
+	}
+}
+
 func (h *endpoints) pageIndexHandler(w http.ResponseWriter, r *http.Request) {
 	h.templateMgr.render(w, &page{
 		Name: "session.html",
-		Data: h.config.team,
+		Data: h.team(),
 	}, r.Header.Get("If-None-Match"))
 }
 
 func (h *endpoints) pageUsersHandler(w http.ResponseWriter, r *http.Request) {
-	h.templateMgr.render(w, &page{
-		Name: "users.html",
-		Data: h.quota,
-	}, r.Header.Get("If-None-Match"))
+	h.renderQuotaPage(w, r, "users.html")
 }
 
 func (h *endpoints) pageLoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -517,87 +1191,162 @@ func (h *endpoints) pageLoginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *endpoints) pageLinksHandler(w http.ResponseWriter, r *http.Request) {
+	h.renderQuotaPage(w, r, "links.html")
+}
+
+func (h *endpoints) pageInviteHandler(w http.ResponseWriter, r *http.Request) {
+	i, err := h.inviteStore.get(mux.Vars(r)["token"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Invalid invite is rendered as such by the page.
 	h.templateMgr.render(w, &page{
-		Name: "links.html",
-		Data: h.quota,
-	}, r.Header.Get("If-None-Match"))
+		Name: "invite.html",
+		Data: i,
+	}, "")
 }
 
 func (h *endpoints) pageDocHandler(w http.ResponseWriter, r *http.Request) {
+	h.renderQuotaPage(w, r, "docs.html")
+}
+
+// renderQuotaPage renders a page showing the team limits.
+func (h *endpoints) renderQuotaPage(w http.ResponseWriter, r *http.Request, name string) {
+	quota, err := h.quota()
+	if err != nil {
+		requestLogger(r).error("quota failed to read", "err", err)
+		http.Error(w, "failed to get quota", http.StatusInternalServerError)
+		return
+	}
 	h.templateMgr.render(w, &page{
-		Name: "docs.html",
-		Data: h.quota,
+		Name: name,
+		Data: quota,
 	}, r.Header.Get("If-None-Match"))
 }
 
 func (h *endpoints) acceptChangeLogListener(w http.ResponseWriter, r *http.Request) {
-	h.socketLoop(w, r, h.sessionTopic, 5*time.Second, true)
+	h.socketLoop(w, r, h.sessionTopic, 5*time.Second, true, h.dispatchSessionCommand)
 }
 
-func (h *endpoints) acceptOnlineListener(w http.ResponseWriter, r *http.Request) {
-	if onlineEnabledFlag {
-		h.socketLoop(w, r, h.online, time.Second, false)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+func (h *endpoints) resumeSession(pusher *socketPusher, since int64) error {
+	base, changes, ok := h.sessionTopic.since(since)
+	if !ok {
+		return pusher.push(h.sessionTopic.sync())
+	}
+	if err := pusher.resume(since, base); err != nil {
+		return err
+	}
+	for _, m := range changes {
+		if err := pusher.push(m); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// seen marks the principal as active on the board.
+func (h *endpoints) seen(p *principal) {
+	if h.online != nil && !p.isAnonymus() {
+		h.online.seen(p.user.Name)
+	}
+}
+
+// presenceChanged pushes the new presence to everyone.
+func (h *endpoints) presenceChanged() {
+	h.sessionTopic.notifyPresence()
+}
+
+// enterPresence shows the client to others as having the board open.
+func (h *endpoints) enterPresence(c *client) func() {
+	if h.online == nil {
+		return func() {}
+	}
+	h.online.enter(c)
+	return func() { h.online.leave(c) }
+}
+
+// authenticate returns the principal of the token, the log of the request is
+// tagged with the user.
+func (h *endpoints) authenticate(r *http.Request, token string) (*principal, error) {
+	p, err := h.auth.authenticate(token, remoteIP(r))
+	if err == nil {
+		setRequestUser(r, p.user.Name)
+	}
+	return p, err
 }
 
 var anonymID = fmt.Sprintf("anonym45%d", time.Now().Unix())
-var upgrader = websocket.Upgrader{} // use default options
-func (h *endpoints) socketLoop(w http.ResponseWriter, r *http.Request, socketTopic topic, pingPeriod time.Duration, allowAnonym bool) {
-	p, err := h.auth.authenticate(queryKeySingular(r, "authorization"))
+
+// socketLoop pushes messages of the topic to the client. Clients of a topic with
+// a dispatcher may request a newer protocol to send commands over the socket.
+func (h *endpoints) socketLoop(w http.ResponseWriter, r *http.Request, socketTopic topic, pingPeriod time.Duration, allowAnonym bool, dispatch socketDispatcher) {
+	p, err := h.authenticate(r, queryKeySingular(r, "authorization"))
 	if err != nil {
 		writeAPIError(w, err)
 		return
 	}
 
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	version := socketProtocolLegacy
+	if dispatch != nil {
+		if version, err = socketProtocol(r); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+
+	if !h.drainer.enter() {
+		writeAPIError(w, errShuttingDown)
+		return
+	}
+	defer h.drainer.leave()
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	l := requestLogger(r).with("user", p.user.Name, "remote", r.RemoteAddr)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("upgrade:", err)
+		l.warn("socket upgrade failed", "err", err)
 		return
 	}
 
-	log.Printf("connection accepted %s \n", r.RemoteAddr)
-
-	c := &client{
-		msg: make(chan msgWriter),
-		id:  p.user.Name,
-	}
+	c := newClient(p.user.Name)
+	l.info("socket connected", "route", routeTemplate(r), "protocol", version)
 
 	wsStat.Inc()
 
+	replies := make(chan *socketMessage)
+	done := make(chan bool)
+	go readSocketCommands(conn, version, func(cmd *socketCommand) *socketMessage {
+		return dispatch(r, p, cmd)
+	}, replies, done)
+
+	pusher := &socketPusher{conn: conn, p: p, protocol: version}
+
 	socketTopic.enter(c)
+	leavePresence := h.enterPresence(c)
 	ticker := time.NewTicker(webSocketPingPeriod)
 
+	// reason tells why the socket closed, the client closes it unless the
+	// server has a reason.
+	reason := "closed"
 	defer func() {
 		ticker.Stop()
+		close(done)
 		conn.Close()
-
-		// while we are waiting to ack leave, we have to drain
-		// all incoming messages to prevent deadlock
-		done := make(chan int)
-		go func() {
-			for {
-				select {
-				case <-c.msg:
-					// drain messages
-				case <-done:
-					return
-				}
-			}
-		}()
+		leavePresence()
 		socketTopic.leave(c)
-		close(done)
 
 		wsStat.Dec()
-		log.Printf("connection %s disconnected \n", r.RemoteAddr)
+		l.info("socket disconnected", "reason", reason)
 	}()
 
-	if _, ok := r.URL.Query()["sync"]; ok {
-		msg := socketTopic.sync()
-		if msg.write(conn, p) != nil {
+	// A client resuming after a drop gets the changes it missed, or a snapshot
+	// if they aren't kept any more.
+	if since, err := strconv.ParseInt(queryKeySingular(r, "since"), 10, 64); err == nil && socketTopic == h.sessionTopic {
+		if h.resumeSession(pusher, since) != nil {
+			return
+		}
+	} else if _, ok := r.URL.Query()["sync"]; ok {
+		if pusher.push(socketTopic.sync()) != nil {
 			return
 		}
 	}
@@ -605,11 +1354,31 @@ func (h *endpoints) socketLoop(w http.ResponseWriter, r *http.Request, socketTop
 	for {
 		select {
 		case msg := <-c.msg:
-			if msg.write(conn, p) != nil {
+			if err := pusher.push(msg); err != nil {
+				reason = err.Error()
 				return
 			}
+		case reply, ok := <-replies:
+			if !ok {
+				return
+			}
+			if err := pusher.reply(reply); err != nil {
+				reason = err.Error()
+				return
+			}
+		case <-c.gone:
+			reason = "too slow"
+			l.warn("client is too slow, disconnecting")
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason), time.Now().Add(socketWriteWait))
+			return
+		case <-h.drainer.done():
+			reason = socketCloseRestarting
+			closeSocketRestarting(conn)
+			return
 		case <-ticker.C:
-			if err := conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(socketWriteWait)); err != nil {
+				reason = err.Error()
 				return
 			}
 		}
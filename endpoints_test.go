@@ -12,6 +12,9 @@ import (
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type testerModel struct {
@@ -102,6 +105,15 @@ func TestVoting(t *testing.T) {
 	voters := []*testerModel{voter1, voter2}
 	scores := []int{22, 2}
 
+	counters := []prometheus.Counter{
+		testHandler.metrics.sessionsOpened, testHandler.metrics.sessionsClosed, testHandler.metrics.votes,
+		testHandler.metrics.unmasks, testHandler.metrics.pollsCompleted, testHandler.metrics.pollsOutOfBucket,
+	}
+	before := make([]float64, len(counters))
+	for i, c := range counters {
+		before[i] = testutil.ToFloat64(c)
+	}
+
 	for lid, leader := range voters {
 		// Verify closed state
 		m := fetchSession(t, master)
@@ -130,6 +142,13 @@ func TestVoting(t *testing.T) {
 		assertStatus(t, w, http.StatusOK)
 		assertOpenSession(t, master, lid, voters, []string{"", ""}, false)
 
+		gauges := newTeamGauges()
+		gauges.add(testHandler)
+		expected := fmt.Sprintf("# HELP session_voters Number of voters of the current poll by team\n# TYPE session_voters gauge\nsession_voters{team=%q} 2\n", testTeam.Name)
+		if err := testutil.CollectAndCompare(gauges, strings.NewReader(expected), "session_voters"); err != nil {
+			t.Fatal(err)
+		}
+
 		// Verify voting.
 		var rounds int
 		for rounds < 2 {
@@ -250,6 +269,12 @@ func TestVoting(t *testing.T) {
 		assertStatus(t, w, http.StatusOK)
 	}
 
+	// Two sessions of two polls each, scores 22 and 2 are close enough.
+	for i, want := range []float64{2, 2, 8, 4, 4, 0} {
+		if got := testutil.ToFloat64(counters[i]) - before[i]; got != want {
+			t.Fatalf("expected counter %d to grow by %v, got %v", i, want, got)
+		}
+	}
 }
 
 func fetchSession(t *testing.T, user *testerModel) *clientModel {
@@ -3,7 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 var (
@@ -14,6 +17,8 @@ var (
 	errVoteRejected  = errors.New("vote rejected")
 	errSessionClosed = errors.New("session closed")
 	errSessionOpen   = errors.New("session is already open")
+	errShuttingDown  = errors.New(socketCloseRestarting)
+	errUsernameTaken = newClientError("username is taken")
 )
 
 type authError struct {
@@ -42,28 +47,50 @@ func (se *systemError) Error() string {
 	return se.msg
 }
 
+// throttleError is returned when a caller must wait before trying again.
+type throttleError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttleError) Error() string {
+	return fmt.Sprintf("too many attempts, try again in %s", e.retryAfter.Round(time.Second))
+}
+
 func writeAPIError(w http.ResponseWriter, err error) {
-	switch v := err.(type) {
+	status := apiErrorStatus(err)
+	if v, ok := err.(*throttleError); ok {
+		secs := int(math.Ceil(v.retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError:
+		http.Error(w, err.Error(), status)
+	default:
+		writeJSONError(w, status, err)
+	}
+}
+
+// apiErrorStatus maps an error of API handlers to the HTTP status of the response.
+func apiErrorStatus(err error) int {
+	switch err.(type) {
 	case *authError:
-		http.Error(w, v.Error(), http.StatusUnauthorized)
-		return
+		return http.StatusUnauthorized
 	case *errClientError:
-		writeJSONError(w, http.StatusBadRequest, err)
-		return
+		return http.StatusBadRequest
+	case *throttleError:
+		return http.StatusTooManyRequests
 	}
 
 	switch err {
 	case errUnauthorized:
-		http.Error(w, err.Error(), http.StatusForbidden)
-	case errVoteRejected:
-		fallthrough
-	case errSessionOpen:
-		fallthrough
-	case errSessionClosed:
-		writeJSONError(w, http.StatusBadRequest, err)
-	default:
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return http.StatusForbidden
+	case errVoteRejected, errSessionOpen, errSessionClosed:
+		return http.StatusBadRequest
+	case errShuttingDown:
+		return http.StatusServiceUnavailable
 	}
+	return http.StatusInternalServerError
 }
 
 func writeJSONError(w http.ResponseWriter, statusCode int, err error) {
@@ -79,3 +106,7 @@ func newClientError(msg string) *errClientError {
 func newSystemError(msg string) *systemError {
 	return &systemError{msg: msg}
 }
+
+func newThrottleError(retryAfter time.Duration) *throttleError {
+	return &throttleError{retryAfter: retryAfter}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Streams end before the write timeout of the server, browsers reconnect
+// at once with the id of the last event.
+const (
+	eventStreamLifetime = serverWriteTimeout - 2*time.Second
+	eventStreamRetry    = 1 * time.Second
+)
+
+// sessionEventsHandler streams session changes as server-sent events for
+// clients which can't open websockets. The id of an event is the session version.
+func (h *endpoints) sessionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("authorization")
+	if len(token) == 0 {
+		// EventSource can't set headers.
+		token = queryKeySingular(r, "authorization")
+	}
+	p, err := h.authenticate(r, token)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, newSystemError("streaming is not supported"))
+		return
+	}
+	if !h.drainer.enter() {
+		writeAPIError(w, errShuttingDown)
+		return
+	}
+	defer h.drainer.leave()
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if len(lastID) == 0 {
+		lastID = queryKeySingular(r, "last_event_id")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Proxies must not buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	l := requestLogger(r).with("user", p.user.Name, "remote", r.RemoteAddr)
+	l.info("event stream opened", "last_event_id", lastID)
+	c := newClient(p.user.Name)
+	sseStat.Inc()
+	h.sessionTopic.enter(c)
+	leavePresence := h.enterPresence(c)
+	reason := "closed"
+	defer func() {
+		leavePresence()
+		h.sessionTopic.leave(c)
+		sseStat.Dec()
+		l.info("event stream closed", "reason", reason)
+	}()
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry/time.Millisecond)
+	// A client which has seen a recent version gets only the changes it missed.
+	since, err := strconv.ParseInt(lastID, 10, 64)
+	_, changes, ok := h.sessionTopic.since(since)
+	if err != nil || !ok {
+		changes = []*modelMasker{h.sessionTopic.sync().(*modelMasker)}
+	}
+	last := since
+	for _, m := range changes {
+		if err := writeSessionEvent(w, m, p); err != nil {
+			reason = err.Error()
+			return
+		}
+		last = m.sm.Version
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(webSocketPingPeriod)
+	defer heartbeat.Stop()
+	lifetime := time.NewTimer(eventStreamLifetime)
+	defer lifetime.Stop()
+
+	for {
+		select {
+		case msg := <-c.msg:
+			if pc, ok := msg.(*presenceChange); ok {
+				if err := writePresenceEvent(w, pc, p); err != nil {
+					reason = err.Error()
+					return
+				}
+				break
+			}
+			// A change queued before the snapshot is already in it.
+			m, ok := msg.(*modelMasker)
+			if !ok || m.sm.Version <= last {
+				continue
+			}
+			if err := writeSessionEvent(w, m, p); err != nil {
+				reason = err.Error()
+				return
+			}
+			last = m.sm.Version
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				reason = err.Error()
+				return
+			}
+		case <-c.gone:
+			reason = "too slow"
+			l.warn("client is too slow, disconnecting")
+			return
+		case <-lifetime.C:
+			reason = "lifetime"
+			return
+		case <-h.drainer.done():
+			// The client reconnects after the retry period.
+			reason = socketCloseRestarting
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSessionEvent(w io.Writer, m *modelMasker, p *principal) error {
+	data, err := json.Marshal(m.get(p))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: session\ndata: %s\n\n", m.sm.Version, data)
+	return err
+}
+
+// writePresenceEvent writes a change of presence without an id, it isn't a
+// version to resume from.
+func writePresenceEvent(w io.Writer, c *presenceChange, p *principal) error {
+	data, err := json.Marshal(c.get(p))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: presence\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	id, event, data string
+}
+
+// readTestEvent reads the next change of the session, changes of presence are skipped.
+func readTestEvent(t *testing.T, r *bufio.Reader) *testEvent {
+	e := new(testEvent)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			if e.event == "presence" {
+				e = new(testEvent)
+			}
+			if len(e.event) > 0 {
+				return e
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func touchTestSession(t *testing.T) int64 {
+	m, err := testHandler.sessionTopic.write(func(s *session, m *modelMasker) error {
+		s.touch()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.sm.Version
+}
+
+func TestSessionEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHandler.sessionEventsHandler))
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	subscribe := func(lastID string) (*http.Response, *bufio.Reader) {
+		r, err := http.NewRequest("GET", srv.URL+"/session/events?authorization="+signinUser(t, master), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lastID) > 0 {
+			r.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected event stream, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		return res, bufio.NewReader(res.Body)
+	}
+
+	res, body := subscribe("")
+	snapshot := readTestEvent(t, body)
+	var m clientModel
+	if err := json.Unmarshal([]byte(snapshot.data), &m); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.event != "session" || snapshot.id != strconv.FormatInt(m.Version, 10) {
+		t.Fatalf("expected snapshot with the session version as id, got %+v", snapshot)
+	}
+
+	version := touchTestSession(t)
+	if e := readTestEvent(t, body); e.id != strconv.FormatInt(version, 10) {
+		t.Fatalf("expected change of version %d, got %+v", version, e)
+	}
+	res.Body.Close()
+	waitTestPresence(t, master.Name, "")
+
+	// A client resuming from the current version gets no snapshot, only
+	// newer changes like its own presence.
+	version = fetchSession(t, master).Version
+	res, body = subscribe(strconv.FormatInt(version, 10))
+	defer res.Body.Close()
+	touched := touchTestSession(t)
+	for {
+		e := readTestEvent(t, body)
+		id, err := strconv.ParseInt(e.id, 10, 64)
+		if err != nil || id <= version {
+			t.Fatalf("expected only changes after version %d, got %+v", version, e)
+		}
+		if id == touched {
+			break
+		}
+	}
+}
+
+// waitTestPresence waits until the user has the presence state, empty if the
+// user doesn't have the board open.
+func waitTestPresence(t *testing.T, name string, state string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, _ := testHandler.sessionTopic.read(nil)
+		var got string
+		for _, n := range m.sm.Presence.Online {
+			if n == name {
+				got = presenceOnline
+			}
+		}
+		for _, n := range m.sm.Presence.Idle {
+			if n == name {
+				got = presenceIdle
+			}
+		}
+		if got == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be %q, got %q", name, state, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionEventsUnauthorized(t *testing.T) {
+	r, err := http.NewRequest("GET", "/session/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	http.HandlerFunc(testHandler.sessionEventsHandler).ServeHTTP(w, r)
+	if w.Code == http.StatusOK {
+		t.Fatal("expected the stream to require authorization")
+	}
+}
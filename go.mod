@@ -12,5 +12,7 @@ require (
 	github.com/gorilla/websocket v1.4.1
 	github.com/mattn/go-shellwords v1.0.9 // indirect
 	github.com/prometheus/client_golang v1.5.1
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	gopkg.in/urfave/cli.v1 v1.20.0 // indirect
+	modernc.org/sqlite v1.20.4
 )
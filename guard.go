@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	guardFailureWindow = 1 * time.Hour
+	guardBaseBackoff   = 1 * time.Second
+	guardMaxBackoff    = 5 * time.Minute
+	guardLockoutPeriod = 15 * time.Minute
+	guardSweepSize     = 1024
+)
+
+// guardPolicy defines how many failed attempts are tolerated for a key before
+// backoff starts and before the key is locked out.
+type guardPolicy struct {
+	scope     string
+	free      int
+	lockAfter int
+}
+
+var (
+	userGuardPolicy = &guardPolicy{scope: "user", free: 3, lockAfter: 10}
+	// Whole team usually sits behind the same office NAT, so an address
+	// is given much more room than a single username.
+	ipGuardPolicy = &guardPolicy{scope: "ip", free: 20, lockAfter: 60}
+)
+
+type attempts struct {
+	failures     int
+	pending      int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+}
+
+// loginGuard tracks failed login attempts per username and per remote address
+// and rejects further attempts with an exponential backoff and a temporary lockout.
+type loginGuard struct {
+	clock *clock
+	users map[string]*attempts
+	ips   map[string]*attempts
+	mux   sync.Mutex
+}
+
+func newLoginGuard(c *clock) *loginGuard {
+	g := new(loginGuard)
+	g.clock = c
+	g.users = make(map[string]*attempts)
+	g.ips = make(map[string]*attempts)
+	return g
+}
+
+// begin returns a throttle error if either the username or the address is
+// blocked, otherwise the attempt is pending until end. Checking and counting is
+// one step, so parallel attempts can't all pass before their failures count:
+// once a key with failures has used its free attempts, it gets one attempt at
+// a time. A key without failures isn't held back, a board page authenticates
+// several requests at once.
+func (g *loginGuard) begin(username string, ip string) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	now := g.clock.Now()
+	if wait := g.wait(username, ip, now); wait > 0 {
+		return newThrottleError(wait)
+	}
+	g.entry(g.users, username, now).pending++
+	g.entry(g.ips, ip, now).pending++
+	return nil
+}
+
+// wait returns how long the username or the address is blocked for.
+func (g *loginGuard) wait(username string, ip string, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, k := range []struct {
+		a      *attempts
+		policy *guardPolicy
+	}{{g.users[username], userGuardPolicy}, {g.ips[ip], ipGuardPolicy}} {
+		switch {
+		case k.a == nil:
+		case now.Before(k.a.blockedUntil):
+			if d := k.a.blockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		case k.a.failures > 0 && k.a.pending > 0 && k.a.failures+k.a.pending >= k.policy.free:
+			if wait < guardBaseBackoff {
+				wait = guardBaseBackoff
+			}
+		}
+	}
+	return wait
+}
+
+// end settles an attempt started by begin. A success forgets failures of the
+// username. Failures of the address are kept, otherwise a single valid account
+// would be enough to reset the counter.
+func (g *loginGuard) end(username string, ip string, failed bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	now := g.clock.Now()
+	u, a := g.entry(g.users, username, now), g.entry(g.ips, ip, now)
+	u.pending--
+	a.pending--
+	if failed {
+		g.record(u, userGuardPolicy, now)
+		g.record(a, ipGuardPolicy, now)
+		authFailures.Inc()
+		return
+	}
+	*u = attempts{pending: u.pending}
+	g.forget(g.users, username)
+	g.forget(g.ips, ip)
+}
+
+// unlock removes any backoff or lockout of the username.
+func (g *loginGuard) unlock(username string) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	a, ok := g.users[username]
+	if ok {
+		*a = attempts{pending: a.pending}
+		g.forget(g.users, username)
+	}
+	return ok
+}
+
+// forget removes attempts of the key unless they have failures or are pending.
+func (g *loginGuard) forget(m map[string]*attempts, key string) {
+	if a, ok := m[key]; ok && a.pending == 0 && a.failures == 0 {
+		delete(m, key)
+	}
+}
+
+// entry returns attempts of the key, adding them if there are none.
+func (g *loginGuard) entry(m map[string]*attempts, key string, now time.Time) *attempts {
+	a, ok := m[key]
+	if !ok {
+		if len(m) >= guardSweepSize {
+			g.sweep(m, now)
+		}
+		a = new(attempts)
+		m[key] = a
+	}
+	return a
+}
+
+func (g *loginGuard) record(a *attempts, policy *guardPolicy, now time.Time) {
+	if now.Sub(a.lastFailure) > guardFailureWindow && !now.Before(a.blockedUntil) {
+		*a = attempts{pending: a.pending}
+	}
+	a.failures++
+	a.lastFailure = now
+
+	switch {
+	case a.failures >= policy.lockAfter:
+		a.blockedUntil = now.Add(guardLockoutPeriod)
+		if !a.locked {
+			a.locked = true
+			authLockouts.WithLabelValues(policy.scope).Inc()
+		}
+	case a.failures > policy.free:
+		backoff := guardMaxBackoff
+		if shift := uint(a.failures - policy.free - 1); shift < 16 {
+			if d := guardBaseBackoff << shift; d < guardMaxBackoff {
+				backoff = d
+			}
+		}
+		a.blockedUntil = now.Add(backoff)
+	}
+}
+
+func (g *loginGuard) sweep(m map[string]*attempts, now time.Time) {
+	for k, a := range m {
+		if a.pending == 0 && now.Sub(a.lastFailure) > guardFailureWindow && !now.Before(a.blockedUntil) {
+			delete(m, k)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuardBackoff(t *testing.T) {
+	c := new(clock)
+	g := newLoginGuard(c)
+
+	for i := 0; i < userGuardPolicy.free; i++ {
+		if err := checkGuard(g, "va", "10.0.0.1"); err != nil {
+			t.Fatalf("attempt %d must not be throttled, got %v", i, err)
+		}
+		failGuard(g, "va", "10.0.0.1")
+	}
+	if err := checkGuard(g, "va", "10.0.0.1"); err != nil {
+		t.Fatalf("free attempts must not be throttled, got %v", err)
+	}
+
+	failGuard(g, "va", "10.0.0.1")
+	assertRetryAfter(t, checkGuard(g, "va", "10.0.0.2"), guardBaseBackoff)
+	if err := checkGuard(g, "vb", "10.0.0.2"); err != nil {
+		t.Fatalf("other users must not be throttled, got %v", err)
+	}
+
+	c.SetOffset(guardBaseBackoff)
+	failGuard(g, "va", "10.0.0.1")
+	assertRetryAfter(t, checkGuard(g, "va", "10.0.0.1"), 2*guardBaseBackoff)
+
+	c.SetOffset(3 * guardBaseBackoff)
+	if err := g.begin("va", "10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	g.end("va", "10.0.0.3", false)
+	if err := checkGuard(g, "va", "10.0.0.3"); err != nil {
+		t.Fatalf("successful login must reset failures, got %v", err)
+	}
+}
+
+func TestGuardParallelAttempts(t *testing.T) {
+	c := new(clock)
+	g := newLoginGuard(c)
+	for i := 0; i < userGuardPolicy.free-1; i++ {
+		failGuard(g, "va", "10.0.0.1")
+	}
+
+	// The last free attempt is pending, others wait for its result.
+	if err := g.begin("va", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	assertRetryAfter(t, g.begin("va", "10.0.0.2"), guardBaseBackoff)
+	g.end("va", "10.0.0.1", true)
+	if err := g.begin("va", "10.0.0.2"); err != nil {
+		t.Fatalf("attempts within free ones must not wait, got %v", err)
+	}
+	g.end("va", "10.0.0.2", true)
+	assertRetryAfter(t, checkGuard(g, "va", "10.0.0.3"), guardBaseBackoff)
+}
+
+func TestGuardParallelSuccesses(t *testing.T) {
+	g := newLoginGuard(new(clock))
+
+	// Requests of a board page, or of a team behind one address, authenticate at once.
+	for i := 0; i <= ipGuardPolicy.free; i++ {
+		if err := g.begin("va", "10.0.0.1"); err != nil {
+			t.Fatalf("attempt %d without failures must not be throttled, got %v", i, err)
+		}
+	}
+	for i := 0; i <= ipGuardPolicy.free; i++ {
+		g.end("va", "10.0.0.1", false)
+	}
+	if len(g.users) != 0 || len(g.ips) != 0 {
+		t.Fatalf("expected settled attempts to be forgotten, got %d users and %d addresses", len(g.users), len(g.ips))
+	}
+}
+
+func TestGuardLockout(t *testing.T) {
+	c := new(clock)
+	g := newLoginGuard(c)
+
+	for i := 0; i < userGuardPolicy.lockAfter; i++ {
+		failGuard(g, "va", fmt.Sprintf("10.0.0.%d", i))
+	}
+	assertRetryAfter(t, checkGuard(g, "va", "10.0.1.1"), guardLockoutPeriod)
+
+	c.SetOffset(guardLockoutPeriod - time.Second)
+	if checkGuard(g, "va", "10.0.1.1") == nil {
+		t.Fatal("lockout must last for the whole period")
+	}
+
+	c.SetOffset(guardLockoutPeriod)
+	if err := checkGuard(g, "va", "10.0.1.1"); err != nil {
+		t.Fatalf("lockout must expire, got %v", err)
+	}
+
+	for i := 0; i < ipGuardPolicy.lockAfter; i++ {
+		failGuard(g, fmt.Sprintf("user%d", i), "10.0.2.1")
+	}
+	if checkGuard(g, "vc", "10.0.2.1") == nil {
+		t.Fatal("address must be locked out after too many failures")
+	}
+}
+
+func TestAuthThrottleAndUnlock(t *testing.T) {
+	attempt := func() *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "/users/auth?name=intruder&passcode=guess", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.usersAuthHandler).ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i <= userGuardPolicy.free; i++ {
+		assertStatus(t, attempt(), http.StatusUnauthorized)
+	}
+	w := attempt()
+	assertStatus(t, w, http.StatusTooManyRequests)
+	if len(w.Header().Get("Retry-After")) == 0 {
+		t.Fatal("Retry-After header is missing")
+	}
+
+	r, err := http.NewRequest("POST", "/users/unlock?name=intruder", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("authorization", signinUser(t, master))
+	w = httptest.NewRecorder()
+	http.HandlerFunc(testHandler.usersUnlockHandler).ServeHTTP(w, r)
+	assertStatus(t, w, http.StatusOK)
+
+	assertStatus(t, attempt(), http.StatusUnauthorized)
+}
+
+func TestTokenThrottle(t *testing.T) {
+	token := b64.URLEncoding.EncodeToString([]byte("throttled,guess,voter"))
+	attempt := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/session", nil)
+		r.RemoteAddr = "10.9.9.9:1234"
+		r.Header.Set("authorization", token)
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.sessionHandler).ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i <= userGuardPolicy.free; i++ {
+		assertStatus(t, attempt(), http.StatusUnauthorized)
+	}
+	assertStatus(t, attempt(), http.StatusTooManyRequests)
+	testHandler.guard.unlock("throttled")
+}
+
+// checkGuard returns a throttle error if the username or the address is blocked.
+func checkGuard(g *loginGuard, username string, ip string) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if wait := g.wait(username, ip, g.clock.Now()); wait > 0 {
+		return newThrottleError(wait)
+	}
+	return nil
+}
+
+// failGuard records a failed attempt even if the username is blocked.
+func failGuard(g *loginGuard, username string, ip string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	now := g.clock.Now()
+	g.record(g.entry(g.users, username, now), userGuardPolicy, now)
+	g.record(g.entry(g.ips, ip, now), ipGuardPolicy, now)
+}
+
+func assertRetryAfter(t *testing.T, err error, wanted time.Duration) {
+	te, ok := err.(*throttleError)
+	if !ok {
+		t.Fatalf("expected throttle error, got %v", err)
+	}
+	// Clock keeps running between fail and check.
+	if te.retryAfter > wanted || te.retryAfter < wanted-time.Second {
+		t.Fatalf("expected retry after %s, got %s", wanted, te.retryAfter)
+	}
+}
+
+func TestAuthUpgradesLegacyPasscodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openBoltStorage(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	users, err := s.users("team", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &user{Name: "va", Role: roleVoter, PasscodeHash: legacyPasscodeHash("salt", "secret")}
+	if err := users.create(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newAuth(users, nil, newLoginGuard(new(clock)))
+	if _, err := a.login("va", "guess", "10.0.0.1"); err != errAuthInvalid {
+		t.Fatalf("expected wrong credentials, got %v", err)
+	}
+	if _, err := a.login("va", "secret", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.get("va")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.PasscodeHash, passcodeHashPrefix) || u.passcodeOutdated() || !u.checkPasscode("secret") {
+		t.Fatalf("expected the legacy hash to be upgraded, got %v", u)
+	}
+
+	// A passcode checked before is forgotten once the hash changes.
+	if _, err := a.login("va", "secret", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	u.setPasscode("other")
+	if err := users.create(u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.login("va", "secret", "10.0.0.1"); err != errAuthInvalid {
+		t.Fatalf("expected the old passcode to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// commit is set at build time with -ldflags "-X main.commit=...", like version.
+var commit string
+
+// readyCheckTimeout bounds a readiness check which waits for a goroutine.
+const readyCheckTimeout = 1 * time.Second
+
+// probePaths are left out of request metrics, they are polled all the time.
+var probePaths = []string{"/healthz", "/readyz", "/version"}
+
+// readinessCheck is a dependency a server needs to serve requests.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type buildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Go      string `json:"go"`
+}
+
+// addProbeRoutes serves probes of load balancers and orchestrators. The server
+// is alive as long as it answers, it is ready if all checks pass.
+func addProbeRoutes(r *mux.Router, checks func() []*readinessCheck) {
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", readyzHandler(checks)).Methods("GET", "HEAD")
+	r.HandleFunc("/version", versionHandler).Methods("GET")
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyzHandler lists every check as ok or its error, any failed check
+// makes the server unavailable.
+func readyzHandler(checks func() []*readinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, results := "ready", make(map[string]string)
+		for _, c := range checks() {
+			results[c.name] = "ok"
+			if err := c.check(); err != nil {
+				status, results[c.name] = "not ready", err.Error()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": results})
+	}
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&buildInfo{Version: version, Commit: commit, Go: runtime.Version()})
+}
+
+// readiness checks the storage, templates and the broadcaster of the team,
+// the team isn't ready once it is shutting down.
+func (h *endpoints) readiness() []*readinessCheck {
+	return []*readinessCheck{
+		{name: "storage", check: h.config.storage.ping},
+		{name: "templates", check: h.templateMgr.loaded},
+		{name: "broadcaster", check: func() error {
+			if !h.sessionTopic.alive(readyCheckTimeout) {
+				return errors.New("broadcaster isn't running")
+			}
+			return nil
+		}},
+		{name: "shutdown", check: h.drainer.accepting},
+	}
+}
+
+// readiness checks teams of the fleet, names of checks are prefixed by the team.
+// It doesn't wait for teams being applied.
+func (f *teamFleet) readiness() []*readinessCheck {
+	var checks []*readinessCheck
+	for name, h := range f.handlers.Load().(map[string]*endpoints) {
+		for _, c := range h.readiness() {
+			checks = append(checks, &readinessCheck{name: name + "/" + c.name, check: c.check})
+		}
+	}
+	return checks
+}
+
+// readiness checks the admin server and every running team, so the admin port
+// tells whether the whole process is ready.
+func (h *adminEndpoints) readiness() []*readinessCheck {
+	checks := []*readinessCheck{
+		{name: "storage", check: func() error {
+			_, err := h.catalog.store.list()
+			return err
+		}},
+		{name: "templates", check: h.template.loaded},
+		{name: "shutdown", check: h.drainer.accepting},
+	}
+	return append(checks, h.catalog.fleet.readiness()...)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestProbes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teams.json")
+
+	fleet, tenants, s := newTestFleet(t, dir)
+	defer s.close()
+	defer fleet.stopAll()
+	records, err := s.teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := newTeamCatalog(path, records, fleet, new(clock))
+	if err := catalog.load(writeTestTeams(t, path, `{"alpha": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	admins, err := s.users(systemShard, maxAdmins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := s.audit(systemShard, new(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := newAdminEndpoints(catalog, admins, audit, loadTestTemplates(t, &page{}), newOriginPolicy(nil), new(clock))
+	adminRouter := newAdminRouter(admin, &teamServerOpts{origins: newOriginPolicy(nil), staticDir: staticDir})
+
+	readyz := func(h http.Handler, path string, status int) map[string]string {
+		w := serveTestTenant(h, "localhost", path)
+		assertStatus(t, w, status)
+		var res struct {
+			Checks map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Checks
+	}
+
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/t/alpha/healthz"), http.StatusOK)
+	w := serveTestTenant(tenants, "localhost", "/t/alpha/version")
+	assertStatus(t, w, http.StatusOK)
+	info := new(buildInfo)
+	if err := json.Unmarshal(w.Body.Bytes(), info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Go != runtime.Version() {
+		t.Fatalf("expected the Go version, got %+v", info)
+	}
+
+	checks := readyz(tenants, "/t/alpha/readyz", http.StatusOK)
+	for _, name := range []string{"storage", "templates", "broadcaster", "shutdown"} {
+		if checks[name] != "ok" {
+			t.Fatalf("expected %s to be ok, got %v", name, checks)
+		}
+	}
+	if checks := readyz(adminRouter, "/readyz", http.StatusOK); checks["alpha/broadcaster"] != "ok" {
+		t.Fatalf("expected the admin server to check teams, got %v", checks)
+	}
+	// The shared listener answers probes of its own.
+	tenants.serveProbes(fleet.readiness)
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/healthz"), http.StatusOK)
+	if checks := readyz(tenants, "/readyz", http.StatusOK); checks["alpha/storage"] != "ok" {
+		t.Fatalf("expected the listener to check teams, got %v", checks)
+	}
+	// Teams being applied hold the fleet, probes don't wait for them.
+	fleet.mux.Lock()
+	readyz(tenants, "/readyz", http.StatusOK)
+	readyz(adminRouter, "/readyz", http.StatusOK)
+	fleet.mux.Unlock()
+
+	// A team is not ready once it is shutting down.
+	alpha := fleet.teams["alpha"].handler
+	alpha.drainer.close()
+	alpha.sessionTopic.close()
+	checks = readyz(tenants, "/t/alpha/readyz", http.StatusServiceUnavailable)
+	if checks["shutdown"] != socketCloseRestarting || checks["broadcaster"] == "ok" || checks["storage"] != "ok" {
+		t.Fatalf("expected shutdown to fail the team, got %v", checks)
+	}
+	readyz(adminRouter, "/readyz", http.StatusServiceUnavailable)
+	readyz(tenants, "/readyz", http.StatusServiceUnavailable)
+}
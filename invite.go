@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const invitesBucketName = "invites"
+
+const (
+	defaultInviteTTL  = 24 * time.Hour
+	maxInviteTTL      = 30 * 24 * time.Hour
+	inviteTokenLength = 16
+)
+
+var (
+	errInviteInvalid = newClientError("invite is invalid or expired")
+)
+
+type invite struct {
+	Token     string    `json:"token"`
+	Role      role      `json:"role"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxUses is a number of users which can join by the invite, zero means
+	// unlimited until the invite expires.
+	MaxUses int `json:"max_uses"`
+	Uses    int `json:"uses"`
+}
+
+func (i *invite) isValid(now time.Time) bool {
+	return now.Before(i.ExpiresAt) && (i.MaxUses == 0 || i.Uses < i.MaxUses)
+}
+
+func newInvite(r role, createdBy string, ttl time.Duration, maxUses int, now time.Time) (*invite, error) {
+	buf := make([]byte, inviteTokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return &invite{
+		Token:     hex.EncodeToString(buf),
+		Role:      r,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		MaxUses:   maxUses,
+	}, nil
+}
+
+type inviteStore interface {
+	create(r role, createdBy string, ttl time.Duration, maxUses int) (*invite, error)
+	// get returns a valid invite or nil.
+	get(token string) (*invite, error)
+	// use consumes one use of the invite, the use is given back if join fails.
+	use(token string, join func(i *invite) error) error
+	delete(token string) error
+	// list returns valid invites.
+	list() ([]*invite, error)
+}
+
+type boltInviteStore struct {
+	db     *bolt.DB
+	bucket []byte
+	clock  *clock
+}
+
+func newBoltInviteStore(db *bolt.DB, shard string, c *clock) (*boltInviteStore, error) {
+	s := new(boltInviteStore)
+	s.db = db
+	s.clock = c
+	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, invitesBucketName))
+	if err := createBucket(s.db, s.bucket); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltInviteStore) create(r role, createdBy string, ttl time.Duration, maxUses int) (*invite, error) {
+	now := s.clock.Now()
+	i, err := newInvite(r, createdBy, ttl, maxUses, now)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		// Expired invites are dropped whenever a new one is created.
+		if err := s.purge(tx, now); err != nil {
+			return err
+		}
+		return s.put(tx, i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *boltInviteStore) get(token string) (*invite, error) {
+	var i *invite
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(s.bucket).Get([]byte(token))
+		if data == nil {
+			return nil
+		}
+		i = new(invite)
+		return json.Unmarshal(data, i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i == nil || !i.isValid(s.clock.Now()) {
+		return nil, nil
+	}
+	return i, nil
+}
+
+func (s *boltInviteStore) use(token string, join func(i *invite) error) error {
+	var used *invite
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(s.bucket).Get([]byte(token))
+		if data == nil {
+			return errInviteInvalid
+		}
+		used = new(invite)
+		if err := json.Unmarshal(data, used); err != nil {
+			return err
+		}
+		if !used.isValid(s.clock.Now()) {
+			return errInviteInvalid
+		}
+		used.Uses++
+		return s.put(tx, used)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := join(used); err != nil {
+		s.db.Update(func(tx *bolt.Tx) error {
+			data := tx.Bucket(s.bucket).Get([]byte(token))
+			if data == nil {
+				return nil
+			}
+			i := new(invite)
+			if err := json.Unmarshal(data, i); err != nil {
+				return err
+			}
+			i.Uses--
+			return s.put(tx, i)
+		})
+		return err
+	}
+	return nil
+}
+
+func (s *boltInviteStore) delete(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(token))
+	})
+}
+
+func (s *boltInviteStore) list() ([]*invite, error) {
+	invites := make([]*invite, 0)
+	now := s.clock.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, v []byte) error {
+			i := new(invite)
+			if err := json.Unmarshal(v, i); err != nil {
+				return err
+			}
+			if i.isValid(now) {
+				invites = append(invites, i)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (s *boltInviteStore) put(tx *bolt.Tx, i *invite) error {
+	buf, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(s.bucket).Put([]byte(i.Token), buf)
+}
+
+func (s *boltInviteStore) purge(tx *bolt.Tx, now time.Time) error {
+	b := tx.Bucket(s.bucket)
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		i := new(invite)
+		if err := json.Unmarshal(v, i); err != nil {
+			return err
+		}
+		if !i.isValid(now) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
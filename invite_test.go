@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestInviteJoin(t *testing.T) {
+	create := func(query string, user *testerModel, status int) *invite {
+		r, err := http.NewRequest("POST", "/users/invite?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("authorization", signinUser(t, user))
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.usersInviteHandler).ServeHTTP(w, r)
+		assertStatus(t, w, status)
+		if status != http.StatusCreated {
+			return nil
+		}
+		i := new(invite)
+		if err := json.Unmarshal(w.Body.Bytes(), i); err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+	join := func(token string, name string, passcode string, status int) {
+		r, err := http.NewRequest("POST", fmt.Sprintf("/users/join?token=%s&name=%s&passcode=%s", token, name, passcode), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.usersJoinHandler).ServeHTTP(w, r)
+		assertStatus(t, w, status)
+		if status == http.StatusCreated && len(w.Header().Get("authorization")) == 0 {
+			t.Fatal("joined user must be signed in")
+		}
+	}
+
+	addVoter(t, voter1)
+	create("role=voter", voter1, http.StatusForbidden)
+	create("role=scrum_master", master, http.StatusForbidden)
+	create("role=voter&ttl=forever", master, http.StatusBadRequest)
+
+	single := create("role=voter", master, http.StatusCreated)
+	join(single.Token, "master", "secret", http.StatusBadRequest)
+	join(single.Token, "voter1", "secret", http.StatusBadRequest)
+	join(single.Token, "newbie", "sec,ret", http.StatusBadRequest)
+	join(single.Token, "newbie", "secret", http.StatusCreated)
+	join(single.Token, "another", "secret", http.StatusBadRequest)
+	signinUser(t, &testerModel{"newbie", "secret", "voter"})
+
+	page := func(token string, contains string) {
+		r, err := http.NewRequest("GET", "/ui/invite/"+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.pageInviteHandler).ServeHTTP(w, mux.SetURLVars(r, map[string]string{"token": token}))
+		assertStatus(t, w, http.StatusOK)
+		if !strings.Contains(w.Body.String(), contains) {
+			t.Fatalf("invite page must contain %q", contains)
+		}
+	}
+	page(single.Token, "invalid or has expired")
+
+	limited := create("role=voter&uses=0&ttl=1h", master, http.StatusCreated)
+	page(limited.Token, limited.Token)
+	join(limited.Token, "first", "secret", http.StatusCreated)
+	join(limited.Token, "second", "secret", http.StatusCreated)
+
+	testClock.SetOffset(time.Hour)
+	defer testClock.SetOffset(0)
+	join(limited.Token, "third", "secret", http.StatusBadRequest)
+
+	for _, n := range []string{"newbie", "first", "second"} {
+		testHandler.userStore.delete(n)
+	}
+}
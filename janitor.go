@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	janitorInterval = 1 * time.Hour
+	// Every batch is deleted in own transaction, so writers are not blocked for long.
+	janitorBatchSize = 500
+)
+
+// janitor purges the history of polls which is beyond the retention of a team.
+type janitor struct {
+	team      string
+	retention *retention
+	polls     pollStore
+	clock     *clock
+}
+
+func (j *janitor) sweep() (int, error) {
+	var olderThan time.Time
+	if age := j.retention.getMaxAge(); age > 0 {
+		olderThan = j.clock.Now().Add(-age)
+	}
+	if olderThan.IsZero() && j.retention.MaxPolls == 0 {
+		return 0, nil
+	}
+
+	var total int
+	for {
+		n, err := j.polls.purge(olderThan, j.retention.MaxPolls, janitorBatchSize)
+		total += n
+		if err != nil || n < janitorBatchSize {
+			return total, err
+		}
+	}
+}
+
+// start sweeps at once and then every interval until stop is closed.
+func (j *janitor) start(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := j.sweep()
+		if err != nil {
+			logs.error("janitor failed to purge polls", "team", j.team, "err", err)
+		} else if n > 0 {
+			logs.info("janitor purged polls", "team", j.team, "polls", n)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJanitorSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openBoltStorage(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	polls, err := s.polls("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(clock)
+	now := c.Now()
+	// More old polls than a batch, so the sweep takes several transactions.
+	for i := 0; i < janitorBatchSize+10; i++ {
+		polls.append(&pollRecord{Time: now.Add(-48 * time.Hour), Name: "old"})
+	}
+	for i := 0; i < 3; i++ {
+		polls.append(&pollRecord{Time: now.Add(-time.Duration(i) * time.Hour), Name: "recent"})
+	}
+
+	j := &janitor{retention: &retention{}, polls: polls, clock: c}
+	if n, err := j.sweep(); err != nil || n != 0 {
+		t.Fatalf("history must be kept without retention, got %d %v", n, err)
+	}
+
+	j.retention = &retention{MaxAge: "24h"}
+	if n, err := j.sweep(); err != nil || n != janitorBatchSize+10 {
+		t.Fatalf("expected old polls purged, got %d %v", n, err)
+	}
+
+	// Polls age with the clock.
+	c.SetOffset(90 * time.Minute)
+	j.retention = &retention{MaxAge: "2h", MaxPolls: 1}
+	if n, err := j.sweep(); err != nil || n != 2 {
+		t.Fatalf("expected polls beyond the retention purged, got %d %v", n, err)
+	}
+}
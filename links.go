@@ -37,14 +37,22 @@ func (l *link) validate() error {
 	return nil
 }
 
-type linksStore struct {
+type linkStore interface {
+	getMaxLinks() int
+	// create assigns an id to the link unless the limit of links is reached.
+	create(l *link) error
+	deleteByID(id int) error
+	list() ([]*link, error)
+}
+
+type boltLinkStore struct {
 	db       *bolt.DB
 	bucket   []byte
 	maxLinks int
 }
 
-func newLinkStore(db *bolt.DB, shard string, maxLinks int) (*linksStore, error) {
-	s := new(linksStore)
+func newBoltLinkStore(db *bolt.DB, shard string, maxLinks int) (*boltLinkStore, error) {
+	s := new(boltLinkStore)
 	s.db = db
 	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, linksBucketName))
 	if maxLinks <= 0 {
@@ -70,11 +78,11 @@ func newLinkStore(db *bolt.DB, shard string, maxLinks int) (*linksStore, error)
 	return s, nil
 }
 
-func (s *linksStore) getMaxLinks() int {
+func (s *boltLinkStore) getMaxLinks() int {
 	return s.maxLinks
 }
 
-func (s *linksStore) create(l *link) error {
+func (s *boltLinkStore) create(l *link) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.bucket)
 
@@ -101,14 +109,14 @@ func (s *linksStore) create(l *link) error {
 	})
 }
 
-func (s *linksStore) deleteByID(id int) error {
+func (s *boltLinkStore) deleteByID(id int) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.bucket)
 		return b.Delete(itob(id))
 	})
 }
 
-func (s *linksStore) list() ([]*link, error) {
+func (s *boltLinkStore) list() ([]*link, error) {
 	var links []*link
 	err := s.db.View(func(tx *bolt.Tx) error {
 		// Assume bucket exists and has keys
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+	logError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return logInfo, fmt.Errorf("unknown log level %q, wanted %s", s, strings.Join(logLevelNames, ", "))
+}
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logs is the logger of the process, lines of the standard log go to it too.
+var logs = newLogger(os.Stderr, logInfo, logFormatText)
+
+// logger writes records with a level, a message and key value fields, as
+// text or as JSON lines. Loggers made by with share the output.
+type logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+type logOutput struct {
+	mux    sync.Mutex
+	w      io.Writer
+	level  logLevel
+	format string
+}
+
+func newLogger(w io.Writer, level logLevel, format string) *logger {
+	return &logger{out: &logOutput{w: w, level: level, format: format}}
+}
+
+// configure sets the level and the format of the output.
+func (l *logger) configure(level string, format string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("unknown log format %q, wanted %s or %s", format, logFormatText, logFormatJSON)
+	}
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	l.out.level, l.out.format = lvl, format
+	return nil
+}
+
+// setOutput replaces the writer of the output and returns the previous one.
+func (l *logger) setOutput(w io.Writer) io.Writer {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	prev := l.out.w
+	l.out.w = w
+	return prev
+}
+
+// with returns a logger adding the key value pairs to every record.
+func (l *logger) with(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &logger{out: l.out, fields: append(fields, kv...)}
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) { l.log(logDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.log(logInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.log(logWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.log(logError, msg, kv) }
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	if level < l.out.level {
+		return
+	}
+	fields := append(l.fields[:len(l.fields):len(l.fields)], kv...)
+	buf := new(bytes.Buffer)
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	if l.out.format == logFormatJSON {
+		writeJSONRecord(buf, now, level, msg, fields)
+	} else {
+		writeTextRecord(buf, now, level, msg, fields)
+	}
+	l.out.w.Write(buf.Bytes())
+}
+
+// writeJSONRecord writes fields in the given order, later fields don't
+// replace earlier ones of the same key.
+func writeJSONRecord(buf *bytes.Buffer, now string, level logLevel, msg string, fields []interface{}) {
+	fmt.Fprintf(buf, `{"time":%q,"level":%q,"msg":%s`, now, level, jsonValue(msg))
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteString(",")
+		buf.Write(jsonValue(fmt.Sprint(fields[i])))
+		buf.WriteString(":")
+		buf.Write(jsonValue(fieldValue(fields, i+1)))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeTextRecord(buf *bytes.Buffer, now string, level logLevel, msg string, fields []interface{}) {
+	fmt.Fprintf(buf, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(fields); i += 2 {
+		v := fmt.Sprint(fieldValue(fields, i+1))
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(buf, " %v=%s", fields[i], v)
+	}
+	buf.WriteString("\n")
+}
+
+// fieldValue returns the value of a key, errors as their message, a key
+// without a value gets nil.
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i >= len(fields) {
+		return nil
+	}
+	if err, ok := fields[i].(error); ok {
+		return err.Error()
+	}
+	return fields[i]
+}
+
+func jsonValue(v interface{}) []byte {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		buf, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return buf
+}
+
+// stdLogWriter takes lines of the standard log, which are info records.
+type stdLogWriter struct {
+	l *logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.l.info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
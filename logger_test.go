@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := newLogger(buf, logInfo, logFormatText)
+	team := l.with("team", "alpha")
+	team.debug("hidden")
+	team.info("socket connected", "user", "va", "reason", "server restarting", "err", errors.New("boom"))
+	if strings.Contains(buf.String(), "hidden") {
+		t.Fatalf("expected debug records to be left out, got %q", buf.String())
+	}
+	line := buf.String()
+	for _, part := range []string{"INFO  socket connected", "team=alpha", "user=va", `reason="server restarting"`, "err=boom"} {
+		if !strings.Contains(line, part) {
+			t.Fatalf("expected %q in %q", part, line)
+		}
+	}
+
+	buf.Reset()
+	if err := l.configure("warn", logFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	team.info("hidden")
+	team.warn("slow", "ms", 12.5)
+	if line := buf.String(); !strings.HasSuffix(line, `"level":"warn","msg":"slow","team":"alpha","ms":12.5}`+"\n") {
+		t.Fatalf("expected a JSON record of the shared output, got %q", line)
+	}
+
+	if err := l.configure("verbose", logFormatJSON); err == nil {
+		t.Fatal("expected unknown levels to fail")
+	}
+	if err := l.configure("info", "xml"); err == nil {
+		t.Fatal("expected unknown formats to fail")
+	}
+}
@@ -12,9 +12,6 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/boltdb/bolt"
-	"github.com/casbin/casbin"
 )
 
 var version string
@@ -23,28 +20,48 @@ var version string
 var (
 	databaseDir     = flag.String("db_dir", "", "Database directory path")
 	databasePerTeam = flag.Bool("db_per_team", false, "Must each team has own database")
+	storageKind     = flag.String("storage", storageBolt, "Storage backend, bolt or sqlite")
+	allowedOrigins  = flag.String("allowed_origins", "", "Comma separated origins allowed besides the server host, e.g. https://board.example.com")
+	listenAddr      = flag.String("listen", "", "Address serving all teams from one listener, e.g. :8000, teams are served from own ports if empty")
+	routeBy         = flag.String("route_by", routeByPath, "How the shared listener picks the team, path /t/{team}/ or host of the team")
+	adminAddr       = flag.String("admin_listen", "", "Address of the admin UI and API managing teams, disabled if empty")
+	teamsWatch      = flag.Duration("teams_watch", 0, "How often teams.json is checked for changes, it is reloaded on SIGHUP only if 0")
+	logLevelName    = flag.String("log_level", "info", "Lowest level of logged records, debug, info, warn or error")
+	logFormat       = flag.String("log_format", logFormatText, "Format of logged records, text or json lines")
 )
 
 const (
-	dbPath                     = "scoreboard.db"
+	dbPath                     = "scoreboard"
 	authConfPath               = "config/auth.conf"
 	policyConfPath             = "config/policy.csv"
 	teamsPath                  = "config/teams.json"
 	templateDir                = "templates/"
 	staticDir                  = "static/"
-	usersLimitPerTeam          = 25
-	linksLimitPerTeam          = 10
-	connLimitPerTeamServer     = 25
+	defaultQuotaUsers          = 25
+	defaultQuotaLinks          = 10
+	defaultQuotaConnections    = 25
 	webSocketPingPeriod        = 5 * time.Second
+	serverWriteTimeout         = 20 * time.Second
 	defaultMaxFib              = 14
 	defaultOutBucket           = 3
 	defaultMaxLeaderIdlePeriod = "1h"
 	notificationBufferSize     = 10
-	onlineEnabledFlag          = false
+	clientBufferSize           = 8
+	sessionHistorySize         = 100
+	clientMaxCoalesced         = 32
+	socketWriteWait            = 10 * time.Second
+	defaultPresenceIdleAfter   = "5m"
+	presenceCheckPeriod        = 1 * time.Second
+	shutdownDrainPeriod        = 10 * time.Second
 )
 
 func main() {
 	flag.Parse()
+	if err := logs.configure(*logLevelName, *logFormat); err != nil {
+		log.Fatal(err)
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logs})
 
 	appdir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -60,56 +77,162 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to read teams %v", err)
 	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:], dbdir, teams); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	start(appdir, dbdir, teams)
 }
 
+// runCommand runs a maintenance command instead of servers.
+func runCommand(name string, args []string, dbdir string, teams map[string]*team) error {
+	switch name {
+	case "migrate":
+		return migrateCommand(args, dbdir, teams)
+	case "backup":
+		return backupCommand(args, dbdir, teams)
+	case "restore":
+		return restoreCommand(args, dbdir, teams)
+	case "export":
+		return exportCommand(args, dbdir, teams)
+	case "import":
+		return importCommand(args, dbdir, teams)
+	case "admin":
+		return adminCommand(args, dbdir)
+	}
+	return fmt.Errorf("unknown command %q, wanted migrate, backup, restore, export, import or admin", name)
+}
+
 func start(appdir string, dbdir string, teams map[string]*team) {
-	done, broadcast := make(chan bool, len(teams)), make(chan bool)
-	enforcer := casbin.NewEnforcer(filepath.Join(appdir, authConfPath), filepath.Join(appdir, policyConfPath))
-
-	var db *bolt.DB
-	for _, team := range teams {
-		if *databasePerTeam || db == nil {
-			// It will be created if it doesn't exist.
-			var dbfile = dbPath
-			if *databasePerTeam {
-				dbfile = fmt.Sprintf("%s.%s", strings.ToLower(team.Name), dbfile)
-			}
-			teamdb, err := bolt.Open(
-				filepath.Join(dbdir, dbfile), 0600, &bolt.Options{Timeout: 1 * time.Second})
-			if err != nil {
-				log.Fatal(err)
-			}
-			db = teamdb
-			defer func(b *bolt.DB) { b.Close() }(teamdb)
+	done, broadcast := make(chan bool), make(chan bool)
+	origins := newOriginPolicy(strings.Split(*allowedOrigins, ","))
+
+	stores, _, err := openTeamStorages(*storageKind, dbdir, *databasePerTeam, teams, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stores.close()
+
+	// The system shard lives in the storage teams share or in own one.
+	system := stores[sortedTeamNames(teams)[0]]
+	if *databasePerTeam {
+		if system, err = openSystemStorage(*storageKind, dbdir); err != nil {
+			log.Fatal(err)
 		}
+	}
+	stores[systemShard] = system
+	records, err := system.teams()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	steps, err := stores.migrate(teams, false)
+	if err != nil {
+		log.Fatalf("failed to migrate storage %v", err)
+	}
+	for _, step := range steps {
+		logs.info("migrated", "step", step)
+	}
+
+	if len(*backupDir) > 0 {
+		go scheduleBackups(backupLabels(stores, *databasePerTeam), *storageKind, *backupDir, *backupInterval, *backupKeep, broadcast)
+	}
 
-		if db == nil {
-			log.Fatal("database was not found")
+	newOpts := func(team *team) *teamServerOpts {
+		return &teamServerOpts{
+			authConf:   filepath.Join(appdir, authConfPath),
+			policyConf: filepath.Join(appdir, policyConfPath),
+			team:       team,
+			addr:       fmt.Sprintf(":%d", team.Port),
+			templates:  filepath.Join(appdir, templateDir),
+			staticDir:  filepath.Join(appdir, staticDir),
+			origins:    origins,
 		}
+	}
 
-		go startTeamServer(&teamServerOpts{
-			db:          db,
-			enf:         enforcer,
-			team:        team,
-			addr:        fmt.Sprintf(":%d", team.Port),
-			templates:   filepath.Join(appdir, templateDir),
-			staticDir:   filepath.Join(appdir, staticDir),
-			connlimit:   connLimitPerTeamServer,
-			sigstop:     broadcast,
-			sigshutdown: done,
-		})
-		log.Printf("server team - %s has started at port %d", team.Name, team.Port)
+	servers := 0
+	var tenants *tenantRouter
+	if len(*listenAddr) > 0 {
+		if tenants, err = newTenantRouter(*routeBy); err != nil {
+			log.Fatal(err)
+		}
+		go serve("of teams", *listenAddr, tenants, broadcast, done)
+		logs.info("server of teams started", "addr", *listenAddr, "route_by", *routeBy)
+		servers++
+	}
+
+	fleet := newTeamFleet(newOpts, tenants)
+	if tenants != nil {
+		tenants.serveProbes(fleet.readiness)
+	}
+	fleet.open = func(t *team) (storage, error) {
+		store, steps, err := stores.open(*storageKind, dbdir, *databasePerTeam, t)
+		for _, step := range steps {
+			logs.info("migrated", "team", t.Name, "step", step)
+		}
+		return store, err
+	}
+	fleet.release = func(t *team) {
+		stores.release(t.Name)
+	}
+
+	path := filepath.Join(appdir, teamsPath)
+	catalog := newTeamCatalog(path, records, fleet, new(clock))
+	if err := catalog.load(teams); err != nil {
+		log.Fatalf("failed to start teams %v", err)
+	}
+	reload := watchTeams(path, *teamsWatch, broadcast)
+
+	var admin *adminEndpoints
+	if len(*adminAddr) > 0 {
+		admins, err := system.users(systemShard, maxAdmins)
+		if err != nil {
+			log.Fatal(err)
+		}
+		audit, err := system.audit(systemShard, new(clock))
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := newOpts(newDefaultTeam())
+		templates, err := newTemplateMgr(opts.templates, &page{Version: version})
+		if err != nil {
+			log.Fatal(err)
+		}
+		admin = newAdminEndpoints(catalog, admins, audit, templates, opts.origins, new(clock))
+		go serve("of admins", *adminAddr, newAdminRouter(admin, opts), broadcast, done)
+		logs.info("server of admins started", "addr", *adminAddr)
+		servers++
 	}
 
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
-	<-sigint
+	for running := true; running; {
+		select {
+		case <-reload:
+			logs.info("reloading teams", "path", path)
+			if err := catalog.reload(); err != nil {
+				logs.error("teams failed to reload", "err", err)
+			}
+		case <-sigint:
+			running = false
+		}
+	}
 
-	log.Printf("shutting down %d servers", len(teams))
+	logs.info("shutting down servers")
+
+	// The admin server reports the process not ready from now on.
+	if admin != nil {
+		admin.drainer.close()
+	}
 
 	close(broadcast)
-	for range teams {
+	fleet.stopAll()
+	if admin != nil {
+		admin.shutdown(shutdownDrainPeriod)
+	}
+	for i := 0; i < servers; i++ {
 		<-done
 	}
 }
@@ -128,20 +251,37 @@ func readTeams(path string) (map[string]*team, error) {
 		return nil, fmt.Errorf("at least one team is required")
 	}
 
-	opts, listenPorts := newDefaultTeam(), make(map[int]bool)
+	if err := validateTeams(teams); err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+// validateTeams extends teams with defaults and validates each of them and
+// ports and hosts they share.
+func validateTeams(teams map[string]*team) error {
+	opts, listenPorts, hosts := newDefaultTeam(), make(map[int]bool), make(map[string]bool)
 	for name, team := range teams {
 		team.Name = name
-		if _, ok := listenPorts[team.Port]; ok {
-			return nil, fmt.Errorf("duplicate port %d", team.Port)
+		if _, ok := listenPorts[team.Port]; ok && team.Port != 0 {
+			return fmt.Errorf("duplicate port %d", team.Port)
 		}
 		listenPorts[team.Port] = true
+		if host := strings.ToLower(team.Host); len(host) > 0 {
+			if _, ok := hosts[host]; ok {
+				return fmt.Errorf("duplicate host %s", team.Host)
+			}
+			hosts[host] = true
+		}
+		if _, ok := teams[team.RenamedFrom]; ok {
+			return fmt.Errorf("team %s is renamed from existing team %s", name, team.RenamedFrom)
+		}
 		team.extend(opts)
 		if err := team.validate(); err != nil {
-			return nil, err
+			return err
 		}
 	}
-
-	return teams, nil
+	return nil
 }
 
 func init() {
@@ -6,10 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
-	"time"
 
-	"github.com/boltdb/bolt"
-	"github.com/casbin/casbin"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -21,6 +19,8 @@ var (
 func TestMain(m *testing.M) {
 	testClock = new(clock)
 	testTeam = newDefaultTeam()
+	// Every test user gets a hash, the cost of real ones only slows tests down.
+	passcodeCost = bcrypt.MinCost
 
 	workdir, err := filepath.Abs(".")
 	if err != nil {
@@ -34,41 +34,85 @@ func TestMain(m *testing.M) {
 	}
 	defer os.Remove(dbFile.Name())
 
-	db, err := bolt.Open(dbFile.Name(), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	store, err := openBoltStorage(dbFile.Name())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	enf := casbin.NewEnforcer(filepath.Join(workdir, authConfPath), filepath.Join(workdir, policyConfPath))
+	overrides, err := store.policies(testTeam.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policies := newPolicyStore(overrides, filepath.Join(workdir, policyConfPath))
+	enf, err := newPolicyEnforcer(filepath.Join(workdir, authConfPath), policies)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// init user store and load users
-	users, err := newUserStore(db, testTeam.Name, 10)
+	users, err := store.users(testTeam.Name, 10)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// init user store and load users
-	links, err := newLinkStore(db, testTeam.Name, 10)
+	links, err := store.links(testTeam.Name, 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	audit, err := store.audit(testTeam.Name, testClock)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	invites, err := store.invites(testTeam.Name, testClock)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	templates := newTemplateMgr(filepath.Join(workdir, templateDir), &page{
+	polls, err := store.polls(testTeam.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	templates, err := newTemplateMgr(filepath.Join(workdir, templateDir), &page{
 		Version: "0.0.0",
 		Team:    testTeam.Name,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	testHandler = newEndpoints(&endpointsConfig{
+	testHandler, err = newEndpoints(&endpointsConfig{
 		team:        testTeam,
 		enforcer:    enf,
 		templateMgr: templates,
 		userStore:   users,
 		linkStore:   links,
+		policyStore: policies,
+		auditStore:  audit,
+		inviteStore: invites,
+		pollStore:   polls,
+		storage:     store,
+		origins:     newOriginPolicy(nil),
 		clock:       testClock,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	code := m.Run()
 
 	os.Remove(dbFile.Name())
 	os.Exit(code)
 }
+
+func loadTestTemplates(t *testing.T, defaults *page) *templateMgr {
+	m, err := newTemplateMgr(templateDir, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
@@ -1,22 +1,52 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-
-	"github.com/prometheus/client_golang/prometheus"
 )
 
-func connLimitMiddleware(size int) mux.MiddlewareFunc {
-	budget := make(chan int, size)
+// connLimit bounds requests served at once.
+type connLimit struct {
+	budget chan int
+}
+
+func newConnLimit(size int) *connLimit {
+	return &connLimit{budget: make(chan int, size)}
+}
+
+// usage returns the number of requests being served and the limit.
+func (l *connLimit) usage() *quotaUsage {
+	return &quotaUsage{Used: len(l.budget), Max: cap(l.budget)}
+}
+
+// connLimitMiddleware rejects requests beyond the limit, requests of ignorePaths
+// like probes are served anyway, so a busy team isn't taken for a dead one.
+func connLimitMiddleware(l *connLimit, ignorePaths []string) mux.MiddlewareFunc {
+	skipMap := make(map[string]bool, len(ignorePaths))
+	for _, p := range ignorePaths {
+		skipMap[p] = true
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skipMap[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
 			select {
-			case budget <- 0:
+			case l.budget <- 0:
 				next.ServeHTTP(w, r)
-				<-budget
+				<-l.budget
 			default:
 				w.WriteHeader(http.StatusServiceUnavailable)
 				w.Write([]byte("Connection limit reached"))
@@ -25,7 +55,92 @@ func connLimitMiddleware(size int) mux.MiddlewareFunc {
 	}
 }
 
-func metricMiddleware(ignorePaths []string) mux.MiddlewareFunc {
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// originPolicy accepts requests without an Origin, from the server host itself
+// and from explicitly allowed origins.
+type originPolicy struct {
+	allowed map[string]bool
+}
+
+func newOriginPolicy(origins []string) *originPolicy {
+	o := new(originPolicy)
+	o.allowed = make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		if len(origin) > 0 {
+			o.allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	return o
+}
+
+func (o *originPolicy) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return o.allowed[strings.ToLower(origin)]
+}
+
+// securityMiddleware rejects state changing requests from foreign origins and
+// checks the double submit CSRF token of browsers. Pages issue the token cookie,
+// API clients without the cookie are only checked for the origin.
+func securityMiddleware(origins *originPolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				if isPagePath(r.URL.Path) {
+					if _, err := r.Cookie(csrfCookieName); err != nil {
+						issueCSRFToken(w)
+					}
+				}
+			default:
+				if !origins.check(r) {
+					http.Error(w, "origin is not allowed", http.StatusForbidden)
+					return
+				}
+				if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != r.Header.Get(csrfHeaderName) {
+					http.Error(w, "csrf token is invalid", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func issueCSRFToken(w http.ResponseWriter) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    hex.EncodeToString(buf),
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func isPagePath(path string) bool {
+	return path == "/" || strings.HasPrefix(path, "/ui/")
+}
+
+// metricMiddleware observes latency of requests by the template of the matched
+// route, so it must be used by a mux router.
+func metricMiddleware(team string, ignorePaths []string) mux.MiddlewareFunc {
 	skipMap := make(map[string]bool, len(ignorePaths))
 	for _, p := range ignorePaths {
 		skipMap[p] = true
@@ -39,9 +154,162 @@ func metricMiddleware(ignorePaths []string) mux.MiddlewareFunc {
 			reqCounter.Inc()
 			start := time.Now()
 			next.ServeHTTP(w, r)
-			httpDurations.With(prometheus.Labels{
-				"path": r.URL.Path,
-			}).Observe(float64(time.Since(start).Seconds()) / 1e3)
+			httpDurations.WithLabelValues(team, routeTemplate(r), r.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// routeTemplate returns the path template of the route matched by mux.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unmatched"
+}
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	requestIDMaxLength = 64
+)
+
+type requestInfoKey struct{}
+
+// requestInfo identifies a request in logs, handlers set the user once the
+// request is authenticated.
+type requestInfo struct {
+	id   string
+	team string
+	mux  sync.Mutex
+	user string
+	// route is the template of the matched route, empty if none matched.
+	route string
+}
+
+func requestInfoOf(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setRequestUser tags the log of the request with the user.
+func setRequestUser(r *http.Request, user string) {
+	if info := requestInfoOf(r); info != nil {
+		info.mux.Lock()
+		info.user = user
+		info.mux.Unlock()
+	}
+}
+
+// requestLogger returns a logger of records correlated with the request.
+func requestLogger(r *http.Request) *logger {
+	info := requestInfoOf(r)
+	if info == nil {
+		return logs
+	}
+	return logs.with("request_id", info.id, "team", info.team)
+}
+
+// requestID keeps the id set by a proxy in front of the server if it is safe to
+// log, otherwise it makes a new one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if len(id) > 0 && len(id) <= requestIDMaxLength && strings.Trim(id, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_.") == "" {
+		return id
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// logRequests logs every request of the router, requests mux answers with 404
+// or 405 included, which never reach middlewares of the router.
+func logRequests(router *mux.Router, team string, ignorePaths []string) http.Handler {
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if info := requestInfoOf(r); info != nil {
+				info.mux.Lock()
+				info.route = routeTemplate(r)
+				info.mux.Unlock()
+			}
+			next.ServeHTTP(w, r)
 		})
+	})
+	return requestLogMiddleware(team, ignorePaths)(router)
+}
+
+// requestLogMiddleware logs a record of every request with its id, which is
+// sent back in the X-Request-ID header. Requests to ignored paths are logged
+// at the debug level.
+func requestLogMiddleware(team string, ignorePaths []string) mux.MiddlewareFunc {
+	skipMap := make(map[string]bool, len(ignorePaths))
+	for _, p := range ignorePaths {
+		skipMap[p] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := &requestInfo{id: requestID(r), team: team}
+			w.Header().Set(requestIDHeader, info.id)
+			rec := &statusRecorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+			info.mux.Lock()
+			user, route := info.user, info.route
+			info.mux.Unlock()
+			if len(route) == 0 {
+				route = "unmatched"
+			}
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			log := logs.info
+			switch {
+			case skipMap[r.URL.Path]:
+				log = logs.debug
+			case status >= http.StatusInternalServerError:
+				log = logs.error
+			}
+			log("request", "request_id", info.id, "team", team, "user", user, "method", r.Method,
+				"route", route, "status", status, "latency_ms", float64(time.Since(start).Microseconds())/1000,
+				"remote", r.RemoteAddr)
+		})
+	}
+}
+
+// statusRecorder keeps the status of the response, it lets websockets hijack
+// the connection and event streams flush.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
 	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
 }
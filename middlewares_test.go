@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricMiddlewareRoutes(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(metricMiddleware("routes", []string{"/healthz"}))
+	r.HandleFunc("/ui/invite/{token}", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+
+	httpDurations.DeleteLabelValues("routes", "/ui/invite/{token}", "GET")
+	series := testutil.CollectAndCount(httpDurations)
+	for _, path := range []string{"/ui/invite/a", "/ui/invite/b", "/healthz"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if n := testutil.CollectAndCount(httpDurations); n != series+1 {
+		t.Fatalf("expected one series for the route template, got %d new", n-series)
+	}
+	httpDurations.WithLabelValues("routes", "/ui/invite/{token}", "GET")
+	if n := testutil.CollectAndCount(httpDurations); n != series+1 {
+		t.Fatal("expected requests to be labeled by the route template")
+	}
+}
+
+func TestSecurityMiddleware(t *testing.T) {
+	router := newTeamRouter(testHandler, &teamServerOpts{
+		team:      testTeam,
+		origins:   newOriginPolicy([]string{"https://board.example.com/"}),
+		staticDir: staticDir,
+	})
+	serve := func(method string, path string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = "localhost:8000"
+		if prepare != nil {
+			prepare(r)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assertStatus(t, serve("GET", "/session/close", nil), http.StatusMethodNotAllowed)
+	assertStatus(t, serve("POST", "/session/changes", nil), http.StatusMethodNotAllowed)
+	assertStatus(t, serve("POST", "/session", nil), http.StatusMethodNotAllowed)
+
+	w := serve("GET", "/", nil)
+	assertStatus(t, w, http.StatusOK)
+	for _, h := range []string{"Content-Security-Policy", "X-Frame-Options", "X-Content-Type-Options"} {
+		if len(w.Header().Get(h)) == 0 {
+			t.Fatalf("page is missing %s header", h)
+		}
+	}
+	var token *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			token = c
+		}
+	}
+	if token == nil {
+		t.Fatal("page must issue a csrf token")
+	}
+
+	// Session options are rendered as JSON instead of an inline script.
+	opts := regexp.MustCompile(`(?s)<script id="SessionOpts" type="application/json">(.*?)</script>`).FindStringSubmatch(w.Body.String())
+	if opts == nil {
+		t.Fatal("session options are missing")
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(opts[1]), &parsed); err != nil {
+		t.Fatalf("session options must be valid JSON: %v %s", err, opts[1])
+	}
+
+	withOrigin := func(origin string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Origin", origin) }
+	}
+	assertStatus(t, serve("POST", "/session/close", withOrigin("https://evil.example.com")), http.StatusForbidden)
+	assertStatus(t, serve("POST", "/session/close", withOrigin("https://board.example.com")), http.StatusUnauthorized)
+	assertStatus(t, serve("POST", "/session/close", withOrigin("http://localhost:8000")), http.StatusUnauthorized)
+	assertStatus(t, serve("POST", "/session/close", nil), http.StatusUnauthorized)
+
+	assertStatus(t, serve("POST", "/session/close", func(r *http.Request) {
+		r.AddCookie(token)
+	}), http.StatusForbidden)
+	assertStatus(t, serve("POST", "/session/close", func(r *http.Request) {
+		r.AddCookie(token)
+		r.Header.Set(csrfHeaderName, token.Value)
+	}), http.StatusUnauthorized)
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	o := newOriginPolicy([]string{"https://board.example.com"})
+	r := httptest.NewRequest("GET", "/session/changes", nil)
+	r.Host = "localhost:8000"
+
+	for origin, allowed := range map[string]bool{
+		"":                          true,
+		"http://localhost:8000":     true,
+		"https://board.example.com": true,
+		"https://evil.example.com":  false,
+	} {
+		r.Header.Set("Origin", origin)
+		if o.check(r) != allowed {
+			t.Fatalf("origin %q must be allowed=%v", origin, allowed)
+		}
+	}
+}
+
+func TestConnLimitMiddleware(t *testing.T) {
+	l := newConnLimit(1)
+	entered, release := make(chan bool), make(chan bool)
+	handler := connLimitMiddleware(l, probePaths)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			return
+		}
+		entered <- true
+		<-release
+	}))
+
+	done := make(chan bool)
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/session/changes", nil))
+		done <- true
+	}()
+	<-entered
+	if u := l.usage(); u.Used != 1 || u.Max != 1 {
+		t.Fatalf("expected one of one connection used, got %+v", u)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/session", nil))
+	assertStatus(t, w, http.StatusServiceUnavailable)
+
+	// Probes are answered by a team with every connection in use.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assertStatus(t, w, http.StatusOK)
+
+	close(release)
+	<-done
+	if u := l.usage(); u.Used != 0 {
+		t.Fatalf("expected connection to be released, got %+v", u)
+	}
+}
+
+func TestQuotaPages(t *testing.T) {
+	users, _ := testHandler.userStore.list()
+	links, _ := testHandler.linkStore.list()
+	for path, quota := range map[string]string{
+		"/ui/users": fmt.Sprintf("%d of %d users", len(users), testHandler.userStore.getMaxUsers()),
+		"/ui/links": fmt.Sprintf("%d of %d links", len(links), testHandler.linkStore.getMaxLinks()),
+	} {
+		w := httptest.NewRecorder()
+		testHandler.renderQuotaPage(w, httptest.NewRequest("GET", path, nil), strings.TrimPrefix(path, "/ui/")+".html")
+		assertStatus(t, w, http.StatusOK)
+		if !strings.Contains(w.Body.String(), quota) {
+			t.Fatalf("expected %s to show %q", path, quota)
+		}
+	}
+}
+
+func TestRequestLogMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/ui/invite/{token}", func(w http.ResponseWriter, r *http.Request) {
+		setRequestUser(r, "va")
+		requestLogger(r).info("inside")
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("GET")
+	r := logRequests(router, "routes", []string{"/healthz"})
+
+	buf := new(bytes.Buffer)
+	prev := logs.setOutput(buf)
+	if err := logs.configure("info", logFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method string, path string, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(requestIDHeader, id)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	kept, made := serve("GET", "/ui/invite/a", "proxy-1.a_b"), serve("GET", "/ui/invite/a", "bad id\n")
+	// Requests mux answers by itself are logged too.
+	serve("GET", "/missing", "missing")
+	serve("POST", "/ui/invite/a", "not-allowed")
+	logs.configure("info", logFormatText)
+	logs.setOutput(prev)
+
+	if id := kept.Header().Get(requestIDHeader); id != "proxy-1.a_b" {
+		t.Fatalf("expected the id of the proxy, got %q", id)
+	}
+	id := made.Header().Get(requestIDHeader)
+	if len(id) == 0 || id == "bad id\n" {
+		t.Fatalf("expected a new id, got %q", id)
+	}
+
+	records := make(map[string]map[string]interface{})
+	unmatched := make(map[interface{}]interface{})
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("expected JSON lines, got %q: %v", line, err)
+		}
+		if rec["request_id"] == id {
+			records[rec["msg"].(string)] = rec
+		}
+		if rec["route"] == "unmatched" {
+			unmatched[rec["request_id"]] = rec["status"]
+		}
+	}
+	if unmatched["missing"] != float64(http.StatusNotFound) || unmatched["not-allowed"] != float64(http.StatusMethodNotAllowed) {
+		t.Fatalf("expected 404 and 405 to be logged, got %v", unmatched)
+	}
+	if inside := records["inside"]; inside == nil || inside["team"] != "routes" {
+		t.Fatalf("expected records of handlers to have the request id and team, got %v", records)
+	}
+	req := records["request"]
+	if req == nil {
+		t.Fatalf("expected a record of the request, got %v", records)
+	}
+	for k, v := range map[string]interface{}{
+		"level": "info", "team": "routes", "user": "va", "route": "/ui/invite/{token}", "method": "GET", "status": float64(http.StatusAccepted),
+	} {
+		if req[k] != v {
+			t.Fatalf("expected %s to be %v, got %v", k, v, req)
+		}
+	}
+	if _, ok := req["latency_ms"].(float64); !ok {
+		t.Fatalf("expected the latency, got %v", req)
+	}
+}
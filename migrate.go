@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	metaBucketName   = "meta"
+	schemaVersionKey = "schema_version"
+)
+
+// teamBucketNames are suffixes of the buckets of a team, every bucket is named <team>_<suffix>.
+var teamBucketNames = []string{
+	usersBucketName, linksBucketName, auditBucketName, invitesBucketName, policyBucketName, pollsBucketName, snapshotBucketName,
+}
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+type migrateOptions struct {
+	// renames maps previous team names to the current ones.
+	renames map[string]string
+	dryRun  bool
+}
+
+type boltMigration struct {
+	version     int
+	description string
+	apply       func(tx *bolt.Tx) error
+}
+
+// boltMigrations are applied in order of versions. A released migration must
+// never be changed, append a new one instead.
+var boltMigrations = []*boltMigration{
+	{
+		version:     1,
+		description: "start versioning of team buckets",
+		apply:       func(tx *bolt.Tx) error { return nil },
+	},
+	{
+		version:     2,
+		description: "hash passcodes of users",
+		apply:       hashBoltPasscodes,
+	},
+}
+
+// hashBoltPasscodes replaces plain passcodes, kept before version 2, with their hashes.
+func hashBoltPasscodes(tx *bolt.Tx) error {
+	var buckets [][]byte
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if strings.HasSuffix(string(name), "_"+usersBucketName) {
+			buckets = append(buckets, append([]byte(nil), name...))
+		}
+		return nil
+	})
+
+	type plainUser struct {
+		user
+		Passcode string `json:"passcode"`
+	}
+	for _, name := range buckets {
+		b := tx.Bucket(name)
+		users := make(map[string]*user)
+		err := b.ForEach(func(k, v []byte) error {
+			u := new(plainUser)
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			if len(u.PasscodeHash) == 0 {
+				u.setPasscode(u.Passcode)
+				users[string(k)] = &u.user
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, u := range users {
+			buf, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(k), buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func latestBoltSchemaVersion() int {
+	return boltMigrations[len(boltMigrations)-1].version
+}
+
+// boltSchemaVersion returns 0 for databases created before schema versioning.
+func boltSchemaVersion(tx *bolt.Tx) int {
+	b := tx.Bucket([]byte(metaBucketName))
+	if b == nil {
+		return 0
+	}
+	v := b.Get([]byte(schemaVersionKey))
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+// migrateBolt applies pending migrations and team renames in the transaction
+// and returns descriptions of the applied steps.
+func migrateBolt(tx *bolt.Tx, opts *migrateOptions) ([]string, error) {
+	var steps []string
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return nil, err
+	}
+
+	version := boltSchemaVersion(tx)
+	if latest := latestBoltSchemaVersion(); version > latest {
+		return nil, fmt.Errorf("schema version %d is newer than %d supported by this build", version, latest)
+	}
+	for _, m := range boltMigrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.apply(tx); err != nil {
+			return nil, fmt.Errorf("migration %d failed: %v", m.version, err)
+		}
+		if err := meta.Put([]byte(schemaVersionKey), itob(m.version)); err != nil {
+			return nil, err
+		}
+		steps = append(steps, fmt.Sprintf("schema %d: %s", m.version, m.description))
+	}
+
+	for _, from := range sortedRenames(opts.renames) {
+		to := opts.renames[from]
+		renamed, err := renameBoltTeam(tx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if renamed {
+			steps = append(steps, fmt.Sprintf("rename team %s to %s", from, to))
+		}
+	}
+	return steps, nil
+}
+
+// renameBoltTeam moves buckets of the team, bolt can't rename buckets so they are copied.
+func renameBoltTeam(tx *bolt.Tx, from string, to string) (bool, error) {
+	var renamed bool
+	for _, name := range teamBucketNames {
+		src := []byte(fmt.Sprintf("%s_%s", from, name))
+		dst := []byte(fmt.Sprintf("%s_%s", to, name))
+		old := tx.Bucket(src)
+		if old == nil {
+			continue
+		}
+		if tx.Bucket(dst) != nil {
+			return false, fmt.Errorf("can't rename team %s to %s, bucket %s already exists", from, to, dst)
+		}
+		b, err := tx.CreateBucket(dst)
+		if err != nil {
+			return false, err
+		}
+		if err := copyBucket(b, old); err != nil {
+			return false, err
+		}
+		if err := tx.DeleteBucket(src); err != nil {
+			return false, err
+		}
+		renamed = true
+	}
+	return renamed, nil
+}
+
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	// Links and audit entries take ids from the sequence.
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(nested, src.Bucket(k))
+		}
+		return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+	})
+}
+
+func (s *boltStorage) migrate(opts *migrateOptions) ([]string, error) {
+	var steps []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if steps, err = migrateBolt(tx, opts); err != nil {
+			return err
+		}
+		if opts.dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return steps, err
+}
+
+type sqliteMigration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// sqliteMigrations are applied in order of versions, the version is kept
+// in the user_version pragma. Tables of the latest schema are created on open.
+var sqliteMigrations = []*sqliteMigration{
+	{
+		version:     1,
+		description: "start versioning of team tables",
+		apply:       func(tx *sql.Tx) error { return nil },
+	},
+	{
+		version:     2,
+		description: "hash passcodes of users",
+		apply:       hashSqlitePasscodes,
+	},
+}
+
+func latestSqliteSchemaVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].version
+}
+
+func hashSqlitePasscodes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT team, name, passcode FROM users WHERE passcode NOT LIKE ? AND passcode NOT LIKE ?`,
+		passcodeHashPrefix+"%", legacyPasscodeHashPrefix+"%")
+	if err != nil {
+		return err
+	}
+	var users []*user
+	var teams []string
+	for rows.Next() {
+		u, team := new(user), ""
+		var passcode string
+		if err := rows.Scan(&team, &u.Name, &passcode); err != nil {
+			rows.Close()
+			return err
+		}
+		u.setPasscode(passcode)
+		users, teams = append(users, u), append(teams, team)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, u := range users {
+		if _, err := tx.Exec(`UPDATE users SET passcode = ? WHERE team = ? AND name = ?`, u.PasscodeHash, teams[i], u.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStorage) migrate(opts *migrateOptions) ([]string, error) {
+	var steps []string
+	err := sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+			return err
+		}
+		if latest := latestSqliteSchemaVersion(); version > latest {
+			return fmt.Errorf("schema version %d is newer than %d supported by this build", version, latest)
+		}
+		for _, m := range sqliteMigrations {
+			if m.version <= version {
+				continue
+			}
+			if err := m.apply(tx); err != nil {
+				return fmt.Errorf("migration %d failed: %v", m.version, err)
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+				return err
+			}
+			steps = append(steps, fmt.Sprintf("schema %d: %s", m.version, m.description))
+		}
+
+		for _, from := range sortedRenames(opts.renames) {
+			renamed, err := renameSqliteTeam(tx, from, opts.renames[from])
+			if err != nil {
+				return err
+			}
+			if renamed {
+				steps = append(steps, fmt.Sprintf("rename team %s to %s", from, opts.renames[from]))
+			}
+		}
+		if opts.dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return steps, err
+}
+
+var sqliteTeamTables = []string{"users", "links", "audit", "invites", "policy_overrides", "polls", "snapshots"}
+
+func renameSqliteTeam(tx *sql.Tx, from string, to string) (bool, error) {
+	var renamed bool
+	for _, table := range sqliteTeamTables {
+		var n int
+		if err := tx.QueryRow(`SELECT count(*) FROM `+table+` WHERE team = ?`, to).Scan(&n); err != nil {
+			return false, err
+		}
+		res, err := tx.Exec(`UPDATE `+table+` SET team = ? WHERE team = ?`, to, from)
+		if err != nil {
+			return false, err
+		}
+		moved, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if moved > 0 && n > 0 {
+			return false, fmt.Errorf("can't rename team %s to %s, table %s already has rows of %s", from, to, table, to)
+		}
+		renamed = renamed || moved > 0
+	}
+	return renamed, nil
+}
+
+func sortedRenames(renames map[string]string) []string {
+	names := make([]string, 0, len(renames))
+	for from := range renames {
+		names = append(names, from)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// migrateCommand applies migrations without starting servers, the same
+// migrations are applied on every start.
+func migrateCommand(args []string, dbdir string, teams map[string]*team) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry_run", false, "Print pending migrations without applying them")
+	flags.Parse(args)
+
+	stores, moves, err := openTeamStorages(*storageKind, dbdir, *databasePerTeam, teams, *dryRun)
+	if err != nil {
+		return err
+	}
+	defer stores.close()
+
+	steps, err := stores.migrate(teams, *dryRun)
+	if err != nil {
+		return err
+	}
+	steps = append(moves, steps...)
+	if len(steps) == 0 {
+		fmt.Println("schema is up to date")
+	}
+	for _, step := range steps {
+		if *dryRun {
+			fmt.Printf("pending %s\n", step)
+		} else {
+			fmt.Printf("applied %s\n", step)
+		}
+	}
+	return nil
+}
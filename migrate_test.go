@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBoltSchemaVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openBoltStorage(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	if _, err := s.migrate(&migrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if v := boltSchemaVersion(tx); v != latestBoltSchemaVersion() {
+			t.Fatalf("expected schema version %d, got %d", latestBoltSchemaVersion(), v)
+		}
+		return nil
+	})
+
+	s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(metaBucketName)).Put([]byte(schemaVersionKey), itob(latestBoltSchemaVersion()+1))
+	})
+	if _, err := s.migrate(&migrateOptions{}); err == nil {
+		t.Fatal("expected error of a newer schema")
+	}
+}
+
+func TestBoltPasscodesMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openBoltStorage(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// Users were kept with plain passcodes before schema version 2.
+	users, err := s.users("team", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("team_users")).Put([]byte("va"), []byte(`{"name":"va","role":"voter","passcode":"secret"}`))
+	})
+
+	if _, err := s.migrate(&migrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.get("va")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || !u.checkPasscode("secret") || u.checkPasscode("va") {
+		t.Fatalf("expected hashed passcode, got %+v", u)
+	}
+}
+
+func TestTeamStoragesRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	teams := map[string]*team{"Old": {Name: "Old"}}
+	stores, _, err := openTeamStorages(storageBolt, dir, true, teams, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := stores["Old"].users("Old", 10)
+	if err := users.create(newUser("va", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+	stores.close()
+
+	// A dry run leaves the file where it is and reports the move.
+	teams = map[string]*team{"New": {Name: "New", RenamedFrom: "Old"}}
+	stores, moves, err := openTeamStorages(storageBolt, dir, true, teams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 1 {
+		t.Fatalf("expected a pending move, got %v", moves)
+	}
+	if _, err := stores.migrate(teams, true); err != nil {
+		t.Fatal(err)
+	}
+	stores.close()
+	if _, err := os.Stat(storageFile(storageBolt, teamStoragePath(dir, "Old"))); err != nil {
+		t.Fatalf("expected the storage file to stay on a dry run, got %v", err)
+	}
+	if _, err := os.Stat(storageFile(storageBolt, teamStoragePath(dir, "New"))); !os.IsNotExist(err) {
+		t.Fatalf("expected no storage file of the new name on a dry run, got %v", err)
+	}
+
+	stores, _, err = openTeamStorages(storageBolt, dir, true, teams, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stores.close()
+	if _, err := os.Stat(storageFile(storageBolt, teamStoragePath(dir, "Old"))); !os.IsNotExist(err) {
+		t.Fatalf("expected the storage file to be moved, got %v", err)
+	}
+
+	steps, err := stores.migrate(teams, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) < 2 || steps[len(steps)-1] != "rename team Old to New" {
+		t.Fatalf("expected schema and rename steps, got %v", steps)
+	}
+	users, _ = stores["New"].users("New", 10)
+	if u, _ := users.get("va"); u == nil {
+		t.Fatal("expected user of the renamed team")
+	}
+}
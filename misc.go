@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,14 +23,24 @@ func queryKey(r *http.Request, key string) []string {
 	return keys
 }
 
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clock is shared by goroutines of a team, like the presence checker, so its
+// offset is atomic.
 type clock struct {
-	offset time.Duration
+	offset int64
 }
 
 func (c *clock) SetOffset(offset time.Duration) {
-	c.offset = offset
+	atomic.StoreInt64(&c.offset, int64(offset))
 }
 
 func (c *clock) Now() time.Time {
-	return time.Now().Add(c.offset).UTC()
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&c.offset))).UTC()
 }
@@ -1,88 +1,165 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
+)
 
-	"github.com/gorilla/websocket"
+const (
+	presenceOnline = "online"
+	presenceIdle   = "idle"
 )
 
+// presenceModel is a part of the session model, lists are sorted by name.
+type presenceModel struct {
+	// Online have the board open and acted recently.
+	Online []string `json:"online"`
+	// Idle have the board open, but haven't acted for a while.
+	Idle []string `json:"idle"`
+	// Offline are voters of the current poll without the board open.
+	Offline []string `json:"offline"`
+}
+
+// presenceChange is pushed when somebody comes, goes or becomes idle. It isn't
+// a change of the session, so it has no version and isn't kept in the history.
+type presenceChange struct {
+	// msk is the current session for clients which only take sessions.
+	msk *modelMasker
+}
+
+func (m *presenceChange) get(p *principal) interface{} {
+	return m.msk.sm.Presence
+}
+
+// online tracks users who have the board open with ref counts, since a user
+// may open it in many tabs, and when they acted for the last time.
 type online struct {
-	clients  map[*client]bool
-	entering chan *client
-	leaving  chan *client
-	sched    *time.Ticker
-	refs     map[string]int
-	dirty    bool
+	clock     *clock
+	idleAfter time.Duration
+	// changed is called when somebody comes, goes or becomes idle.
+	changed func()
+	stop    chan bool
+	once    sync.Once
+
 	mux      sync.RWMutex
+	refs     map[string]int
+	lastSeen map[string]time.Time
+	last     map[string]string
 }
 
-func newOnline() *online {
+func newOnline(c *clock, idleAfter time.Duration, changed func()) *online {
 	o := new(online)
-	o.clients = make(map[*client]bool)
-	o.entering = make(chan *client)
-	o.leaving = make(chan *client)
-	o.sched = time.NewTicker(time.Millisecond * 200)
+	o.clock = c
+	o.idleAfter = idleAfter
+	o.changed = changed
 	o.refs = make(map[string]int)
-	go o.start()
+	o.lastSeen = make(map[string]time.Time)
+	o.last = make(map[string]string)
+	o.stop = make(chan bool)
+	go o.start(presenceCheckPeriod)
 	return o
 }
 
 func (o *online) enter(s *client) {
-	o.entering <- s
+	o.mux.Lock()
+	o.refs[s.id]++
+	o.lastSeen[s.id] = o.clock.Now()
+	o.mux.Unlock()
+	o.check()
 }
 
 func (o *online) leave(s *client) {
-	o.leaving <- s
+	o.mux.Lock()
+	o.refs[s.id]--
+	if o.refs[s.id] <= 0 {
+		delete(o.refs, s.id)
+		delete(o.lastSeen, s.id)
+	}
+	o.mux.Unlock()
+	o.check()
+}
+
+// seen marks the user as active unless the user doesn't have the board open.
+func (o *online) seen(name string) {
+	o.mux.Lock()
+	if o.refs[name] > 0 {
+		o.lastSeen[name] = o.clock.Now()
+	}
+	o.mux.Unlock()
+	o.check()
+}
+
+func (o *online) states() map[string]string {
+	now := o.clock.Now()
+	states := make(map[string]string, len(o.refs))
+	for name := range o.refs {
+		if now.Sub(o.lastSeen[name]) < o.idleAfter {
+			states[name] = presenceOnline
+		} else {
+			states[name] = presenceIdle
+		}
+	}
+	return states
 }
 
-func (o *online) sync() msgWriter {
+// model returns the presence of users, voters are the voters of the current poll.
+func (o *online) model(voters []string) *presenceModel {
 	o.mux.RLock()
 	defer o.mux.RUnlock()
-	msg := new(onlineUsersMsg)
-	msg.users = make([]string, 0, len(o.refs))
-	for id := range o.refs {
-		msg.users = append(msg.users, id)
+
+	m := &presenceModel{Online: make([]string, 0), Idle: make([]string, 0), Offline: make([]string, 0)}
+	for name, state := range o.states() {
+		if state == presenceOnline {
+			m.Online = append(m.Online, name)
+		} else {
+			m.Idle = append(m.Idle, name)
+		}
+	}
+	for _, voter := range voters {
+		if o.refs[voter] == 0 {
+			m.Offline = append(m.Offline, voter)
+		}
 	}
-	return msg
+	sort.Strings(m.Online)
+	sort.Strings(m.Idle)
+	sort.Strings(m.Offline)
+	return m
 }
 
-func (o *online) start() {
-	defer o.sched.Stop()
-	for {
-		select {
-		case <-o.sched.C:
-			if o.dirty {
-				o.dirty = false
-
-				msg := o.sync()
-				for s := range o.clients {
-					s.msg <- msg
-				}
-			}
-		case s := <-o.entering:
-			o.clients[s] = true
-			o.refs[s.id]++
-			if o.refs[s.id] == 1 {
-				o.dirty = true
-			}
-		case s := <-o.leaving:
-			delete(o.clients, s)
-			close(s.msg)
-
-			o.refs[s.id]--
-			if o.refs[s.id] == 0 {
-				delete(o.refs, s.id)
-				o.dirty = true
-			}
+// check calls changed if states differ from the last check.
+func (o *online) check() {
+	o.mux.Lock()
+	states := o.states()
+	same := len(states) == len(o.last)
+	for name, state := range states {
+		if o.last[name] != state {
+			same = false
+			break
 		}
 	}
+	o.last = states
+	o.mux.Unlock()
+
+	if !same && o.changed != nil {
+		o.changed()
+	}
 }
 
-type onlineUsersMsg struct {
-	users []string
+// start notices users becoming idle until the tracking is closed.
+func (o *online) start(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.check()
+		case <-o.stop:
+			return
+		}
+	}
 }
 
-func (o *onlineUsersMsg) write(c *websocket.Conn, p *principal) error {
-	return c.WriteJSON(o.users)
+func (o *online) close() {
+	o.once.Do(func() { close(o.stop) })
 }
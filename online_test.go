@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnlinePresence(t *testing.T) {
+	c := new(clock)
+	var changes int32
+	o := newOnline(c, time.Minute, func() { atomic.AddInt32(&changes, 1) })
+
+	expect := func(voters []string, want *presenceModel, wantChanges int32) {
+		t.Helper()
+		if got := o.model(voters); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected presence %+v, got %+v", want, got)
+		}
+		if got := atomic.LoadInt32(&changes); got != wantChanges {
+			t.Fatalf("expected %d changes, got %d", wantChanges, got)
+		}
+	}
+
+	// A second tab of the same user is not a change.
+	tab1, tab2, bob := newClient("alice"), newClient("alice"), newClient("bob")
+	o.enter(tab1)
+	o.enter(tab2)
+	o.enter(bob)
+	voters := []string{"carol", "alice"}
+	expect(voters, &presenceModel{Online: []string{"alice", "bob"}, Idle: []string{}, Offline: []string{"carol"}}, 2)
+
+	o.leave(tab1)
+	expect(voters, &presenceModel{Online: []string{"alice", "bob"}, Idle: []string{}, Offline: []string{"carol"}}, 2)
+
+	// Users who haven't acted become idle.
+	c.SetOffset(2 * time.Minute)
+	o.seen("bob")
+	o.seen("carol")
+	expect(voters, &presenceModel{Online: []string{"bob"}, Idle: []string{"alice"}, Offline: []string{"carol"}}, 3)
+
+	o.seen("alice")
+	expect(voters, &presenceModel{Online: []string{"alice", "bob"}, Idle: []string{}, Offline: []string{"carol"}}, 4)
+
+	o.leave(tab2)
+	expect(voters, &presenceModel{Online: []string{"bob"}, Idle: []string{}, Offline: []string{"alice", "carol"}}, 5)
+}
+
+func TestSessionPresence(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHandler.acceptChangeLogListener))
+	defer srv.Close()
+
+	watcher := dialTestSocket(t, srv, voter2, "&protocol=1")
+	defer watcher.Close()
+	waitTestPresence(t, voter2.Name, presenceOnline)
+	version := fetchSession(t, master).Version
+	testHandler.sessionTopic.mux.RLock()
+	history := len(testHandler.sessionTopic.history)
+	testHandler.sessionTopic.mux.RUnlock()
+
+	conn := dialTestSocket(t, srv, voter1, "&protocol=1")
+	waitTestPresence(t, voter1.Name, presenceOnline)
+	// Others are told without a new version of the session.
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for online := false; !online; {
+		msg := new(socketMessage)
+		if err := watcher.ReadJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != socketMsgPresence {
+			continue
+		}
+		buf, _ := json.Marshal(msg.Data)
+		m := new(presenceModel)
+		if err := json.Unmarshal(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range m.Online {
+			online = online || name == voter1.Name
+		}
+	}
+	if got := fetchSession(t, master).Version; got != version {
+		t.Fatalf("expected presence to keep version %d, got %d", version, got)
+	}
+	testHandler.sessionTopic.mux.RLock()
+	kept := len(testHandler.sessionTopic.history)
+	testHandler.sessionTopic.mux.RUnlock()
+	if kept != history {
+		t.Fatalf("expected presence to stay out of the history, got %d changes instead of %d", kept, history)
+	}
+	conn.Close()
+	waitTestPresence(t, voter1.Name, "")
+}
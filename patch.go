@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	patchOpAdd     = "add"
+	patchOpRemove  = "remove"
+	patchOpReplace = "replace"
+)
+
+// patchOp is an operation of a JSON Patch (RFC 6902). Value is encoded even
+// if null, members an operation doesn't define are ignored by receivers.
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// toJSONValue converts a model to the generic value it is encoded as.
+func toJSONValue(v interface{}) (interface{}, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(buf, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// diffJSON returns a patch turning the generic value from into to. Objects are
+// compared key by key, any other changed value including arrays is replaced.
+func diffJSON(from, to interface{}) []*patchOp {
+	return appendJSONDiff(make([]*patchOp, 0), "", from, to)
+}
+
+func appendJSONDiff(ops []*patchOp, path string, from, to interface{}) []*patchOp {
+	fromObj, fromIsObj := from.(map[string]interface{})
+	toObj, toIsObj := to.(map[string]interface{})
+	if !fromIsObj || !toIsObj {
+		if !reflect.DeepEqual(from, to) {
+			ops = append(ops, &patchOp{Op: patchOpReplace, Path: path, Value: to})
+		}
+		return ops
+	}
+
+	// Keys are sorted, so equal models always produce the same patch.
+	for _, k := range sortedJSONKeys(fromObj) {
+		if _, ok := toObj[k]; !ok {
+			ops = append(ops, &patchOp{Op: patchOpRemove, Path: path + "/" + escapeJSONPointer(k)})
+		}
+	}
+	for _, k := range sortedJSONKeys(toObj) {
+		v, ok := fromObj[k]
+		if !ok {
+			ops = append(ops, &patchOp{Op: patchOpAdd, Path: path + "/" + escapeJSONPointer(k), Value: toObj[k]})
+			continue
+		}
+		ops = appendJSONDiff(ops, path+"/"+escapeJSONPointer(k), v, toObj[k])
+	}
+	return ops
+}
+
+func sortedJSONKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeJSONPointer escapes a reference token of a JSON Pointer (RFC 6901).
+func escapeJSONPointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applyJSONPatch applies add, remove and replace operations of diffJSON to a generic value.
+func applyJSONPatch(t *testing.T, doc interface{}, ops []*patchOp) interface{} {
+	for _, op := range ops {
+		if len(op.Path) == 0 {
+			doc = op.Value
+			continue
+		}
+		tokens := strings.Split(op.Path, "/")[1:]
+		parent := doc
+		for _, token := range tokens[:len(tokens)-1] {
+			parent = parent.(map[string]interface{})[unescapeTestJSONPointer(token)]
+		}
+		obj := parent.(map[string]interface{})
+		key := unescapeTestJSONPointer(tokens[len(tokens)-1])
+		switch op.Op {
+		case patchOpAdd, patchOpReplace:
+			obj[key] = op.Value
+		case patchOpRemove:
+			delete(obj, key)
+		default:
+			t.Fatalf("unexpected patch op %s", op.Op)
+		}
+	}
+	return doc
+}
+
+// jsonModelVersion returns the version of a generic model, zero if it has none.
+func jsonModelVersion(v interface{}) int64 {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	version, _ := obj["version"].(float64)
+	return int64(version)
+}
+
+func unescapeTestJSONPointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+}
+
+func decodeTestJSON(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ops      int
+	}{
+		{`{"version": 1, "chain": null}`, `{"version": 1, "chain": null}`, 0},
+		{`{"version": 1, "chain": null}`, `{"version": 2, "chain": {"voters": {"a": ""}}}`, 2},
+		{`{"version": 2, "chain": {"voters": {"a": "", "b": "3"}}}`, `{"version": 3, "chain": {"voters": {"a": "5"}}}`, 3},
+		{`{"chain": {"result": {"scores": [1, 2]}}}`, `{"chain": {"result": {"scores": [1, 3]}}}`, 1},
+		{`{"a/b": 1, "c~d": 2}`, `{"a/b": 2}`, 2},
+		{`{"chain": {"name": "x"}}`, `{"chain": null}`, 1},
+		{`[1, 2]`, `{"version": 1}`, 1},
+	}
+	for _, test := range tests {
+		from, to := decodeTestJSON(t, test.from), decodeTestJSON(t, test.to)
+		ops := diffJSON(from, to)
+		if len(ops) != test.ops {
+			t.Fatalf("expected %d ops from %s to %s, got %d", test.ops, test.from, test.to, len(ops))
+		}
+
+		// Patches are sent over the wire, so they are applied after a round trip.
+		buf, err := json.Marshal(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received []*patchOp
+		if err := json.Unmarshal(buf, &received); err != nil {
+			t.Fatal(err)
+		}
+		if got := applyJSONPatch(t, decodeTestJSON(t, test.from), received); !reflect.DeepEqual(got, to) {
+			t.Fatalf("expected patch to turn %s into %s, got %v", test.from, test.to, got)
+		}
+	}
+}
+
+func TestSessionSocketPatches(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHandler.acceptChangeLogListener))
+	defer srv.Close()
+
+	voters := []*testerModel{voter1, voter2}
+	query := addVoters(t, voters)
+
+	conn := dialTestSocket(t, srv, voter2, "&protocol=2&sync")
+	defer conn.Close()
+
+	// Presence is replaced in the model as a client does, later patches apply to it.
+	var model interface{}
+	readPush := func() *socketMessage {
+		for {
+			msg := new(socketMessage)
+			if err := conn.ReadJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != socketMsgPresence {
+				return msg
+			}
+			if m, ok := model.(map[string]interface{}); ok {
+				m["presence"] = msg.Data
+			}
+		}
+	}
+	expectModel := func(model interface{}) {
+		r, err := http.NewRequest("GET", "/session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("authorization", signinUser(t, voter2))
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.sessionHandler).ServeHTTP(w, r)
+		want := decodeTestJSON(t, w.Body.String())
+		got, err := toJSONValue(model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected pushed model %v, got %v", want, got)
+		}
+	}
+
+	snapshot := readPush()
+	if snapshot.Type != socketMsgSession {
+		t.Fatalf("expected a snapshot first, got %+v", snapshot)
+	}
+	model = snapshot.Data
+	expectModel(model)
+
+	post := func(path string, user *testerModel, handler http.HandlerFunc) {
+		r, err := http.NewRequest("POST", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("authorization", signinUser(t, user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK && w.Code != http.StatusAccepted {
+			t.Fatalf("%s failed with %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	changes := []func(){
+		func() { post("/session/open?"+query, voter1, testHandler.sessionOpenHandler) },
+		func() { post("/session/vote?score=5", voter1, testHandler.sessionVoteHandler) },
+		func() { post("/session/vote?score=3", voter2, testHandler.sessionVoteHandler) },
+		func() { post("/session/close", voter1, testHandler.sessionCloseHandler) },
+	}
+	for i, change := range changes {
+		change()
+		msg := readPush()
+		if msg.Type != socketMsgPatch || msg.Base != jsonModelVersion(model) {
+			t.Fatalf("change %d: expected a patch against version %d, got %+v", i, jsonModelVersion(model), msg)
+		}
+		buf, _ := json.Marshal(msg.Data)
+		var ops []*patchOp
+		if err := json.Unmarshal(buf, &ops); err != nil {
+			t.Fatal(err)
+		}
+		model = applyJSONPatch(t, model, ops)
+		// The vote of voter1 stays masked for voter2 until everybody voted.
+		expectModel(model)
+	}
+}
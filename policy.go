@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+)
+
+const policyBucketName = "policy"
+
+const (
+	policyOpAdd    = "add"
+	policyOpRemove = "remove"
+)
+
+// Policies of the "policies" object are only editable in policy.csv,
+// so nobody can lock everyone out of the policy API at runtime.
+const policyManagementObj = "policies"
+
+// Policies of the "storage" object are only editable in policy.csv,
+// a storage may keep data of several teams.
+const storageManagementObj = "storage"
+
+type policyRule struct {
+	PType string   `json:"ptype"`
+	Rule  []string `json:"rule"`
+}
+
+func (r *policyRule) line() string {
+	return strings.Join(append([]string{r.PType}, r.Rule...), ", ")
+}
+
+func (r *policyRule) validate() error {
+	for _, v := range r.Rule {
+		if len(strings.TrimSpace(v)) == 0 || strings.Contains(v, ",") {
+			return newClientError("rule values must be non empty and must not contain commas")
+		}
+	}
+	switch r.PType {
+	case "p":
+		if len(r.Rule) != 4 {
+			return newClientError("policy rule must have sub, obj, act and eft")
+		}
+		if r.Rule[1] == policyManagementObj || r.Rule[1] == storageManagementObj {
+			return newClientError(r.Rule[1] + " rules can only be changed in the policy file")
+		}
+		if _, err := regexp.Compile(r.Rule[2]); err != nil {
+			return newClientError("policy act must be a valid regular expression")
+		}
+		if r.Rule[3] != "allow" && r.Rule[3] != "deny" {
+			return newClientError("policy eft must be allow or deny")
+		}
+	case "g":
+		if len(r.Rule) != 2 {
+			return newClientError("role rule must have user and role")
+		}
+	default:
+		return newClientError("ptype must be p or g")
+	}
+	return nil
+}
+
+type policyOverride struct {
+	policyRule
+	Op string `json:"op"`
+}
+
+// policyOverrideStore keeps team overrides of the policy file keyed by the rule line.
+type policyOverrideStore interface {
+	list() ([]*policyOverride, error)
+	put(o *policyOverride) error
+	delete(line string) error
+	// replace drops all overrides and stores the given ones.
+	replace(overrides []*policyOverride) error
+}
+
+// policyStore is a casbin adapter which keeps team overrides of the policy file.
+// Rules of the policy file are the base for every team, a team can add own rules
+// or remove base rules, removal of a base rule is stored as a tombstone.
+type policyStore struct {
+	store    policyOverrideStore
+	basePath string
+}
+
+func newPolicyStore(store policyOverrideStore, basePath string) *policyStore {
+	s := new(policyStore)
+	s.store = store
+	s.basePath = basePath
+	return s
+}
+
+// newPolicyEnforcer creates an enforcer of the model backed by the store. Auto save is
+// disabled, callers must persist changes through the store before applying them.
+func newPolicyEnforcer(modelPath string, store *policyStore) (*casbin.SyncedEnforcer, error) {
+	base, err := store.base()
+	if err != nil {
+		return nil, err
+	}
+	if len(base) == 0 {
+		return nil, fmt.Errorf("policy file %s has no rules", store.basePath)
+	}
+	e := casbin.NewSyncedEnforcer(modelPath, store)
+	e.EnableAutoSave(false)
+	return e, nil
+}
+
+func (s *policyStore) base() ([]string, error) {
+	f, err := os.Open(s.basePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := normalizePolicyLine(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func (s *policyStore) overrides() ([]*policyOverride, error) {
+	return s.store.list()
+}
+
+// LoadPolicy loads the policy file and applies team overrides on top of it.
+func (s *policyStore) LoadPolicy(m model.Model) error {
+	base, err := s.base()
+	if err != nil {
+		return err
+	}
+	overrides, err := s.overrides()
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, o := range overrides {
+		if o.Op == policyOpRemove {
+			removed[o.line()] = true
+		}
+	}
+	for _, line := range base {
+		if !removed[line] {
+			persist.LoadPolicyLine(line, m)
+		}
+	}
+	for _, o := range overrides {
+		if o.Op == policyOpAdd {
+			persist.LoadPolicyLine(o.line(), m)
+		}
+	}
+	return nil
+}
+
+// SavePolicy stores the difference between the model and the policy file.
+func (s *policyStore) SavePolicy(m model.Model) error {
+	base, err := s.base()
+	if err != nil {
+		return err
+	}
+	inBase := make(map[string]bool, len(base))
+	for _, line := range base {
+		inBase[line] = true
+	}
+
+	current := make(map[string]*policyRule)
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				r := &policyRule{PType: ptype, Rule: rule}
+				current[r.line()] = r
+			}
+		}
+	}
+
+	var overrides []*policyOverride
+	for line, r := range current {
+		if !inBase[line] {
+			overrides = append(overrides, &policyOverride{policyRule: *r, Op: policyOpAdd})
+		}
+	}
+	for _, line := range base {
+		if _, ok := current[line]; !ok {
+			overrides = append(overrides, &policyOverride{policyRule: *parsePolicyLine(line), Op: policyOpRemove})
+		}
+	}
+	return s.store.replace(overrides)
+}
+
+// AddPolicy stores a team rule or drops the tombstone of a base rule.
+func (s *policyStore) AddPolicy(sec string, ptype string, rule []string) error {
+	return s.change(&policyRule{PType: ptype, Rule: rule}, policyOpAdd)
+}
+
+// RemovePolicy drops a team rule or stores a tombstone of a base rule.
+func (s *policyStore) RemovePolicy(sec string, ptype string, rule []string) error {
+	return s.change(&policyRule{PType: ptype, Rule: rule}, policyOpRemove)
+}
+
+// RemoveFilteredPolicy is not supported.
+func (s *policyStore) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return errors.New("not implemented")
+}
+
+func (s *policyStore) change(r *policyRule, op string) error {
+	base, err := s.base()
+	if err != nil {
+		return err
+	}
+	line := r.line()
+	var inBase bool
+	for _, l := range base {
+		if l == line {
+			inBase = true
+			break
+		}
+	}
+
+	// Adding a base rule or removing a team rule only cancels the previous override.
+	if inBase == (op == policyOpAdd) {
+		return s.store.delete(line)
+	}
+	return s.store.put(&policyOverride{policyRule: *r, Op: op})
+}
+
+type boltPolicyOverrideStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltPolicyOverrideStore(db *bolt.DB, shard string) (*boltPolicyOverrideStore, error) {
+	s := new(boltPolicyOverrideStore)
+	s.db = db
+	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, policyBucketName))
+	if err := createBucket(s.db, s.bucket); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltPolicyOverrideStore) list() ([]*policyOverride, error) {
+	overrides := make([]*policyOverride, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, v []byte) error {
+			o := new(policyOverride)
+			if err := json.Unmarshal(v, o); err != nil {
+				return err
+			}
+			overrides = append(overrides, o)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+func (s *boltPolicyOverrideStore) put(o *policyOverride) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putPolicyOverride(tx.Bucket(s.bucket), o)
+	})
+}
+
+func (s *boltPolicyOverrideStore) delete(line string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(line))
+	})
+}
+
+func (s *boltPolicyOverrideStore) replace(overrides []*policyOverride) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(s.bucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket(s.bucket)
+		if err != nil {
+			return err
+		}
+		for _, o := range overrides {
+			if err := putPolicyOverride(b, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func putPolicyOverride(b *bolt.Bucket, o *policyOverride) error {
+	buf, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(o.line()), buf)
+}
+
+func parsePolicyLine(line string) *policyRule {
+	tokens := strings.Split(normalizePolicyLine(line), ", ")
+	return &policyRule{PType: tokens[0], Rule: tokens[1:]}
+}
+
+func normalizePolicyLine(line string) string {
+	tokens := strings.Split(strings.TrimSpace(line), ",")
+	for i := range tokens {
+		tokens[i] = strings.TrimSpace(tokens[i])
+	}
+	return strings.Join(tokens, ", ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyStoreOverrides(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	store, err := openBoltStorage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	workdir, _ := filepath.Abs(".")
+	newStore := func(shard string) *policyStore {
+		overrides, err := store.policies(shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newPolicyStore(overrides, filepath.Join(workdir, policyConfPath))
+	}
+	modelPath := filepath.Join(workdir, authConfPath)
+
+	a := newStore("a")
+	added := &policyRule{PType: "p", Rule: []string{"voter", "links", "add", "allow"}}
+	removed := &policyRule{PType: "p", Rule: []string{"voter", "session", "vote", "allow"}}
+	if err := a.change(added, policyOpAdd); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.change(removed, policyOpRemove); err != nil {
+		t.Fatal(err)
+	}
+
+	enf, err := newPolicyEnforcer(modelPath, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enf.Enforce("voter", "links", "add") {
+		t.Fatal("added rule must be loaded")
+	}
+	if enf.Enforce("voter", "session", "vote") {
+		t.Fatal("removed base rule must not be loaded")
+	}
+
+	other, err := newPolicyEnforcer(modelPath, newStore("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Enforce("voter", "links", "add") || !other.Enforce("voter", "session", "vote") {
+		t.Fatal("overrides of a team must not affect other teams")
+	}
+
+	// Restoring a base rule and dropping a team rule leaves no overrides.
+	if err := a.change(removed, policyOpAdd); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.change(added, policyOpRemove); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := a.overrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 0 {
+		t.Fatalf("expected no overrides, got %d", len(overrides))
+	}
+}
+
+func TestPolicyEndpoints(t *testing.T) {
+	change := func(path string, body string, user *testerModel, status int) {
+		r, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("authorization", signinUser(t, user))
+		w := httptest.NewRecorder()
+		if path == "/policies/add" {
+			http.HandlerFunc(testHandler.policiesAddHandler).ServeHTTP(w, r)
+		} else {
+			http.HandlerFunc(testHandler.policiesRemoveHandler).ServeHTTP(w, r)
+		}
+		assertStatus(t, w, status)
+	}
+
+	rule := `{"ptype":"p","rule":["voter","links","remove","allow"]}`
+	addVoter(t, voter1)
+	change("/policies/add", rule, voter1, http.StatusForbidden)
+	change("/policies/add", rule, master, http.StatusOK)
+	change("/policies/add", rule, master, http.StatusBadRequest)
+	if !testHandler.config.enforcer.Enforce("voter", "links", "remove") {
+		t.Fatal("added rule must be enforced")
+	}
+	change("/policies/remove", rule, master, http.StatusOK)
+	if testHandler.config.enforcer.Enforce("voter", "links", "remove") {
+		t.Fatal("removed rule must not be enforced")
+	}
+
+	change("/policies/add", `{"ptype":"p","rule":["voter","policies","add","allow"]}`, master, http.StatusBadRequest)
+	change("/policies/add", `{"ptype":"g","rule":["voter"]}`, master, http.StatusBadRequest)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const pollsBucketName = "polls"
+
+// pollRecord is a finished poll kept in the history of a team.
+type pollRecord struct {
+	ID      int            `json:"id"`
+	Time    time.Time      `json:"time"`
+	Name    string         `json:"name"`
+	Leader  string         `json:"leader"`
+	Votes   map[string]int `json:"votes"`
+	Average float64        `json:"average"`
+}
+
+// isOutOfBucket reports whether scores are spread too much to agree on, the
+// way the board decides it: scores take limit distinct values or more, or the
+// lowest and highest are limit or more apart in the sequence.
+func (rec *pollRecord) isOutOfBucket(seq []int, limit int) bool {
+	if limit <= 0 {
+		limit = defaultOutBucket
+	}
+	scores := make([]int, 0, len(rec.Votes))
+	for _, score := range rec.Votes {
+		scores = append(scores, score)
+	}
+	if len(scores) == 0 {
+		return false
+	}
+	sort.Ints(scores)
+
+	distinct, prev := 0, scores[0]
+	for _, score := range scores {
+		if score != prev {
+			distinct++
+		}
+		if distinct >= limit {
+			return true
+		}
+		prev = score
+	}
+	if len(seq) > 1 {
+		return indexOfInt(seq, scores[len(scores)-1])-indexOfInt(seq, scores[0]) >= limit
+	}
+	return false
+}
+
+// fibSequence returns the distinct numbers of the first size fibonacci
+// numbers, the sequence the board offers to vote with.
+func fibSequence(size int) []int {
+	if size > 20 {
+		size = 20
+	}
+	seq := make([]int, 0, size)
+	for i := 0; i < size; i++ {
+		switch i {
+		case 0:
+			seq = append(seq, 0)
+		case 1:
+			seq = append(seq, 1)
+		default:
+			seq = append(seq, seq[i-2]+seq[i-1])
+		}
+	}
+	distinct := make([]int, 0, len(seq))
+	for i, n := range seq {
+		if i == 0 || n != seq[i-1] {
+			distinct = append(distinct, n)
+		}
+	}
+	return distinct
+}
+
+func indexOfInt(seq []int, n int) int {
+	for i, v := range seq {
+		if v == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// pollStore keeps the history of finished polls.
+type pollStore interface {
+	// append assigns an id to the record.
+	append(rec *pollRecord) error
+	// each calls fn for every record newest first until fn returns false.
+	each(fn func(rec *pollRecord) bool) error
+	// purge deletes at most limit records which are older than the time, or are
+	// beyond the newest keep of the remaining records, and returns how many were
+	// deleted. A zero time or keep disables its rule.
+	purge(olderThan time.Time, keep int, limit int) (int, error)
+}
+
+type boltPollStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltPollStore(db *bolt.DB, shard string) (*boltPollStore, error) {
+	s := new(boltPollStore)
+	s.db = db
+	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, pollsBucketName))
+	if err := createBucket(s.db, s.bucket); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltPollStore) append(rec *pollRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		rec.ID = int(id)
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(rec.ID), buf)
+	})
+}
+
+func (s *boltPollStore) each(fn func(rec *pollRecord) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			rec := new(pollRecord)
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if !fn(rec) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltPollStore) purge(olderThan time.Time, keep int, limit int) (int, error) {
+	var deleted int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		var expired [][]byte
+		var kept int
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(expired) < limit; k, v = c.Prev() {
+			rec := new(pollRecord)
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if (!olderThan.IsZero() && rec.Time.Before(olderThan)) || (keep > 0 && kept >= keep) {
+				expired = append(expired, append([]byte(nil), k...))
+			} else {
+				kept++
+			}
+		}
+		// Keys are deleted after iterating, deleting under a cursor skips keys.
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// teamFleet runs teams and applies changes of teams.json to them. Teams whose
+// settings didn't change, or changed only in preferences and the leader idle
+// period, keep running with their open sessions.
+type teamFleet struct {
+	// newOpts returns options of a team server without storage and signals.
+	newOpts func(t *team) *teamServerOpts
+	// open returns the storage of a team, release closes it once the team is gone.
+	open    func(t *team) (storage, error)
+	release func(t *team)
+	// tenants shares one listener among teams, teams listen on own ports if nil.
+	tenants *tenantRouter
+
+	mux   sync.Mutex
+	teams map[string]*fleetTeam
+	// handlers are handlers of running teams, probes read them without the
+	// lock apply holds while teams drain.
+	handlers atomic.Value
+}
+
+type fleetTeam struct {
+	team     *team
+	handler  *endpoints
+	sigstop  chan bool
+	finished chan bool
+}
+
+func newTeamFleet(newOpts func(t *team) *teamServerOpts, tenants *tenantRouter) *teamFleet {
+	f := new(teamFleet)
+	f.newOpts = newOpts
+	f.tenants = tenants
+	f.teams = make(map[string]*fleetTeam)
+	f.publish()
+	return f
+}
+
+// apply starts added teams, stops removed ones and restarts or reconfigures
+// changed ones.
+func (f *teamFleet) apply(teams map[string]*team) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	// Removed teams go first, so their ports and hosts are free for the rest.
+	for name, ft := range f.teams {
+		if t, ok := teams[name]; !ok || t.Suspended || teamNeedsRestart(ft.team, t) {
+			f.stop(ft, shutdownDrainPeriod)
+			logs.info("team stopped", "team", name)
+		}
+	}
+	for _, name := range sortedTeamNames(teams) {
+		t := teams[name]
+		if t.Suspended {
+			continue
+		}
+		if ft, ok := f.teams[name]; ok {
+			if !reflect.DeepEqual(ft.team, t) {
+				ft.handler.reconfigure(t)
+				ft.team = t
+				logs.info("team reconfigured", "team", name)
+			}
+			continue
+		}
+		if err := f.start(t); err != nil {
+			logs.error("team failed to start", "team", name, "err", err)
+			continue
+		}
+		if f.tenants != nil {
+			logs.info("team started", "team", name, "path", f.tenants.basePath(t))
+		} else {
+			logs.info("team started", "team", name, "port", t.Port)
+		}
+	}
+}
+
+// start serves the team, a team which fails to start is undone, its storage
+// is released and its session stopped.
+func (f *teamFleet) start(t *team) error {
+	if f.tenants == nil && t.Port == 0 {
+		return fmt.Errorf("team has no port, set it or serve teams with -listen")
+	}
+	store, err := f.open(t)
+	if err != nil {
+		return err
+	}
+	opts := f.newOpts(t)
+	opts.store = store
+	if f.tenants != nil {
+		opts.basePath = f.tenants.basePath(t)
+	}
+	ft := &fleetTeam{team: t, sigstop: make(chan bool), finished: make(chan bool, 1)}
+	opts.sigstop, opts.sigshutdown = ft.sigstop, ft.finished
+
+	h, handler, err := newTeamHandler(opts)
+	if err != nil {
+		f.release(t)
+		return err
+	}
+	ft.handler = h
+	if f.tenants == nil {
+		go serve("team - "+t.Name, opts.addr, handler, opts.sigstop, opts.sigshutdown)
+		f.teams[t.Name] = ft
+		f.publish()
+		return nil
+	}
+
+	if err := f.tenants.add(t, handler); err != nil {
+		close(ft.sigstop)
+		h.close()
+		f.release(t)
+		return err
+	}
+	ft.finished <- true
+	f.teams[t.Name] = ft
+	f.publish()
+	return nil
+}
+
+// stop closes boards of the team waiting for them up to the timeout, then
+// stops the team. The team is gone for probes first, a restart of one team
+// doesn't fail probes of the process.
+func (f *teamFleet) stop(ft *fleetTeam, timeout time.Duration) {
+	delete(f.teams, ft.team.Name)
+	f.publish()
+	if f.tenants != nil {
+		f.tenants.remove(ft.team)
+	}
+	close(ft.sigstop)
+	ft.handler.shutdown(timeout)
+	<-ft.finished
+	f.release(ft.team)
+}
+
+// handler returns the handler of the running team, nil if it isn't running.
+func (f *teamFleet) handler(name string) *endpoints {
+	return f.handlers.Load().(map[string]*endpoints)[name]
+}
+
+// publish keeps handlers of running teams for probes, it is called under the
+// lock whenever teams change.
+func (f *teamFleet) publish() {
+	handlers := make(map[string]*endpoints, len(f.teams))
+	for name, ft := range f.teams {
+		handlers[name] = ft.handler
+	}
+	f.handlers.Store(handlers)
+}
+
+// stopAll stops every team on shutdown, boards of all teams are closed at
+// once so the drain period bounds the whole shutdown.
+func (f *teamFleet) stopAll() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	deadline := time.Now().Add(shutdownDrainPeriod)
+	for _, ft := range f.teams {
+		ft.handler.drainer.close()
+	}
+	for _, ft := range f.teams {
+		f.stop(ft, time.Until(deadline))
+	}
+}
+
+// running returns names of running teams.
+func (f *teamFleet) running() map[string]bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	names := make(map[string]bool, len(f.teams))
+	for name := range f.teams {
+		names[name] = true
+	}
+	return names
+}
+
+// teamNeedsRestart reports whether settings besides preferences and the
+// leader idle period differ, those are applied to the running team.
+func teamNeedsRestart(old *team, t *team) bool {
+	a, b := *old, *t
+	a.Preference, b.Preference = nil, nil
+	a.LeaderMaxIdlePeriod, b.LeaderMaxIdlePeriod = "", ""
+	a.LeaderMaxIdleDuration, b.LeaderMaxIdleDuration = 0, 0
+	a.RenamedFrom, b.RenamedFrom = "", ""
+	return !reflect.DeepEqual(a, b)
+}
+
+// watchTeams signals a reload on SIGHUP and, with a positive interval, when
+// the modification time of the file changes.
+func watchTeams(path string, interval time.Duration, stop <-chan bool) <-chan bool {
+	reload := make(chan bool, 1)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	go func() {
+		defer signal.Stop(sighup)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		last := modTime()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sighup:
+			case <-tick:
+				if modTime().Equal(last) {
+					continue
+				}
+			}
+			last = modTime()
+			select {
+			case reload <- true:
+			default:
+			}
+		}
+	}()
+	return reload
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFleet(t *testing.T, dir string) (*teamFleet, *tenantRouter, storage) {
+	s, err := openBoltStorage(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := newTenantRouter(routeByPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleet := newTeamFleet(func(team *team) *teamServerOpts {
+		return &teamServerOpts{
+			authConf:   authConfPath,
+			policyConf: policyConfPath,
+			team:       team,
+			templates:  templateDir,
+			staticDir:  staticDir,
+			origins:    newOriginPolicy(nil),
+		}
+	}, tenants)
+	fleet.open = func(team *team) (storage, error) { return s, nil }
+	fleet.release = func(team *team) {}
+	return fleet, tenants, s
+}
+
+func writeTestTeams(t *testing.T, path string, data string) map[string]*team {
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	teams, err := readTeams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return teams
+}
+
+func TestTeamFleetReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teams.json")
+
+	fleet, tenants, s := newTestFleet(t, dir)
+	defer s.close()
+	defer fleet.stopAll()
+	records, err := s.teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := newTeamCatalog(path, records, fleet, new(clock))
+	if err := catalog.load(writeTestTeams(t, path, `{"alpha": {"port": 8001}, "beta": {"port": 8002}}`)); err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/t/alpha/session"), http.StatusUnauthorized)
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/t/beta/session"), http.StatusUnauthorized)
+	alpha := fleet.teams["alpha"].handler
+
+	// Preferences are applied to the running team, removed teams are stopped.
+	writeTestTeams(t, path, `{"alpha": {"port": 8001, "leader_max_idle_period": "2h", "preference": {"max_fib": 7}}}`)
+	if err := catalog.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if fleet.teams["alpha"].handler != alpha {
+		t.Fatal("expected alpha to keep running")
+	}
+	if alpha.team().Preference.MaxFib != 7 || alpha.leader.maxLife != 2*time.Hour || alpha.team().getLeaderDuration() != 2*time.Hour {
+		t.Fatalf("expected alpha to be reconfigured, got %+v", alpha.team())
+	}
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/t/beta/session"), http.StatusNotFound)
+
+	// Other settings restart the team.
+	writeTestTeams(t, path, `{"alpha": {"port": 8003, "preference": {"max_fib": 7}}}`)
+	if err := catalog.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if fleet.teams["alpha"].handler == alpha {
+		t.Fatal("expected alpha to be restarted")
+	}
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/t/alpha/session"), http.StatusUnauthorized)
+
+	// An invalid file keeps the running teams.
+	if err := ioutil.WriteFile(path, []byte(`{"alpha": {"port": 80}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.reload(); err == nil {
+		t.Fatal("expected invalid teams to be rejected")
+	}
+	if fleet.teams["alpha"].team.Port != 8003 {
+		t.Fatal("expected the running teams to be kept")
+	}
+}
+
+func TestTeamFleetStartFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fleet, tenants, s := newTestFleet(t, dir)
+	defer s.close()
+	defer fleet.stopAll()
+	newOpts := fleet.newOpts
+	fleet.newOpts = func(team *team) *teamServerOpts {
+		opts := newOpts(team)
+		opts.policyConf = filepath.Join(dir, "missing.csv")
+		return opts
+	}
+	var released int
+	fleet.release = func(team *team) { released++ }
+
+	// A team which fails to start is logged and undone, the rest keep running.
+	fleet.apply(writeTestTeams(t, filepath.Join(dir, "teams.json"), `{"alpha": {"port": 8001}}`))
+	if len(fleet.running()) != 0 || released != 1 {
+		t.Fatalf("expected the storage of the failed team to be released, running %v", fleet.running())
+	}
+	assertStatus(t, serveTestTenant(tenants, "localhost", "/t/alpha/session"), http.StatusNotFound)
+}
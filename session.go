@@ -3,11 +3,10 @@ package main
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -17,8 +16,9 @@ const (
 )
 
 type sessionModel struct {
-	Version int64           `json:"version"`
-	Chain   *pollChainModel `json:"chain"`
+	Version  int64           `json:"version"`
+	Chain    *pollChainModel `json:"chain"`
+	Presence *presenceModel  `json:"presence,omitempty"`
 }
 
 type pollChainModel struct {
@@ -36,7 +36,9 @@ type pollResult struct {
 }
 
 type modelMasker struct {
-	sm   *sessionModel
+	sm *sessionModel
+	// prev is the version the change was made to, zero for a snapshot.
+	prev int64
 	noop bool
 }
 
@@ -44,6 +46,7 @@ func (msk *modelMasker) slurpModel(s *session) {
 	sm := new(sessionModel)
 	sm.Version = s.version
 
+	var voters []string
 	// Copy current poll.
 	if s.getChain() != nil {
 		chain := s.getChain()
@@ -69,18 +72,21 @@ func (msk *modelMasker) slurpModel(s *session) {
 		if chain.current().isReady() {
 			sm.Chain.Result = chain.current().compute()
 		}
+		for voter := range poll.voters {
+			voters = append(voters, voter)
+		}
+	}
+	if s.presence != nil {
+		sm.Presence = s.presence.model(voters)
 	}
 	msk.sm = sm
 }
 
-func (msk *modelMasker) write(c *websocket.Conn, p *principal) error {
-	return c.WriteJSON(msk.get(p))
-}
-
 func (msk *modelMasker) get(p *principal) interface{} {
 	src := msk.sm
 	dist := new(sessionModel)
 	dist.Version = src.Version
+	dist.Presence = src.Presence
 	if src.Chain != nil {
 		dist.Chain = new(pollChainModel)
 		dist.Chain.Name = src.Chain.Name
@@ -179,6 +185,24 @@ func (c *pollChain) next() {
 	c.touch()
 }
 
+// record returns the current poll for the history unless somebody hasn't voted yet.
+func (c *pollChain) record(now time.Time) *pollRecord {
+	if c.poll == nil || !c.poll.isReady() {
+		return nil
+	}
+	votes := make(map[string]int, len(c.poll.voters))
+	for voter, score := range c.poll.voters {
+		votes[voter] = score
+	}
+	return &pollRecord{
+		Time:    now,
+		Name:    c.poll.name,
+		Leader:  c.leader.name,
+		Votes:   votes,
+		Average: c.poll.compute().Average,
+	}
+}
+
 func (c *pollChain) touch() {
 	if c.owner != nil {
 		c.owner.touch()
@@ -267,6 +291,8 @@ func (p *poll) compute() *pollResult {
 			r.Scores = append(r.Scores, score)
 		}
 	}
+	// Voters are a map, sorted scores keep a patch of an unchanged result empty.
+	sort.Ints(r.Scores)
 	r.Average = math.Round(float64(sum)/float64(voted)*100) / 100
 	return r
 }
@@ -274,11 +300,18 @@ func (p *poll) compute() *pollResult {
 type session struct {
 	version int64
 	chain   *pollChain
+	// presence is nil unless the team shows presence.
+	presence *online
+	clock    *clock
+	// active is the time of the last change made by voters or the leader.
+	active time.Time
 }
 
 func newSession(c *clock) *session {
 	s := new(session)
-	s.version = c.Now().Unix()
+	s.clock = c
+	s.active = c.Now()
+	s.version = s.active.Unix()
 	return s
 }
 
@@ -305,13 +338,21 @@ func (s *session) setChain(ch *pollChain) {
 
 func (s *session) touch() {
 	s.version = s.version + 1
+	s.active = s.clock.Now()
 }
 
 type sessionTopic struct {
 	clients  map[*client]bool
 	entering chan *client
 	leaving  chan *client
-	changes  chan *modelMasker
+	changes  chan msgWriter
+	// stop ends the broadcaster, clients entering or leaving later are ignored.
+	stop     chan bool
+	stopOnce sync.Once
+	// pings are received by the broadcaster to tell it is running.
+	pings chan bool
+	// history is a ring of recent changes oldest first, clients resume from it.
+	history []*modelMasker
 
 	mux     sync.RWMutex
 	session *session
@@ -323,7 +364,9 @@ func newSessionTopic(s *session, size int) *sessionTopic {
 	t.clients = make(map[*client]bool)
 	t.entering = make(chan *client)
 	t.leaving = make(chan *client)
-	t.changes = make(chan *modelMasker, size)
+	t.changes = make(chan msgWriter, size)
+	t.stop = make(chan bool)
+	t.pings = make(chan bool)
 	go t.broadcaster()
 	return t
 }
@@ -334,15 +377,42 @@ func (t *sessionTopic) sync() msgWriter {
 }
 
 func (t *sessionTopic) enter(c *client) {
-	t.entering <- c
+	select {
+	case t.entering <- c:
+	case <-t.stop:
+	}
 }
 
 func (t *sessionTopic) leave(c *client) {
-	t.leaving <- c
+	select {
+	case t.leaving <- c:
+	case <-t.stop:
+	}
+}
+
+func (t *sessionTopic) notify(m msgWriter) {
+	select {
+	case t.changes <- m:
+	case <-t.stop:
+	}
 }
 
-func (t *sessionTopic) notify(m *modelMasker) {
-	t.changes <- m
+// alive reports whether the broadcaster takes a ping within the timeout.
+func (t *sessionTopic) alive(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case t.pings <- true:
+		return true
+	case <-t.stop:
+	case <-timer.C:
+	}
+	return false
+}
+
+// close stops the broadcaster.
+func (t *sessionTopic) close() {
+	t.stopOnce.Do(func() { close(t.stop) })
 }
 
 func (t *sessionTopic) broadcaster() {
@@ -350,13 +420,18 @@ func (t *sessionTopic) broadcaster() {
 		select {
 		case m := <-t.changes:
 			for c := range t.clients {
-				c.msg <- m
+				if !c.deliver(m) {
+					delete(t.clients, c)
+					c.drop()
+				}
 			}
 		case c := <-t.entering:
 			t.clients[c] = true
 		case c := <-t.leaving:
 			delete(t.clients, c)
-			close(c.msg)
+		case <-t.pings:
+		case <-t.stop:
+			return
 		}
 	}
 }
@@ -390,13 +465,60 @@ func (t *sessionTopic) write(writer func(s *session, m *modelMasker) error) (*mo
 	defer t.mux.Unlock()
 
 	old := t.session.getVersion()
-	msk := &modelMasker{}
+	msk := &modelMasker{prev: old}
 	if err := writer(t.session, msk); err != nil {
 		return nil, err
 	}
 	msk.slurpModel(t.session)
 	if old != t.session.getVersion() {
+		t.remember(msk)
 		t.notify(msk)
 	}
 	return msk, nil
 }
+
+// notifyPresence pushes the current presence without making a new version, so
+// comings and goings don't push changes of the session out of the history.
+func (t *sessionTopic) notifyPresence() {
+	// The lock keeps changes of presence in order with each other and with changes.
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	msk := new(modelMasker)
+	msk.slurpModel(t.session)
+	t.notify(&presenceChange{msk: msk})
+}
+
+func (t *sessionTopic) remember(m *modelMasker) {
+	if len(t.history) == sessionHistorySize {
+		copy(t.history, t.history[1:])
+		t.history = t.history[:len(t.history)-1]
+	}
+	t.history = append(t.history, m)
+}
+
+// since returns the model of the version and changes made after it oldest first.
+// The model is nil if only changes after it are kept. It returns false if the
+// version is too old to be in the history.
+func (t *sessionTopic) since(version int64) (*modelMasker, []*modelMasker, bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	if len(t.history) > 0 && t.history[0].prev == version {
+		changes := make([]*modelMasker, len(t.history))
+		copy(changes, t.history)
+		return nil, changes, true
+	}
+	for i, m := range t.history {
+		if m.sm.Version == version {
+			changes := make([]*modelMasker, len(t.history)-i-1)
+			copy(changes, t.history[i+1:])
+			return m, changes, true
+		}
+	}
+	// Nothing changed since the session was created.
+	if version == t.session.getVersion() {
+		base := new(modelMasker)
+		base.slurpModel(t.session)
+		return base, nil, true
+	}
+	return nil, nil, false
+}
@@ -5,6 +5,27 @@ import (
 	"testing"
 )
 
+func TestPollOutOfBucket(t *testing.T) {
+	seq := fibSequence(14)
+	if len(seq) != 13 || seq[1] != 1 || seq[2] != 2 || seq[12] != 233 {
+		t.Fatalf("expected distinct fibonacci numbers, got %v", seq)
+	}
+	for _, c := range []struct {
+		votes map[string]int
+		out   bool
+	}{
+		{map[string]int{voterA: 3, voterB: 3}, false},
+		{map[string]int{voterA: 2, voterB: 5}, false},
+		{map[string]int{voterA: 2, voterB: 8}, true},
+		{map[string]int{voterA: 2, voterB: 3, voterC: 5}, false},
+		{map[string]int{voterA: 1, voterB: 3, voterC: 5, "vd": 2}, true},
+	} {
+		if out := (&pollRecord{Votes: c.votes}).isOutOfBucket(seq, 3); out != c.out {
+			t.Fatalf("expected %v out of bucket to be %v", c.votes, c.out)
+		}
+	}
+}
+
 var (
 	voterA = "va"
 	voterB = "vb"
@@ -174,6 +195,29 @@ func TestNextPoll(t *testing.T) {
 	checkReadyResult(t, p2, 4, 2)
 }
 
+func TestPollRecord(t *testing.T) {
+	c := newPollChain(&leader{name: "leader", clock: testClock}, []string{voterA, voterB})
+
+	c.current().accept(voterA, 3)
+	if rec := c.record(testClock.Now()); rec != nil {
+		t.Fatalf("unfinished poll must not be recorded, got %v", rec)
+	}
+
+	c.current().accept(voterB, 5)
+	rec := c.record(testClock.Now())
+	if rec == nil {
+		t.Fatal("expected record of the finished poll")
+	}
+	if rec.Leader != "leader" || rec.Average != 4 || rec.Votes[voterA] != 3 || rec.Votes[voterB] != 5 {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+
+	c.current().accept(voterA, 8)
+	if rec.Votes[voterA] != 3 {
+		t.Fatal("record must not change with the poll")
+	}
+}
+
 func TestVersionChange(t *testing.T) {
 	s := newSession(testClock)
 	s.setChain(newPollChain(&leader{name: "leader", clock: testClock}, []string{voterA, voterB}))
@@ -243,3 +287,49 @@ func checkReadyResult(t *testing.T, p *poll, average float64, scores int) {
 		t.Fatal("Ready result must have all scores")
 	}
 }
+
+func TestSessionTopicHistory(t *testing.T) {
+	topic := newSessionTopic(newSession(testClock), sessionHistorySize+10)
+	touch := func() int64 {
+		m, err := topic.write(func(s *session, m *modelMasker) error {
+			s.touch()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.sm.Version
+	}
+
+	initial := topic.sync().(*modelMasker).sm.Version
+	if base, changes, ok := topic.since(initial); !ok || len(changes) != 0 || base.sm.Version != initial {
+		t.Fatalf("expected a new session to resume from its version, got %v %v", ok, changes)
+	}
+
+	first := touch()
+	second := touch()
+	base, changes, ok := topic.since(initial)
+	if !ok || len(changes) != 2 || changes[0].sm.Version != first || changes[1].sm.Version != second {
+		t.Fatalf("expected changes %d and %d, got %v", first, second, changes)
+	}
+	if base != nil || changes[0].prev != initial {
+		t.Fatalf("expected changes to follow version %d", initial)
+	}
+	if base, changes, ok := topic.since(first); !ok || len(changes) != 1 || base.sm.Version != first {
+		t.Fatalf("expected change %d after %d, got %v", second, first, changes)
+	}
+	if _, _, ok := topic.since(second + 1); ok {
+		t.Fatal("expected an unknown version to need a snapshot")
+	}
+
+	// The ring is bounded, too old versions need a snapshot.
+	for i := 0; i < sessionHistorySize; i++ {
+		touch()
+	}
+	if _, _, ok := topic.since(first); ok {
+		t.Fatalf("expected version %d to be dropped from the history", first)
+	}
+	if _, changes, ok := topic.since(second); !ok || len(changes) != sessionHistorySize {
+		t.Fatalf("expected %d changes since version %d, got %d", sessionHistorySize, second, len(changes))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketCloseRestarting is the reason of the close frame sent to open boards
+// on shutdown, clients reconnect once the server is back.
+const socketCloseRestarting = "server restarting"
+
+// drainer closes long lived connections on shutdown. Websockets are hijacked
+// and event streams never finish, so http.Server.Shutdown doesn't close them.
+type drainer struct {
+	mux     sync.Mutex
+	closing chan bool
+	closed  bool
+	conns   sync.WaitGroup
+}
+
+func newDrainer() *drainer {
+	d := new(drainer)
+	d.closing = make(chan bool)
+	return d
+}
+
+// enter registers a connection, it returns false once the server is shutting
+// down and the connection must be refused.
+func (d *drainer) enter() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.closed {
+		return false
+	}
+	d.conns.Add(1)
+	return true
+}
+
+func (d *drainer) leave() {
+	d.conns.Done()
+}
+
+// accepting returns errShuttingDown once connections are told to close.
+func (d *drainer) accepting() error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.closed {
+		return errShuttingDown
+	}
+	return nil
+}
+
+// done is closed when connections have to close.
+func (d *drainer) done() <-chan bool {
+	return d.closing
+}
+
+// close tells connections to close without waiting for them.
+func (d *drainer) close() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.closing)
+	}
+}
+
+// drain closes connections and waits for them up to the timeout, it reports
+// whether all of them have closed.
+func (d *drainer) drain(timeout time.Duration) bool {
+	d.close()
+	drained := make(chan bool)
+	go func() {
+		d.conns.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// closeSocketRestarting tells the client the server is going away for a while.
+func closeSocketRestarting(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseServiceRestart, socketCloseRestarting), time.Now().Add(socketWriteWait))
+}
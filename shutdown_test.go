@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitGoroutines fails unless the number of goroutines drops to n soon.
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("expected %d goroutines, got %d\n%s", n, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTeamShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teams.json")
+
+	fleet, tenants, s := newTestFleet(t, dir)
+	defer s.close()
+	defer fleet.stopAll()
+	records, err := s.teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := newTeamCatalog(path, records, fleet, new(clock))
+	teams := writeTestTeams(t, path, `{"alpha": {"presence": {}}}`)
+	baseline := runtime.NumGoroutine()
+	if err := catalog.load(teams); err != nil {
+		t.Fatal(err)
+	}
+
+	h := fleet.teams["alpha"].handler
+	u := newUser("va", roleVoter)
+	u.setPasscode("va")
+	if err := h.userStore.create(u); err != nil {
+		t.Fatal(err)
+	}
+	token, err := h.auth.login("va", "va", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.sessionTopic.write(func(s *session, m *modelMasker) error {
+		h.leader.name = "va"
+		s.setChain(newPollChain(h.leader, []string{"va", "vb"}))
+		s.getChain().current().accept("va", 5)
+		return nil
+	})
+
+	srv := httptest.NewServer(tenants)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/t/alpha/session/changes?authorization=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open boards are told why they are closed.
+	fleet.stopAll()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) || !strings.Contains(err.Error(), socketCloseRestarting) {
+		t.Fatalf("expected a close frame of the restart, got %v", err)
+	}
+	conn.Close()
+	srv.Close()
+	waitGoroutines(t, baseline)
+
+	// The open session is back after the restart.
+	if err := catalog.load(teams); err != nil {
+		t.Fatal(err)
+	}
+	sm := fleet.teams["alpha"].handler.summary()
+	if !sm.Open || sm.Leader != "va" || sm.Voters != 2 || sm.Voted != 1 {
+		t.Fatalf("expected the session to be restored, got %+v", sm)
+	}
+}
+
+func TestDrainer(t *testing.T) {
+	d := newDrainer()
+	if !d.enter() {
+		t.Fatal("expected a connection to be accepted")
+	}
+	if d.drain(10 * time.Millisecond) {
+		t.Fatal("expected the drain to time out while a connection is open")
+	}
+	select {
+	case <-d.done():
+	default:
+		t.Fatal("expected connections to be told to close")
+	}
+	if d.enter() {
+		t.Fatal("expected connections to be refused during shutdown")
+	}
+	d.leave()
+	if !d.drain(time.Second) {
+		t.Fatal("expected the drain to finish once connections are closed")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	snapshotBucketName = "snapshot"
+	snapshotKey        = "session"
+)
+
+// sessionSnapshot is the open session of a team kept over a restart.
+type sessionSnapshot struct {
+	Time    time.Time      `json:"time"`
+	Version int64          `json:"version"`
+	Active  time.Time      `json:"active"`
+	Leader  string         `json:"leader"`
+	Voters  []string       `json:"voters"`
+	Counter int            `json:"counter"`
+	Poll    string         `json:"poll"`
+	Votes   map[string]int `json:"votes"`
+}
+
+// snapshotStore keeps the last snapshot of the session of a team.
+type snapshotStore interface {
+	// save replaces the snapshot, nil deletes it.
+	save(snap *sessionSnapshot) error
+	// load returns nil if there is no snapshot.
+	load() (*sessionSnapshot, error)
+}
+
+// snapshot returns the open session, nil if it is closed.
+func (s *session) snapshot(now time.Time) *sessionSnapshot {
+	c := s.getChain()
+	if c == nil {
+		return nil
+	}
+	votes := make(map[string]int, len(c.poll.voters))
+	for voter, score := range c.poll.voters {
+		votes[voter] = score
+	}
+	return &sessionSnapshot{
+		Time:    now,
+		Version: s.version,
+		Active:  s.active,
+		Leader:  c.leader.name,
+		Voters:  c.getVoters(),
+		Counter: c.counter,
+		Poll:    c.poll.name,
+		Votes:   votes,
+	}
+}
+
+// restore opens the session of the snapshot led by l. Versions keep growing,
+// so clients of the previous run don't mistake the session for one they have.
+func (s *session) restore(snap *sessionSnapshot, l *leader) {
+	l.name = snap.Leader
+	l.alive()
+	c := &pollChain{leader: l, voters: snap.Voters, counter: snap.Counter}
+	c.poll = &poll{owner: c, name: snap.Poll, voters: snap.Votes}
+	s.setChain(c)
+	if snap.Version >= s.version {
+		s.version = snap.Version + 1
+	}
+	s.active = snap.Active
+}
+
+type boltSnapshotStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltSnapshotStore(db *bolt.DB, shard string) (*boltSnapshotStore, error) {
+	s := new(boltSnapshotStore)
+	s.db = db
+	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, snapshotBucketName))
+	if err := createBucket(s.db, s.bucket); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltSnapshotStore) save(snap *sessionSnapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if snap == nil {
+			return b.Delete([]byte(snapshotKey))
+		}
+		buf, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(snapshotKey), buf)
+	})
+}
+
+func (s *boltSnapshotStore) load() (*sessionSnapshot, error) {
+	var snap *sessionSnapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.bucket).Get([]byte(snapshotKey))
+		if v == nil {
+			return nil
+		}
+		snap = new(sessionSnapshot)
+		return json.Unmarshal(v, snap)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version 0 is the original protocol, the server only pushes bare models.
+// Version 1 wraps pushes into socketMessage and accepts socketCommand.
+// Version 2 pushes changes as JSON Patches against the previous push.
+const (
+	socketProtocolLegacy   = 0
+	socketProtocolCommands = 1
+	socketProtocolPatch    = 2
+	socketProtocolVersion  = socketProtocolPatch
+)
+
+const socketReadLimit = 4096
+
+const (
+	socketMsgSession  = "session"
+	socketMsgPatch    = "patch"
+	socketMsgPresence = "presence"
+	socketMsgReply    = "reply"
+)
+
+const (
+	socketCmdPing   = "ping"
+	socketCmdVote   = "vote"
+	socketCmdCancel = "cancel"
+	socketCmdReset  = "reset"
+	socketCmdUnmask = "unmask"
+	socketCmdClose  = "close"
+)
+
+// socketCommand is a request of a client, the reply carries the same id.
+type socketCommand struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	Score   *int   `json:"score,omitempty"`
+}
+
+// socketMessage is either a pushed change of the topic or a reply to a command.
+// A patch applies to the previously pushed model, which has the base version.
+type socketMessage struct {
+	Type    string       `json:"type"`
+	ID      string       `json:"id,omitempty"`
+	Command string       `json:"command,omitempty"`
+	Base    int64        `json:"base,omitempty"`
+	Data    interface{}  `json:"data,omitempty"`
+	Error   *socketError `json:"error,omitempty"`
+}
+
+// socketError carries the status and message an HTTP handler would respond with.
+type socketError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func newSocketError(err error) *socketError {
+	return &socketError{Status: apiErrorStatus(err), Message: err.Error()}
+}
+
+// socketDispatcher executes a command of the principal and returns the reply.
+type socketDispatcher func(r *http.Request, p *principal, cmd *socketCommand) *socketMessage
+
+// socketProtocol returns the protocol version requested by the protocol query key.
+func socketProtocol(r *http.Request) (int, error) {
+	v := queryKeySingular(r, "protocol")
+	if len(v) == 0 {
+		return socketProtocolLegacy, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < socketProtocolLegacy || version > socketProtocolVersion {
+		return 0, newClientError(fmt.Sprintf("unsupported protocol version, wanted at most %d", socketProtocolVersion))
+	}
+	return version, nil
+}
+
+// socketPusher writes messages of a topic as seen by the principal in the
+// protocol of the client.
+type socketPusher struct {
+	conn     *websocket.Conn
+	p        *principal
+	protocol int
+
+	// last is the generic value of the previous push, patches are computed against it.
+	last        interface{}
+	lastVersion int64
+}
+
+// reply writes a reply to a command of the client.
+func (s *socketPusher) reply(msg *socketMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return s.conn.WriteJSON(msg)
+}
+
+// resume continues pushes after the version the client already has. Without
+// the base model of the version the next change is pushed as a snapshot.
+func (s *socketPusher) resume(version int64, base *modelMasker) error {
+	s.lastVersion = version
+	if s.protocol != socketProtocolPatch || base == nil {
+		return nil
+	}
+	value, err := toJSONValue(base.get(s.p))
+	if err != nil {
+		return err
+	}
+	s.last = value
+	return nil
+}
+
+func (s *socketPusher) push(msg msgWriter) error {
+	if c, ok := msg.(*presenceChange); ok {
+		return s.pushPresence(c)
+	}
+	m, versioned := msg.(*modelMasker)
+	// A change queued before the snapshot or the replay is already pushed.
+	if versioned && m.sm.Version <= s.lastVersion {
+		return nil
+	}
+
+	// A stalled connection fails instead of blocking the loop of the client.
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	model := msg.get(s.p)
+	var out interface{}
+	switch s.protocol {
+	case socketProtocolLegacy:
+		out = model
+	case socketProtocolCommands:
+		out = &socketMessage{Type: socketMsgSession, Data: model}
+	default:
+		value, err := toJSONValue(model)
+		if err != nil {
+			return err
+		}
+		// A client which missed a change gets a snapshot instead of a patch.
+		if versioned && s.last != nil && m.prev == s.lastVersion {
+			out = &socketMessage{Type: socketMsgPatch, Base: s.lastVersion, Data: diffJSON(s.last, value)}
+		} else {
+			out = &socketMessage{Type: socketMsgSession, Data: value}
+		}
+		s.last = value
+	}
+
+	if err := s.conn.WriteJSON(out); err != nil {
+		return err
+	}
+	if versioned {
+		s.lastVersion = m.sm.Version
+	}
+	return nil
+}
+
+// pushPresence writes a change of presence. Clients of the legacy protocol only
+// take sessions, they get the current one again with the same version.
+func (s *socketPusher) pushPresence(c *presenceChange) error {
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	switch s.protocol {
+	case socketProtocolLegacy:
+		// A newer session is already pushed.
+		if c.msk.sm.Version < s.lastVersion {
+			return nil
+		}
+		return s.conn.WriteJSON(c.msk.get(s.p))
+	case socketProtocolPatch:
+		// The client replaces its presence, the next patch applies to the same.
+		if last, ok := s.last.(map[string]interface{}); ok {
+			value, err := toJSONValue(c.get(s.p))
+			if err != nil {
+				return err
+			}
+			last["presence"] = value
+		}
+	}
+	return s.conn.WriteJSON(&socketMessage{Type: socketMsgPresence, Data: c.get(s.p)})
+}
+
+func (h *endpoints) dispatchSessionCommand(r *http.Request, p *principal, cmd *socketCommand) *socketMessage {
+	reply := &socketMessage{Type: socketMsgReply, ID: cmd.ID, Command: cmd.Command}
+	// Any command, a ping included, tells the user is still at the board.
+	h.seen(p)
+
+	var model *modelMasker
+	var err error
+	switch cmd.Command {
+	case socketCmdPing:
+		return reply
+	case socketCmdVote:
+		if cmd.Score == nil || *cmd.Score < voterSkipScore {
+			err = newClientError("score is missing or invalid")
+		} else {
+			model, err = h.vote(r, p, *cmd.Score)
+		}
+	case socketCmdCancel:
+		model, err = h.vote(r, p, StatusNotVoted)
+	case socketCmdReset:
+		model, err = h.resetSession(r, p)
+	case socketCmdUnmask:
+		model, err = h.unmaskSession(r, p)
+	case socketCmdClose:
+		model, err = h.closeSession(r, p)
+	default:
+		err = newClientError(fmt.Sprintf("unknown command %s", cmd.Command))
+	}
+
+	if err != nil {
+		reply.Error = newSocketError(err)
+		return reply
+	}
+	reply.Data = model.get(p)
+	return reply
+}
+
+// readSocketCommands dispatches commands until the connection fails, replies are
+// sent to the writer of the connection. Commands of the legacy protocol are dropped.
+func readSocketCommands(conn *websocket.Conn, version int, dispatch func(cmd *socketCommand) *socketMessage, replies chan<- *socketMessage, done <-chan bool) {
+	defer close(replies)
+
+	conn.SetReadLimit(socketReadLimit)
+	for {
+		cmd := new(socketCommand)
+		err := conn.ReadJSON(cmd)
+		if err != nil && !isSocketDecodeError(err) {
+			return
+		}
+		if version == socketProtocolLegacy {
+			continue
+		}
+
+		var reply *socketMessage
+		if err != nil {
+			reply = &socketMessage{Type: socketMsgReply, Error: newSocketError(newClientError("command is malformed"))}
+		} else {
+			reply = dispatch(cmd)
+		}
+		select {
+		case replies <- reply:
+		case <-done:
+			return
+		}
+	}
+}
+
+// isSocketDecodeError tells a malformed message apart from a failed connection.
+func isSocketDecodeError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialTestSocket(t *testing.T, srv *httptest.Server, user *testerModel, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/session/changes?authorization=" + signinUser(t, user) + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readTestReply skips pushed changes until the reply of the command.
+func readTestReply(t *testing.T, conn *websocket.Conn, id string) *socketMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg := new(socketMessage)
+		if err := conn.ReadJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == socketMsgReply && msg.ID == id {
+			return msg
+		}
+		if msg.Type != socketMsgSession && msg.Type != socketMsgPresence {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+}
+
+func sendTestCommand(t *testing.T, conn *websocket.Conn, cmd *socketCommand) *socketMessage {
+	if err := conn.WriteJSON(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return readTestReply(t, conn, cmd.ID)
+}
+
+func TestSessionSocketCommands(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHandler.acceptChangeLogListener))
+	defer srv.Close()
+
+	voters := []*testerModel{voter1, voter2}
+	r, err := http.NewRequest("POST", "/session/open?"+addVoters(t, voters), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("authorization", signinUser(t, voter1))
+	w := httptest.NewRecorder()
+	http.HandlerFunc(testHandler.sessionOpenHandler).ServeHTTP(w, r)
+	assertStatus(t, w, http.StatusOK)
+
+	leader := dialTestSocket(t, srv, voter1, "&protocol=1")
+	defer leader.Close()
+	other := dialTestSocket(t, srv, voter2, "&protocol=1")
+	defer other.Close()
+
+	if reply := sendTestCommand(t, leader, &socketCommand{ID: "1", Command: socketCmdPing}); reply.Error != nil {
+		t.Fatalf("expected pong, got %+v", reply.Error)
+	}
+
+	score := 3
+	reply := sendTestCommand(t, leader, &socketCommand{ID: "2", Command: socketCmdVote, Score: &score})
+	if reply.Error != nil {
+		t.Fatalf("expected vote to be accepted, got %+v", reply.Error)
+	}
+	buf, _ := json.Marshal(reply.Data)
+	var m clientModel
+	if err := json.Unmarshal(buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	assertOpenSession2(t, &m, 0, voters, []string{"3", ""}, false)
+
+	reply = sendTestCommand(t, leader, &socketCommand{ID: "3", Command: socketCmdCancel})
+	if reply.Error != nil {
+		t.Fatalf("expected vote to be canceled, got %+v", reply.Error)
+	}
+	assertOpenSession(t, master, 0, voters, []string{"", ""}, false)
+
+	// Errors carry the status the HTTP handlers respond with.
+	reply = sendTestCommand(t, other, &socketCommand{ID: "4", Command: socketCmdUnmask})
+	if reply.Error == nil || reply.Error.Status != http.StatusForbidden {
+		t.Fatalf("expected unmask by non leader to be forbidden, got %+v", reply.Error)
+	}
+	reply = sendTestCommand(t, other, &socketCommand{ID: "5", Command: socketCmdReset})
+	if reply.Error == nil || reply.Error.Status != http.StatusBadRequest {
+		t.Fatalf("expected reset by non leader to be rejected, got %+v", reply.Error)
+	}
+	reply = sendTestCommand(t, other, &socketCommand{ID: "6", Command: "launch"})
+	if reply.Error == nil || reply.Error.Status != http.StatusBadRequest {
+		t.Fatalf("expected unknown command to be rejected, got %+v", reply.Error)
+	}
+	if err := other.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if reply = readTestReply(t, other, ""); reply.Error == nil {
+		t.Fatal("expected malformed command to be rejected")
+	}
+
+	if reply = sendTestCommand(t, leader, &socketCommand{ID: "7", Command: socketCmdUnmask}); reply.Error != nil {
+		t.Fatalf("expected unmask by leader, got %+v", reply.Error)
+	}
+	if reply = sendTestCommand(t, leader, &socketCommand{ID: "8", Command: socketCmdClose}); reply.Error != nil {
+		t.Fatalf("expected close by leader, got %+v", reply.Error)
+	}
+	if m := fetchSession(t, master); m.Chain != nil {
+		t.Fatalf("expected session to be closed, got %+v", m.Chain)
+	}
+}
+
+func TestSessionSocketLegacyProtocol(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHandler.acceptChangeLogListener))
+	defer srv.Close()
+
+	conn := dialTestSocket(t, srv, master, "&sync")
+	defer conn.Close()
+
+	// Old clients get bare models and their messages are ignored.
+	if err := conn.WriteJSON(&socketCommand{ID: "1", Command: socketCmdPing}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m map[string]interface{}
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["version"]; !ok {
+		t.Fatalf("expected a bare session model, got %v", m)
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/session/changes?protocol=99&authorization=" + signinUser(t, master)
+	if _, res, err := websocket.DefaultDialer.Dial(url, nil); err == nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected unsupported protocol to be rejected")
+	}
+}
+
+func TestSessionSocketResume(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHandler.acceptChangeLogListener))
+	defer srv.Close()
+
+	since := touchTestSession(t)
+	missed := []int64{touchTestSession(t), touchTestSession(t)}
+
+	readVersion := func(conn *websocket.Conn) int64 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var m clientModel
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Version
+	}
+
+	conn := dialTestSocket(t, srv, master, "&since="+strconv.FormatInt(since, 10))
+	for _, version := range missed {
+		if got := readVersion(conn); got != version {
+			t.Fatalf("expected missed change %d, got %d", version, got)
+		}
+	}
+	conn.Close()
+
+	// A client behind the history gets a snapshot.
+	conn = dialTestSocket(t, srv, master, "&since=1")
+	defer conn.Close()
+	if got, current := readVersion(conn), fetchSession(t, master).Version; got != current {
+		t.Fatalf("expected snapshot of version %d, got %d", current, got)
+	}
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	// Pure Go driver, the binary is built with CGO disabled.
+	_ "modernc.org/sqlite"
+)
+
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000000"
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		team TEXT NOT NULL,
+		name TEXT NOT NULL,
+		role TEXT NOT NULL,
+		passcode TEXT NOT NULL, -- salted hash, see passcodeHash
+		PRIMARY KEY (team, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		team TEXT NOT NULL,
+		uri TEXT NOT NULL,
+		display_name TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		team TEXT NOT NULL,
+		time TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		result TEXT NOT NULL,
+		error TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_team_id ON audit (team, id)`,
+	`CREATE TABLE IF NOT EXISTS invites (
+		token TEXT PRIMARY KEY,
+		team TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		max_uses INTEGER NOT NULL,
+		uses INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS polls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		team TEXT NOT NULL,
+		time TEXT NOT NULL,
+		name TEXT NOT NULL,
+		leader TEXT NOT NULL,
+		votes TEXT NOT NULL,
+		average REAL NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS polls_team_id ON polls (team, id)`,
+	`CREATE TABLE IF NOT EXISTS policy_overrides (
+		team TEXT NOT NULL,
+		line TEXT NOT NULL,
+		ptype TEXT NOT NULL,
+		rule TEXT NOT NULL,
+		op TEXT NOT NULL,
+		PRIMARY KEY (team, line)
+	)`,
+	`CREATE TABLE IF NOT EXISTS teams (
+		name TEXT PRIMARY KEY,
+		record TEXT NOT NULL -- JSON of teamRecord
+	)`,
+	`CREATE TABLE IF NOT EXISTS snapshots (
+		team TEXT PRIMARY KEY,
+		snapshot TEXT NOT NULL -- JSON of sessionSnapshot
+	)`,
+}
+
+// sqliteStorage keeps all teams in shared tables with a team column,
+// so the data can be queried with standard SQL tools.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func openSqliteStorage(path string) (*sqliteStorage, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(1000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writers, which is what sqlite does anyway.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+func (s *sqliteStorage) users(shard string, maxUsers int) (userStore, error) {
+	if maxUsers <= 0 {
+		maxUsers = defaultMaxUsers
+	}
+	return &sqliteUserStore{db: s.db, team: shard, maxUsers: maxUsers}, nil
+}
+
+func (s *sqliteStorage) links(shard string, maxLinks int) (linkStore, error) {
+	if maxLinks <= 0 {
+		maxLinks = defaultMaxLinks
+	}
+	return &sqliteLinkStore{db: s.db, team: shard, maxLinks: maxLinks}, nil
+}
+
+func (s *sqliteStorage) audit(shard string, c *clock) (auditStore, error) {
+	return &sqliteAuditStore{db: s.db, team: shard, clock: c}, nil
+}
+
+func (s *sqliteStorage) invites(shard string, c *clock) (inviteStore, error) {
+	return &sqliteInviteStore{db: s.db, team: shard, clock: c}, nil
+}
+
+func (s *sqliteStorage) policies(shard string) (policyOverrideStore, error) {
+	return &sqlitePolicyOverrideStore{db: s.db, team: shard}, nil
+}
+
+func (s *sqliteStorage) polls(shard string) (pollStore, error) {
+	return &sqlitePollStore{db: s.db, team: shard}, nil
+}
+
+func (s *sqliteStorage) snapshots(shard string) (snapshotStore, error) {
+	return &sqliteSnapshotStore{db: s.db, team: shard}, nil
+}
+
+func (s *sqliteStorage) teams() (teamConfigStore, error) {
+	return &sqliteTeamConfigStore{db: s.db}, nil
+}
+
+// sqliteUsageColumns are summed up to estimate the size of team rows.
+var sqliteUsageColumns = []struct {
+	bucket, table, columns string
+}{
+	{usersBucketName, "users", "name || role || passcode"},
+	{linksBucketName, "links", "uri || display_name"},
+	{auditBucketName, "audit", "time || actor || action || target || ip || result || error"},
+	{invitesBucketName, "invites", "token || role || created_by || created_at || expires_at"},
+	{policyBucketName, "policy_overrides", "line || ptype || rule || op"},
+	{pollsBucketName, "polls", "time || name || leader || votes"},
+	{snapshotBucketName, "snapshots", "snapshot"},
+}
+
+func (s *sqliteStorage) usage(shard string) ([]*bucketUsage, error) {
+	var usage []*bucketUsage
+	for _, u := range sqliteUsageColumns {
+		bu := &bucketUsage{Name: u.bucket}
+		err := s.db.QueryRow(`SELECT count(*), coalesce(sum(length(`+u.columns+`)), 0) FROM `+u.table+` WHERE team = ?`, shard).
+			Scan(&bu.Records, &bu.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, bu)
+	}
+	return usage, nil
+}
+
+func (s *sqliteStorage) replaceTeam(shard string, users []*user, links []*link, overrides []*policyOverride) error {
+	return sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		for _, q := range []string{
+			`DELETE FROM users WHERE team = ? AND role != '` + string(roleMaster) + `'`,
+			`DELETE FROM links WHERE team = ?`,
+			`DELETE FROM policy_overrides WHERE team = ?`,
+		} {
+			if _, err := tx.Exec(q, shard); err != nil {
+				return err
+			}
+		}
+		for _, u := range users {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO users (team, name, role, passcode) VALUES (?, ?, ?, ?)`,
+				shard, u.Name, string(u.Role), u.PasscodeHash); err != nil {
+				return err
+			}
+		}
+		for _, l := range links {
+			res, err := tx.Exec(`INSERT INTO links (team, uri, display_name) VALUES (?, ?, ?)`, shard, l.URI, l.DisplayName)
+			if err != nil {
+				return err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			l.ID = int(id)
+		}
+		for _, o := range overrides {
+			if err := putSqlitePolicyOverride(tx, shard, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqliteStorage) close() error {
+	return s.db.Close()
+}
+
+// sqliteUpdate runs fn in a transaction, which is committed unless fn fails.
+func sqliteUpdate(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func formatSqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func parseSqliteTime(v string) (time.Time, error) {
+	return time.Parse(sqliteTimeFormat, v)
+}
+
+type sqliteUserStore struct {
+	db       *sql.DB
+	team     string
+	maxUsers int
+}
+
+func (s *sqliteUserStore) getMaxUsers() int {
+	return s.maxUsers
+}
+
+func (s *sqliteUserStore) create(u *user) error {
+	return s.put(u, true)
+}
+
+func (s *sqliteUserStore) add(u *user) error {
+	return s.put(u, false)
+}
+
+func (s *sqliteUserStore) put(u *user, replace bool) error {
+	return sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		var n, exists int
+		if err := tx.QueryRow(`SELECT count(*), coalesce(sum(name = ?), 0) FROM users WHERE team = ?`, u.Name, s.team).Scan(&n, &exists); err != nil {
+			return err
+		}
+		if exists != 0 && !replace {
+			return errUsernameTaken
+		}
+		// Replacing an existing user doesn't count against the limit.
+		if exists == 0 && s.maxUsers <= n {
+			return newClientError(fmt.Sprintf("maximum %d allowed users is reached", s.maxUsers))
+		}
+		_, err := tx.Exec(`INSERT OR REPLACE INTO users (team, name, role, passcode) VALUES (?, ?, ?, ?)`,
+			s.team, u.Name, string(u.Role), u.PasscodeHash)
+		return err
+	})
+}
+
+func (s *sqliteUserStore) get(username string) (*user, error) {
+	u := new(user)
+	err := s.db.QueryRow(`SELECT name, role, passcode FROM users WHERE team = ? AND name = ?`, s.team, username).
+		Scan(&u.Name, &u.Role, &u.PasscodeHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *sqliteUserStore) rehash(username string, old string, hash string) error {
+	_, err := s.db.Exec(`UPDATE users SET passcode = ? WHERE team = ? AND name = ? AND passcode = ?`, hash, s.team, username, old)
+	return err
+}
+
+func (s *sqliteUserStore) delete(username string) error {
+	_, err := s.db.Exec(`DELETE FROM users WHERE team = ? AND name = ?`, s.team, username)
+	return err
+}
+
+func (s *sqliteUserStore) list() ([]*user, error) {
+	rows, err := s.db.Query(`SELECT name, role, passcode FROM users WHERE team = ? ORDER BY name`, s.team)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*user, 0)
+	for rows.Next() {
+		u := new(user)
+		if err := rows.Scan(&u.Name, &u.Role, &u.PasscodeHash); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+type sqliteLinkStore struct {
+	db       *sql.DB
+	team     string
+	maxLinks int
+}
+
+func (s *sqliteLinkStore) getMaxLinks() int {
+	return s.maxLinks
+}
+
+func (s *sqliteLinkStore) create(l *link) error {
+	return sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT count(*) FROM links WHERE team = ?`, s.team).Scan(&n); err != nil {
+			return err
+		}
+		if s.maxLinks <= n {
+			return newClientError(fmt.Sprintf("maximum %d allowed links is reached", s.maxLinks))
+		}
+		res, err := tx.Exec(`INSERT INTO links (team, uri, display_name) VALUES (?, ?, ?)`, s.team, l.URI, l.DisplayName)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		l.ID = int(id)
+		return nil
+	})
+}
+
+func (s *sqliteLinkStore) deleteByID(id int) error {
+	_, err := s.db.Exec(`DELETE FROM links WHERE team = ? AND id = ?`, s.team, id)
+	return err
+}
+
+func (s *sqliteLinkStore) list() ([]*link, error) {
+	rows, err := s.db.Query(`SELECT id, uri, display_name FROM links WHERE team = ? ORDER BY id`, s.team)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]*link, 0)
+	for rows.Next() {
+		l := new(link)
+		if err := rows.Scan(&l.ID, &l.URI, &l.DisplayName); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+type sqliteAuditStore struct {
+	db    *sql.DB
+	team  string
+	clock *clock
+}
+
+func (s *sqliteAuditStore) append(e *auditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = s.clock.Now()
+	}
+	res, err := s.db.Exec(`INSERT INTO audit (team, time, actor, action, target, ip, result, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.team, formatSqliteTime(e.Time), e.Actor, e.Action, e.Target, e.IP, e.Result, e.Error)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	e.ID = int(id)
+	return nil
+}
+
+func (s *sqliteAuditStore) list(f *auditFilter) ([]*auditEntry, error) {
+	return listAuditEntries(s, f)
+}
+
+func (s *sqliteAuditStore) each(f *auditFilter, fn func(e *auditEntry) bool) error {
+	where, args := []string{"team = ?"}, []interface{}{s.team}
+	if len(f.Actor) > 0 {
+		where, args = append(where, "actor = ?"), append(args, f.Actor)
+	}
+	if len(f.Action) > 0 {
+		where, args = append(where, "substr(action, 1, length(?)) = ?"), append(args, f.Action, f.Action)
+	}
+	if len(f.Result) > 0 {
+		where, args = append(where, "result = ?"), append(args, f.Result)
+	}
+	if !f.Since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, formatSqliteTime(f.Since))
+	}
+	if !f.Until.IsZero() {
+		where, args = append(where, "time < ?"), append(args, formatSqliteTime(f.Until))
+	}
+	if f.Before > 0 {
+		where, args = append(where, "id < ?"), append(args, f.Before)
+	}
+
+	rows, err := s.db.Query(`SELECT id, time, actor, action, target, ip, result, error FROM audit
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := new(auditEntry)
+		var t string
+		if err := rows.Scan(&e.ID, &t, &e.Actor, &e.Action, &e.Target, &e.IP, &e.Result, &e.Error); err != nil {
+			return err
+		}
+		if e.Time, err = parseSqliteTime(t); err != nil {
+			return err
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+type sqliteInviteStore struct {
+	db    *sql.DB
+	team  string
+	clock *clock
+}
+
+const sqliteInviteColumns = `token, role, created_by, created_at, expires_at, max_uses, uses`
+
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSqliteInvite(row sqliteScanner) (*invite, error) {
+	i := new(invite)
+	var createdAt, expiresAt string
+	err := row.Scan(&i.Token, &i.Role, &i.CreatedBy, &createdAt, &expiresAt, &i.MaxUses, &i.Uses)
+	if err != nil {
+		return nil, err
+	}
+	if i.CreatedAt, err = parseSqliteTime(createdAt); err != nil {
+		return nil, err
+	}
+	if i.ExpiresAt, err = parseSqliteTime(expiresAt); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *sqliteInviteStore) create(r role, createdBy string, ttl time.Duration, maxUses int) (*invite, error) {
+	now := s.clock.Now()
+	i, err := newInvite(r, createdBy, ttl, maxUses, now)
+	if err != nil {
+		return nil, err
+	}
+	err = sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		// Expired invites are dropped whenever a new one is created.
+		_, err := tx.Exec(`DELETE FROM invites WHERE team = ? AND (expires_at <= ? OR (max_uses > 0 AND uses >= max_uses))`,
+			s.team, formatSqliteTime(now))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO invites (team, `+sqliteInviteColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			s.team, i.Token, string(i.Role), i.CreatedBy, formatSqliteTime(i.CreatedAt), formatSqliteTime(i.ExpiresAt), i.MaxUses, i.Uses)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *sqliteInviteStore) get(token string) (*invite, error) {
+	i, err := scanSqliteInvite(s.db.QueryRow(`SELECT `+sqliteInviteColumns+` FROM invites WHERE team = ? AND token = ?`, s.team, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !i.isValid(s.clock.Now()) {
+		return nil, nil
+	}
+	return i, nil
+}
+
+func (s *sqliteInviteStore) use(token string, join func(i *invite) error) error {
+	var used *invite
+	err := sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		var err error
+		used, err = scanSqliteInvite(tx.QueryRow(`SELECT `+sqliteInviteColumns+` FROM invites WHERE team = ? AND token = ?`, s.team, token))
+		if err == sql.ErrNoRows {
+			return errInviteInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if !used.isValid(s.clock.Now()) {
+			return errInviteInvalid
+		}
+		used.Uses++
+		_, err = tx.Exec(`UPDATE invites SET uses = uses + 1 WHERE team = ? AND token = ?`, s.team, token)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := join(used); err != nil {
+		s.db.Exec(`UPDATE invites SET uses = uses - 1 WHERE team = ? AND token = ?`, s.team, token)
+		return err
+	}
+	return nil
+}
+
+func (s *sqliteInviteStore) delete(token string) error {
+	_, err := s.db.Exec(`DELETE FROM invites WHERE team = ? AND token = ?`, s.team, token)
+	return err
+}
+
+func (s *sqliteInviteStore) list() ([]*invite, error) {
+	rows, err := s.db.Query(`SELECT `+sqliteInviteColumns+` FROM invites WHERE team = ? ORDER BY created_at`, s.team)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := s.clock.Now()
+	invites := make([]*invite, 0)
+	for rows.Next() {
+		i, err := scanSqliteInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		if i.isValid(now) {
+			invites = append(invites, i)
+		}
+	}
+	return invites, rows.Err()
+}
+
+type sqlitePollStore struct {
+	db   *sql.DB
+	team string
+}
+
+func (s *sqlitePollStore) append(rec *pollRecord) error {
+	votes, err := json.Marshal(rec.Votes)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO polls (team, time, name, leader, votes, average) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.team, formatSqliteTime(rec.Time), rec.Name, rec.Leader, string(votes), rec.Average)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rec.ID = int(id)
+	return nil
+}
+
+func (s *sqlitePollStore) each(fn func(rec *pollRecord) bool) error {
+	rows, err := s.db.Query(`SELECT id, time, name, leader, votes, average FROM polls WHERE team = ? ORDER BY id DESC`, s.team)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec := new(pollRecord)
+		var t, votes string
+		if err := rows.Scan(&rec.ID, &t, &rec.Name, &rec.Leader, &votes, &rec.Average); err != nil {
+			return err
+		}
+		if rec.Time, err = parseSqliteTime(t); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(votes), &rec.Votes); err != nil {
+			return err
+		}
+		if !fn(rec) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlitePollStore) purge(olderThan time.Time, keep int, limit int) (int, error) {
+	if keep <= 0 {
+		// A negative limit means no limit to sqlite.
+		keep = -1
+	}
+	t := formatSqliteTime(olderThan)
+	res, err := s.db.Exec(`DELETE FROM polls WHERE id IN (
+		SELECT id FROM polls WHERE team = ? AND (time < ? OR id NOT IN (
+			SELECT id FROM polls WHERE team = ? AND time >= ? ORDER BY id DESC LIMIT ?))
+		ORDER BY id LIMIT ?)`, s.team, t, s.team, t, keep, limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+type sqlitePolicyOverrideStore struct {
+	db   *sql.DB
+	team string
+}
+
+func (s *sqlitePolicyOverrideStore) list() ([]*policyOverride, error) {
+	rows, err := s.db.Query(`SELECT ptype, rule, op FROM policy_overrides WHERE team = ? ORDER BY line`, s.team)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := make([]*policyOverride, 0)
+	for rows.Next() {
+		o := new(policyOverride)
+		var rule string
+		if err := rows.Scan(&o.PType, &rule, &o.Op); err != nil {
+			return nil, err
+		}
+		o.Rule = strings.Split(rule, ",")
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+func (s *sqlitePolicyOverrideStore) put(o *policyOverride) error {
+	return putSqlitePolicyOverride(s.db, s.team, o)
+}
+
+func (s *sqlitePolicyOverrideStore) delete(line string) error {
+	_, err := s.db.Exec(`DELETE FROM policy_overrides WHERE team = ? AND line = ?`, s.team, line)
+	return err
+}
+
+func (s *sqlitePolicyOverrideStore) replace(overrides []*policyOverride) error {
+	return sqliteUpdate(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM policy_overrides WHERE team = ?`, s.team); err != nil {
+			return err
+		}
+		for _, o := range overrides {
+			if err := putSqlitePolicyOverride(tx, s.team, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type sqliteExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func putSqlitePolicyOverride(db sqliteExecer, team string, o *policyOverride) error {
+	// Rule values never contain commas, see policyRule.validate.
+	_, err := db.Exec(`INSERT OR REPLACE INTO policy_overrides (team, line, ptype, rule, op) VALUES (?, ?, ?, ?, ?)`,
+		team, o.line(), o.PType, strings.Join(o.Rule, ","), o.Op)
+	return err
+}
+
+type sqliteTeamConfigStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteTeamConfigStore) list() ([]*teamRecord, error) {
+	rows, err := s.db.Query(`SELECT record FROM teams ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*teamRecord, 0)
+	for rows.Next() {
+		var buf string
+		if err := rows.Scan(&buf); err != nil {
+			return nil, err
+		}
+		rec := new(teamRecord)
+		if err := json.Unmarshal([]byte(buf), rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteTeamConfigStore) put(rec *teamRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO teams (name, record) VALUES (?, ?)`, rec.Name, string(buf))
+	return err
+}
+
+type sqliteSnapshotStore struct {
+	db   *sql.DB
+	team string
+}
+
+func (s *sqliteSnapshotStore) save(snap *sessionSnapshot) error {
+	if snap == nil {
+		_, err := s.db.Exec(`DELETE FROM snapshots WHERE team = ?`, s.team)
+		return err
+	}
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO snapshots (team, snapshot) VALUES (?, ?)`, s.team, string(buf))
+	return err
+}
+
+func (s *sqliteSnapshotStore) load() (*sessionSnapshot, error) {
+	var buf string
+	err := s.db.QueryRow(`SELECT snapshot FROM snapshots WHERE team = ?`, s.team).Scan(&buf)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snap := new(sessionSnapshot)
+	if err := json.Unmarshal([]byte(buf), snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
@@ -0,0 +1,141 @@
+toastr.options.closeDuration = 200;
+toastr.options.timeOut = 4000;
+
+var adminKey = 'admin' + BasePath;
+
+var adminApi = {
+  auth(name, passcode, success, error) {
+    var q = jQuery.param({ name, passcode }, true);
+    $.post(`/admin/auth?${q}`).done(success).fail(api._failHandler(error));
+  },
+
+  listTeams(success, error) {
+    $.ajax('/admin/teams').done(success).fail(api._failHandler(error));
+  },
+
+  saveTeam(team, success, error) {
+    $.post('/admin/teams/save', JSON.stringify(team)).done(success).fail(api._failHandler(error));
+  },
+
+  changeTeam(action, name, success, error) {
+    var q = jQuery.param({ name }, true);
+    $.post(`/admin/teams/${action}?${q}`).done(success).fail(api._failHandler(error));
+  }
+};
+
+var AdminPage = {
+  tpl: {
+    Teams: Handlebars.compile(`
+      <h6 class="mb-3">Teams <small class="float-right">{{teams.length}} teams</small></h6>
+      <ul class="list-group">
+        {{#each teams}}
+        <li class="list-group-item clearfix">
+          <a href="#" class="edit-team-btn list-item-txt float-left" data-name="{{this.name}}">{{this.name}}</a>
+          <small class="ml-2 text-muted">{{#if this.port}}port {{this.port}}{{/if}} {{this.host}} from {{this.source}}</small>
+          <span class="float-right">
+            {{#if this.suspended}}
+            <button class="team-action-btn btn btn-sm btn-outline-success" data-action="resume" data-name="{{this.name}}">Resume</button>
+            {{else}}
+            <span class="badge {{#if this.running}}badge-success{{else}}badge-warning{{/if}}">{{#if this.running}}running{{else}}stopped{{/if}}</span>
+            <button class="team-action-btn btn btn-sm btn-outline-secondary" data-action="suspend" data-name="{{this.name}}">Suspend</button>
+            {{/if}}
+            <button class="team-action-btn btn btn-sm btn-outline-danger" data-action="remove" data-name="{{this.name}}">Remove</button>
+          </span>
+        </li>
+        {{else}}
+        <li class="list-group-item clearfix">
+          <span class="list-item-txt font-italic text-center">There are no teams</span>
+        </li>
+        {{/each}}
+      </ul>
+    `)
+  },
+
+  init() {
+    this.teams = [];
+    this.login = $('#AdminLogin');
+    this.editor = $('#TeamEditor');
+    this.container = $('#TeamsContainer');
+    this.inputTeam = $('#InputTeam');
+
+    api.defaultErrorHandler = (res) => {
+      if (res.status == 401) {
+        this.logout();
+      }
+      toastr.error(res.error.error);
+    };
+
+    $('#AdminLoginBtn').on('click', () => {
+      var name = $('#InputAdminName').val() || '';
+      var passcode = $('#InputAdminPasscode').val() || '';
+      adminApi.auth(name, passcode, (data, statusText, res) => {
+        window.localStorage.setItem(adminKey, JSON.stringify({ name, token: res.getResponseHeader('authorization') }));
+        this.start();
+      });
+    });
+    $('#LogoutBtn').on('click', () => this.logout());
+
+    $('#SaveTeamBtn').on('click', () => {
+      var team;
+      try {
+        team = JSON.parse(this.inputTeam.val());
+      } catch (e) {
+        this.inputTeam.addClass('is-invalid');
+        return;
+      }
+      this.inputTeam.removeClass('is-invalid');
+      adminApi.saveTeam(team, () => {
+        toastr.success(`Team ${team.name} is saved`);
+        this.refresh();
+      });
+    });
+
+    this.container.on('click', '.team-action-btn', (event) => {
+      var target = $(event.target).closest('.team-action-btn');
+      var action = target.data('action'), name = target.data('name');
+      if (action == 'remove' && !window.confirm(`Remove team ${name}? Its data is kept.`)) {
+        return;
+      }
+      adminApi.changeTeam(action, name, () => this.refresh());
+    });
+
+    this.container.on('click', '.edit-team-btn', (event) => {
+      event.preventDefault();
+      var name = $(event.target).data('name');
+      var team = Object.assign({}, this.teams.find(t => t.name == name));
+      delete team.source;
+      delete team.running;
+      this.inputTeam.val(JSON.stringify(team, null, 2));
+    });
+
+    this.start();
+  },
+
+  start() {
+    var admin = JSON.parse(window.localStorage.getItem(adminKey) || 'null');
+    if (!admin) {
+      this.login.removeClass('d-none');
+      return;
+    }
+    $.ajaxSetup({ headers: { 'authorization': admin.token } });
+    $('#LogoutBtn').text('Logout ' + admin.name).removeClass('d-none');
+    this.login.addClass('d-none');
+    this.editor.removeClass('d-none');
+    this.container.removeClass('d-none');
+    this.refresh();
+  },
+
+  logout() {
+    window.localStorage.removeItem(adminKey);
+    window.location.reload();
+  },
+
+  refresh() {
+    adminApi.listTeams((teams) => {
+      this.teams = teams;
+      this.container.html(this.tpl.Teams({ teams }));
+    });
+  }
+};
+
+$(() => AdminPage.init());
@@ -1,13 +1,13 @@
 function logout() {
-  window.localStorage.removeItem('user');
-  window.location = '/ui/login';
+  window.localStorage.removeItem(userKey);
+  window.location = BasePath + '/ui/login';
 }
 
-var userData = window.localStorage.getItem('user');
+var userData = window.localStorage.getItem(userKey);
 if (!userData) {
   logout();
 }
 
 var user = JSON.parse(userData);  
-$("#LogoutBtn").text('Logout ' + user.name).removeClass('d-none');
+$("#LogoutBtn").text('Logout ' + user.name).removeClass('d-none').on('click', logout);
 $.ajaxSetup({ headers: { 'authorization': user.token } });
\ No newline at end of file
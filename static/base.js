@@ -302,6 +302,21 @@ var _ = (function(){
     };
 })();
 
+// Path prefix of the team when teams share a listener, e.g. /t/alpha.
+var BasePath = (document.querySelector('meta[name="base-path"]') || {}).content || '';
+var userKey = 'user' + BasePath;
+$.ajaxPrefilter((options) => {
+  if (options.url.charAt(0) === '/' && options.url.charAt(1) !== '/') {
+    options.url = BasePath + options.url;
+  }
+});
+
+// Double submit CSRF token issued by the server as a cookie.
+var csrfToken = (document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/) || [])[1];
+if (csrfToken) {
+  $.ajaxSetup({ headers: { 'X-CSRF-Token': csrfToken } });
+}
+
 var api = {
   _noop: () => {},
 
@@ -343,6 +358,16 @@ var api = {
     $.post(`/users/add?${q}`).done(success).fail(api._failHandler(error));
   },
 
+  userInvite(invite, success, error) {
+    var q = jQuery.param(invite, true);
+    $.post(`/users/invite?${q}`).done(success).fail(api._failHandler(error));
+  },
+
+  userJoin(join, success, error) {
+    var q = jQuery.param(join, true);
+    $.post(`/users/join?${q}`).done(success).fail(api._failHandler(error));
+  },
+
   userAuth(creds, success, error) {
     var q = jQuery.param(creds, true);
     $.post(`/users/auth?${q}`).done(success).fail(api._failHandler(error));
@@ -0,0 +1,136 @@
+toastr.options.closeDuration = 200;
+toastr.options.timeOut = 4000;
+
+// Admins and coaches share the login, both are users of the system shard.
+var adminKey = 'admin' + BasePath;
+
+var dashboardApi = {
+  auth(name, passcode, success, error) {
+    var q = jQuery.param({ name, passcode }, true);
+    $.post(`/admin/auth?${q}`).done(success).fail(api._failHandler(error));
+  },
+
+  listTeams(success, error) {
+    $.ajax('/dashboard/teams').done(success).fail(api._failHandler(error));
+  }
+};
+
+var DashboardPage = {
+  tpl: {
+    Summaries: Handlebars.compile(`
+      <h6 class="mb-3">Teams <small class="float-right">{{open}} of {{teams.length}} sessions open</small></h6>
+      <table class="table table-sm mb-0">
+        <thead>
+          <tr><th>Team</th><th>Session</th><th>Leader</th><th>Voted</th><th>Last activity</th></tr>
+        </thead>
+        <tbody>
+          {{#each teams}}
+          <tr>
+            <td>{{this.team}}</td>
+            <td>
+              {{#if this.running}}
+              <span class="badge {{#if this.open}}badge-success{{else}}badge-secondary{{/if}}">{{#if this.open}}open{{else}}closed{{/if}}</span>
+              {{else}}
+              <span class="badge badge-warning">{{#if this.suspended}}suspended{{else}}stopped{{/if}}</span>
+              {{/if}}
+            </td>
+            <td>{{this.leader}}</td>
+            <td>{{#if this.open}}{{this.voted}} of {{this.voters}}{{/if}}</td>
+            <td><small class="text-muted">{{this.ago}}</small></td>
+          </tr>
+          {{else}}
+          <tr><td colspan="5" class="font-italic text-center">There are no teams</td></tr>
+          {{/each}}
+        </tbody>
+      </table>
+    `)
+  },
+
+  init() {
+    this.teams = [];
+    this.login = $('#DashboardLogin');
+    this.container = $('#SummariesContainer');
+
+    api.defaultErrorHandler = (res) => {
+      if (res.status == 401 || res.status == 403) {
+        this.logout();
+      }
+      toastr.error(res.error.error);
+    };
+
+    $('#DashboardLoginBtn').on('click', () => {
+      var name = $('#InputCoachName').val() || '';
+      var passcode = $('#InputCoachPasscode').val() || '';
+      dashboardApi.auth(name, passcode, (data, statusText, res) => {
+        window.localStorage.setItem(adminKey, JSON.stringify({ name, token: res.getResponseHeader('authorization') }));
+        this.start();
+      });
+    });
+    $('#LogoutBtn').on('click', () => this.logout());
+
+    // Keeps the last activity fresh between changes.
+    setInterval(() => this.render(), 30000);
+    this.start();
+  },
+
+  start() {
+    var coach = JSON.parse(window.localStorage.getItem(adminKey) || 'null');
+    if (!coach) {
+      this.login.removeClass('d-none');
+      return;
+    }
+    $.ajaxSetup({ headers: { 'authorization': coach.token } });
+    $('#LogoutBtn').text('Logout ' + coach.name).removeClass('d-none');
+    this.login.addClass('d-none');
+    this.container.removeClass('d-none');
+    dashboardApi.listTeams((teams) => {
+      this.update(teams);
+      this.connect(coach.token, 1000);
+    });
+  },
+
+  // connect follows changes of the teams, it reconnects with a growing delay.
+  connect(token, delay) {
+    var url = 'ws://' + location.host + BasePath + '/dashboard/changes?authorization=' + encodeURIComponent(token);
+    var socket = new WebSocket(url);
+    socket.onopen = () => delay = 1000;
+    socket.onmessage = (event) => this.update(JSON.parse(event.data));
+    socket.onclose = () => {
+      setTimeout(() => this.connect(token, Math.min(delay * 2, 30000)), delay);
+    };
+  },
+
+  logout() {
+    window.localStorage.removeItem(adminKey);
+    window.location.reload();
+  },
+
+  update(teams) {
+    this.teams = teams;
+    this.render();
+  },
+
+  render() {
+    var now = Date.now();
+    var teams = this.teams.map(t => Object.assign({ ago: t.active ? this.ago(now - Date.parse(t.active)) : '' }, t));
+    var open = teams.filter(t => t.open).length;
+    this.container.html(this.tpl.Summaries({ teams, open }));
+  },
+
+  ago(ms) {
+    var minutes = Math.floor(ms / 60000);
+    if (minutes < 1) {
+      return 'just now';
+    }
+    if (minutes < 60) {
+      return `${minutes} min ago`;
+    }
+    var hours = Math.floor(minutes / 60);
+    if (hours < 24) {
+      return `${hours} h ago`;
+    }
+    return `${Math.floor(hours / 24)} d ago`;
+  }
+};
+
+$(() => DashboardPage.init());
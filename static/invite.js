@@ -0,0 +1,26 @@
+var InvitePage = {
+  init() {
+    this.joinBtn = $('#JoinBtn');
+    this.nameInput = $('#InputName');
+    this.passcodeInput = $('#InputPasscode');
+    this.errorBox = $('#JoinError');
+
+    this.joinBtn.on('click', () => {
+      var name = this.nameInput.val() || '';
+      var passcode = this.passcodeInput.val() || '';
+      var token = this.joinBtn.data('token');
+      this.joinBtn.attr('disabled', true);
+      api.userJoin({ token, name, passcode }, (data, statusText, res) => {
+        var token = res.getResponseHeader('authorization');
+        var role = atob(token).split(',')[2];
+        window.localStorage.setItem(userKey, JSON.stringify({ name, token, role }));
+        window.location = BasePath + '/';
+      }, (res) => {
+        this.joinBtn.removeAttr('disabled');
+        this.errorBox.removeClass('d-none').text(res.error.error);
+      });
+    });
+  }
+};
+
+$(() => InvitePage.init());
@@ -14,7 +14,7 @@ var passcodeTemplate = Handlebars.compile(`
       <input id="Passcode" type="password" class="form-control form-control-lg" placeholder="Enter passcode" data-username="{{name}}">
     </div>    
     <div>
-      <button class="btn btn-fixed-2 btn-outline-secondary float-left" type="button" style="cursor: pointer;" onclick="javascript:location.reload();">
+      <button class="btn btn-fixed-2 btn-outline-secondary float-left" type="button" style="cursor: pointer;" id="BackBtn">
         <svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16" width="16" height="16" fill="#fff">
           <path fill-rule="evenodd" d="M7.78 12.53a.75.75 0 01-1.06 0L2.47 8.28a.75.75 0 010-1.06l4.25-4.25a.75.75 0 011.06 1.06L4.81 7h7.44a.75.75 0 010 1.5H4.81l2.97 2.97a.75.75 0 010 1.06z"></path>
         </svg>
@@ -33,8 +33,8 @@ var LoginPage = {
     this.root.on('click', '.user-btn', (event) => {
       var name = event.target.dataset.user;
       if (event.target.dataset.user == 'observer') {
-        window.localStorage.setItem("user", JSON.stringify({ name }));
-        window.location = '/';
+        window.localStorage.setItem(userKey, JSON.stringify({ name }));
+        window.location = BasePath + '/';
         return;
       }
       var user = this.users.find((u) => u.name === name);
@@ -49,6 +49,7 @@ var LoginPage = {
     });
 
     this.root.on('click', '#LoginBtn', attemptLogin);
+    this.root.on('click', '#BackBtn', () => location.reload());
 
     function attemptLogin() {
       var passEl = $("#Passcode");
@@ -57,8 +58,8 @@ var LoginPage = {
       api.userAuth({ name, passcode }, (data, statusText, res) => {
         var token = res.getResponseHeader('authorization');
         var role = atob(token).split(',')[2];
-        window.localStorage.setItem("user", JSON.stringify({ name, token, role }));
-        window.location = '/';
+        window.localStorage.setItem(userKey, JSON.stringify({ name, token, role }));
+        window.location = BasePath + '/';
       },
         function (res) {
           var msg = res.error.error;
@@ -1,3 +1,4 @@
+var SessionOpts = JSON.parse(document.getElementById('SessionOpts').textContent);
 toastr.options = {
   timeOut: 100,
   closeDuration: 100
@@ -26,7 +27,7 @@ const ClickSound = {
   }
 
 };
-ClickSound.init("/static/n.mp3");
+ClickSound.init(BasePath + "/static/n.mp3");
 
 class FibSeq {
   constructor(options = {}) {
@@ -187,7 +188,7 @@ class SessionStart extends React.Component {
       component = /*#__PURE__*/React.createElement("div", {
         className: "alert alert-warning"
       }, "There is no any voter in the team yet, ", /*#__PURE__*/React.createElement("a", {
-        href: "/ui/users",
+        href: BasePath + "/ui/users",
         className: "bold"
       }, "add voter"), ".", /*#__PURE__*/React.createElement("br", null));
     } else {
@@ -223,7 +224,7 @@ class SessionStart extends React.Component {
       }, "Opening a session makes you leader ", /*#__PURE__*/React.createElement("span", {
         className: "leader-badge"
       }, "\u2605"), " of it. ", /*#__PURE__*/React.createElement("a", {
-        href: "/ui/docs"
+        href: BasePath + "/ui/docs"
       }, "More")));
     }
 
@@ -357,11 +358,32 @@ class FibBoard extends React.Component {
 
 }
 
+const presenceOf = (presence, name) => {
+  if (!presence) return null;
+  if (presence.offline.indexOf(name) >= 0) return 'offline';
+  if (presence.idle.indexOf(name) >= 0) return 'idle';
+  if (presence.online.indexOf(name) >= 0) return 'online';
+  return null;
+};
+
+const PresenceLine = props => /*#__PURE__*/React.createElement("div", {
+  className: "presence-line small mt-3"
+}, props.presence.online.map(name => /*#__PURE__*/React.createElement("span", {
+  key: name,
+  className: "presence presence-online mr-2",
+  title: "online"
+}, name)), props.presence.idle.map(name => /*#__PURE__*/React.createElement("span", {
+  key: name,
+  className: "presence presence-idle mr-2",
+  title: "idle"
+}, name)));
+
 const UserScoreLine = props => /*#__PURE__*/React.createElement("div", {
   className: "user-vote",
   datauser: props.user
 }, /*#__PURE__*/React.createElement("div", null, /*#__PURE__*/React.createElement("span", {
-  className: "voter-name"
+  className: "voter-name" + (props.presence ? " presence presence-" + props.presence : ""),
+  title: props.presence
 }, props.user), /*#__PURE__*/React.createElement("span", {
   className: "badge badge-score"
 }, props.score), props.leader && /*#__PURE__*/React.createElement("div", {
@@ -440,7 +462,8 @@ class Voting extends React.Component {
     var voters = Object.keys(chain.voters).map(username => ({
       name: username,
       score: chain.voters[username],
-      leader: chain.leader === username
+      leader: chain.leader === username,
+      presence: presenceOf(this.props.presence, username)
     }));
     var voter = voters.find(v => v.name == this.props.user.name);
     var peers = voters.filter(p => p !== voter).sort();
@@ -465,7 +488,8 @@ class Voting extends React.Component {
     }), /*#__PURE__*/React.createElement("div", null, voter && /*#__PURE__*/React.createElement(UserScoreLine, {
       user: voter.name,
       score: voter.score,
-      leader: voter.leader
+      leader: voter.leader,
+      presence: voter.presence
     }, /*#__PURE__*/React.createElement(FibBoard, {
       onVote: this.handleVote,
       sequence: this.fibonacci.getSequence()
@@ -473,8 +497,11 @@ class Voting extends React.Component {
       key: p.name,
       user: p.name,
       score: p.score,
-      leader: p.leader
-    }))), /*#__PURE__*/React.createElement("div", {
+      leader: p.leader,
+      presence: p.presence
+    }))), this.props.presence && /*#__PURE__*/React.createElement(PresenceLine, {
+      presence: this.props.presence
+    }), /*#__PURE__*/React.createElement("div", {
       className: "row mt-3"
     }, /*#__PURE__*/React.createElement("div", {
       className: "col-sm-4 offset-sm-4"
@@ -488,28 +515,46 @@ class Voting extends React.Component {
 
 class SessionSubscriber {
   constructor(topic, token, handler) {
-    this.url = 'ws://' + location.host + '/session/' + topic + '?authorization=' + (token || '');
+    this.url = 'ws://' + location.host + BasePath + '/session/' + topic + '?authorization=' + (token || '');
+    this.eventsUrl = BasePath + '/session/events?authorization=' + (token || '');
     this.token = token;
     this.handler = handler;
     this.firstTime = true;
     this.maxRefereshWaitMs = 6000;
+    this.failures = 0;
+    this.maxFailures = 2;
   }
 
   connect() {
-    if (this.socket) {
+    if (this.socket || this.events) {
+      return;
+    }
+
+    if (this.failures >= this.maxFailures) {
+      this.listen();
       return;
     }
 
     var url = this.url;
 
     if (this.firstTime) {
-      url += '&sync';
+      // Resume from the last seen version to get only missed changes.
+      url += this.version ? '&since=' + this.version : '&sync';
       this.firstTime = false;
     }
 
+    var opened = false;
     this.socket = new WebSocket(url);
+    this.socket.addEventListener('open', () => {
+      opened = true;
+      this.failures = 0;
+    });
     this.socket.addEventListener('error', console.error);
     this.socket.addEventListener('close', () => {
+      if (!opened) {
+        this.failures++;
+      }
+
       this.firstTime = true;
       this.socket = null;
       var randomMs = 5000 + parseInt(Math.random() * 3000);
@@ -518,8 +563,31 @@ class SessionSubscriber {
     });
     this.socket.addEventListener('message', event => {
       if (!event.data || !event.data.length) return;
+      var session = JSON.parse(event.data); // A change of presence comes with the same version.
+
+      if (session.version !== this.version) {
+        ClickSound.play();
+      }
+
+      this.version = session.version;
+      this.handler(session);
+    });
+  } // listen falls back to server-sent events when a proxy blocks websockets.
+
+
+  listen() {
+    this.events = new EventSource(this.eventsUrl);
+    this.events.addEventListener('session', event => {
       ClickSound.play();
-      this.handler(JSON.parse(event.data));
+      this.session = JSON.parse(event.data);
+      this.handler(this.session);
+    });
+    this.events.addEventListener('presence', event => {
+      if (!this.session) return;
+      this.session = Object.assign({}, this.session, {
+        presence: JSON.parse(event.data)
+      });
+      this.handler(this.session);
     });
   }
 
@@ -611,11 +679,12 @@ class Session extends React.Component {
       component = /*#__PURE__*/React.createElement("div", {
         className: "alert alert-danger"
       }, "Encountered error: ", this.state.error, ". ", /*#__PURE__*/React.createElement("a", {
-        href: "/"
+        href: BasePath + "/"
       }, "Try to again"));
     } else if (this.state.session.chain) {
       component = /*#__PURE__*/React.createElement(Voting, {
         chain: this.state.session.chain,
+        presence: this.state.session.presence,
         primaryAggregate: SessionOpts.primaryAggregate,
         fibSize: SessionOpts.fibonacci.size,
         fibBucketThreshold: SessionOpts.fibonacci.bucketThreshold,
@@ -1,3 +1,4 @@
+var SessionOpts = JSON.parse(document.getElementById('SessionOpts').textContent);
 toastr.options = {
   timeOut: 100,
   closeDuration: 100,
@@ -27,7 +28,7 @@ const ClickSound = {
   }
  };
  
- ClickSound.init("/static/n.mp3");
+ ClickSound.init(BasePath + "/static/n.mp3");
 
 class FibSeq {
   constructor(options = {}) {
@@ -143,7 +144,7 @@ class SessionStart extends React.Component {
     } else if (!this.state.voters.length) {
       component = (
         <div className="alert alert-warning">
-          There is no any voter in the team yet, <a href="/ui/users" className="bold">add voter</a>.<br />
+          There is no any voter in the team yet, <a href={BasePath + "/ui/users"} className="bold">add voter</a>.<br />
         </div>
       );
     } else {
@@ -163,7 +164,7 @@ class SessionStart extends React.Component {
           <button id="OpenSessionBtn" onClick={this.handleOpen} className="btn btn-sm btn-primary mt-3">
             Open <svg viewBox="0 0 16 16" width="16" height="16" className="ml-1"><path fillRule="evenodd" d="M14.064 0a8.75 8.75 0 00-6.187 2.563l-.459.458c-.314.314-.616.641-.904.979H3.31a1.75 1.75 0 00-1.49.833L.11 7.607a.75.75 0 00.418 1.11l3.102.954c.037.051.079.1.124.145l2.429 2.428c.046.046.094.088.145.125l.954 3.102a.75.75 0 001.11.418l2.774-1.707a1.75 1.75 0 00.833-1.49V9.485c.338-.288.665-.59.979-.904l.458-.459A8.75 8.75 0 0016 1.936V1.75A1.75 1.75 0 0014.25 0h-.186zM10.5 10.625c-.088.06-.177.118-.266.175l-2.35 1.521.548 1.783 1.949-1.2a.25.25 0 00.119-.213v-2.066zM3.678 8.116L5.2 5.766c.058-.09.117-.178.176-.266H3.309a.25.25 0 00-.213.119l-1.2 1.95 1.782.547zm5.26-4.493A7.25 7.25 0 0114.063 1.5h.186a.25.25 0 01.25.25v.186a7.25 7.25 0 01-2.123 5.127l-.459.458a15.21 15.21 0 01-2.499 2.02l-2.317 1.5-2.143-2.143 1.5-2.317a15.25 15.25 0 012.02-2.5l.458-.458h.002zM12 5a1 1 0 11-2 0 1 1 0 012 0zm-8.44 9.56a1.5 1.5 0 10-2.12-2.12c-.734.73-1.047 2.332-1.15 3.003a.23.23 0 00.265.265c.671-.103 2.273-.416 3.005-1.148z"></path></svg>
           </button>
-          <div className="mt-3 small">Opening a session makes you leader <span className="leader-badge">&#x02605;</span> of it. <a href="/ui/docs">More</a></div>
+          <div className="mt-3 small">Opening a session makes you leader <span className="leader-badge">&#x02605;</span> of it. <a href={BasePath + "/ui/docs"}>More</a></div>
         </React.Fragment>
       );
     }      
@@ -262,10 +263,25 @@ class FibBoard extends React.Component {
   }
 }
 
+const presenceOf = (presence, name) => {
+  if (!presence) return null;
+  if (presence.offline.indexOf(name) >= 0) return 'offline';
+  if (presence.idle.indexOf(name) >= 0) return 'idle';
+  if (presence.online.indexOf(name) >= 0) return 'online';
+  return null;
+};
+
+const PresenceLine = props => (
+  <div className="presence-line small mt-3">
+    {props.presence.online.map(name => <span key={name} className="presence presence-online mr-2" title="online">{name}</span>)}
+    {props.presence.idle.map(name => <span key={name} className="presence presence-idle mr-2" title="idle">{name}</span>)}
+  </div>
+);
+
 const UserScoreLine = props => (
   <div className="user-vote" datauser={props.user}>
     <div>
-      <span className="voter-name">{props.user}</span>
+      <span className={"voter-name" + (props.presence ? " presence presence-" + props.presence : "")} title={props.presence}>{props.user}</span>
       <span className="badge badge-score">{props.score}</span>
       {props.leader && <div className="leader-badge float-right">&#x02605;</div>}
     </div>
@@ -334,6 +350,7 @@ class Voting extends React.Component {
       name: username, 
       score: chain.voters[username],
       leader: chain.leader === username,
+      presence: presenceOf(this.props.presence, username),
     }));
 
     var voter = voters.find(v => v.name == this.props.user.name);
@@ -346,12 +363,13 @@ class Voting extends React.Component {
         {result && <VoteResult result={result} unmask={unmask} onUnmask={this.handleUnmask}/>}
         <div>
           {voter && 
-            (<UserScoreLine  user={voter.name} score={voter.score} leader={voter.leader}>
+            (<UserScoreLine  user={voter.name} score={voter.score} leader={voter.leader} presence={voter.presence}>
               <FibBoard onVote={this.handleVote} sequence={this.fibonacci.getSequence()}/>
             </UserScoreLine>)
           }
-          {peers.map(p => (<UserScoreLine key={p.name} user={p.name} score={p.score} leader={p.leader}/>))}
+          {peers.map(p => (<UserScoreLine key={p.name} user={p.name} score={p.score} leader={p.leader} presence={p.presence}/>))}
         </div>
+        {this.props.presence && <PresenceLine presence={this.props.presence}/>}
         <div className="row mt-3" >
           <div className="col-sm-4 offset-sm-4">
             <button onClick={this.handleClose} className="btn btn-sm btn-block btn-close">Close</button>
@@ -364,22 +382,36 @@ class Voting extends React.Component {
 
 class SessionSubscriber {
   constructor(topic, token, handler) {
-    this.url = 'ws://' + location.host + '/session/' + topic + '?authorization=' + (token || '');
+    this.url = 'ws://' + location.host + BasePath + '/session/' + topic + '?authorization=' + (token || '');
+    this.eventsUrl = BasePath + '/session/events?authorization=' + (token || '');
     this.token = token;
     this.handler = handler;
     this.firstTime = true;
     this.maxRefereshWaitMs = 6000;
+    this.failures = 0;
+    this.maxFailures = 2;
   }
   connect() {
-    if (this.socket) { return; }
+    if (this.socket || this.events) { return; }
+    if (this.failures >= this.maxFailures) {
+      this.listen();
+      return;
+    }
     var url = this.url;
     if (this.firstTime) {
-      url += '&sync';
+      // Resume from the last seen version to get only missed changes.
+      url += this.version ? '&since=' + this.version : '&sync';
       this.firstTime = false;
     }
+    var opened = false;
     this.socket = new WebSocket(url);
+    this.socket.addEventListener('open', () => {
+      opened = true;
+      this.failures = 0;
+    });
     this.socket.addEventListener('error', console.error);
     this.socket.addEventListener('close', () => {
+      if (!opened) { this.failures++; }
       this.firstTime = true;
       this.socket = null;
       var randomMs = 5000 + parseInt(Math.random() * 3000);
@@ -388,8 +420,25 @@ class SessionSubscriber {
     });
     this.socket.addEventListener('message', (event) => {
       if (!event.data || !event.data.length) return;  
+      var session = JSON.parse(event.data);
+      // A change of presence comes with the same version.
+      if (session.version !== this.version) { ClickSound.play(); }
+      this.version = session.version;
+      this.handler(session);
+    });
+  }
+  // listen falls back to server-sent events when a proxy blocks websockets.
+  listen() {
+    this.events = new EventSource(this.eventsUrl);
+    this.events.addEventListener('session', (event) => {
       ClickSound.play();
-      this.handler(JSON.parse(event.data));
+      this.session = JSON.parse(event.data);
+      this.handler(this.session);
+    });
+    this.events.addEventListener('presence', (event) => {
+      if (!this.session) return;
+      this.session = Object.assign({}, this.session, { presence: JSON.parse(event.data) });
+      this.handler(this.session);
     });
   }
 };
@@ -444,10 +493,11 @@ class Session extends React.Component {
     if (this.state.loader) {
       component = (<Spinner message={this.state.loader.message}/>)
     } else if (this.state.error) {
-      component = <div className="alert alert-danger">Encountered error: {this.state.error}. <a href="/">Try to again</a></div>
+      component = <div className="alert alert-danger">Encountered error: {this.state.error}. <a href={BasePath + "/"}>Try to again</a></div>
     } else if (this.state.session.chain) {
       component = <Voting 
         chain={this.state.session.chain}
+         presence={this.state.session.presence}
          primaryAggregate={SessionOpts.primaryAggregate}
          fibSize={SessionOpts.fibonacci.size}
          fibBucketThreshold={SessionOpts.fibonacci.bucketThreshold}
@@ -65,6 +65,13 @@
           });
       });
 
+      $('#InviteBtn').on('click', () => {
+        api.userInvite({ role: 'voter' }, (invite) => {
+          $('#InviteLink').val(location.origin + BasePath + '/ui/invite/' + invite.token).removeClass('d-none').select();
+          toastr.success("Invite is valid until " + new Date(invite.expires_at).toLocaleString());
+        });
+      });
+
       this.votersContainer.on('click', '.del-user-btn', (event) => {
         var target = $(event.target).closest('.del-user-btn');
         var name = target.data('username');
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	wsStat = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -9,21 +13,185 @@ var (
 		Help:      "Total number of active websocket connections",
 	})
 
+	sseStat = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "sse",
+		Name:      "conn_active",
+		Help:      "Total number of active server-sent event streams",
+	})
+
+	broadcastCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "broadcast",
+		Name:      "coalesced_total",
+		Help:      "Total number of messages superseded in the buffer of a slow client",
+	})
+
+	broadcastDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "broadcast",
+		Name:      "slow_clients_dropped_total",
+		Help:      "Total number of clients disconnected for not keeping up with changes",
+	})
+
+	// httpDurations is labeled by the route template, like /ui/invite/{token},
+	// so tokens and names in paths don't make new series.
 	httpDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    "http_req_latency_sec",
-		Help:    "Http latency distributions.",
-		Buckets: prometheus.LinearBuckets(300, 500, 3),
-	}, []string{"path"})
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests by team and route",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"team", "route", "method"})
 
 	reqCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Subsystem: "http",
 		Name:      "req_total",
 		Help:      "Total number of requests received",
 	})
+
+	authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Total number of failed login attempts",
+	})
+
+	authLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "lockouts_total",
+		Help:      "Total number of lockouts by scope (user or ip)",
+	}, []string{"scope"})
+
+	sessionsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "session",
+		Name:      "opened_total",
+		Help:      "Total number of opened sessions by team",
+	}, []string{"team"})
+
+	sessionsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "session",
+		Name:      "closed_total",
+		Help:      "Total number of closed sessions by team",
+	}, []string{"team"})
+
+	sessionUnmasks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "session",
+		Name:      "unmask_total",
+		Help:      "Total number of polls unmasked by leaders by team",
+	}, []string{"team"})
+
+	leaderExpirations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "session",
+		Name:      "leader_expired_total",
+		Help:      "Total number of sessions closed by others after the leader was idle too long by team",
+	}, []string{"team"})
+
+	pollsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "poll",
+		Name:      "completed_total",
+		Help:      "Total number of polls everybody voted in by team",
+	}, []string{"team"})
+
+	pollsOutOfBucket = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "poll",
+		Name:      "out_of_bucket_total",
+		Help:      "Total number of completed polls with scores spread over the out of bucket limit by team",
+	}, []string{"team"})
+
+	votesCast = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "poll",
+		Name:      "votes_total",
+		Help:      "Total number of accepted votes by team",
+	}, []string{"team"})
+
+	runningTeams = newTeamGauges()
+)
+
+// teamMetrics are counters of a team.
+type teamMetrics struct {
+	sessionsOpened    prometheus.Counter
+	sessionsClosed    prometheus.Counter
+	unmasks           prometheus.Counter
+	leaderExpirations prometheus.Counter
+	pollsCompleted    prometheus.Counter
+	pollsOutOfBucket  prometheus.Counter
+	votes             prometheus.Counter
+}
+
+func newTeamMetrics(team string) *teamMetrics {
+	return &teamMetrics{
+		sessionsOpened:    sessionsOpened.WithLabelValues(team),
+		sessionsClosed:    sessionsClosed.WithLabelValues(team),
+		unmasks:           sessionUnmasks.WithLabelValues(team),
+		leaderExpirations: leaderExpirations.WithLabelValues(team),
+		pollsCompleted:    pollsCompleted.WithLabelValues(team),
+		pollsOutOfBucket:  pollsOutOfBucket.WithLabelValues(team),
+		votes:             votesCast.WithLabelValues(team),
+	}
+}
+
+var (
+	sessionVotersDesc = prometheus.NewDesc("session_voters",
+		"Number of voters of the current poll by team", []string{"team"}, nil)
+	broadcastQueueDesc = prometheus.NewDesc("broadcast_queue_depth",
+		"Number of changes waiting for the broadcaster by team", []string{"team"}, nil)
 )
 
+// teamGauges reads gauges of running teams when metrics are scraped.
+type teamGauges struct {
+	mux   sync.Mutex
+	teams map[*endpoints]bool
+}
+
+func newTeamGauges() *teamGauges {
+	return &teamGauges{teams: make(map[*endpoints]bool)}
+}
+
+func (g *teamGauges) add(h *endpoints) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.teams[h] = true
+}
+
+func (g *teamGauges) remove(h *endpoints) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	delete(g.teams, h)
+}
+
+func (g *teamGauges) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionVotersDesc
+	ch <- broadcastQueueDesc
+}
+
+func (g *teamGauges) Collect(ch chan<- prometheus.Metric) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for h := range g.teams {
+		name := h.team().Name
+		var voters int
+		h.sessionTopic.readPartial(func(s *session) error {
+			if c := s.getChain(); c != nil {
+				voters = len(c.current().voters)
+			}
+			return nil
+		})
+		ch <- prometheus.MustNewConstMetric(sessionVotersDesc, prometheus.GaugeValue, float64(voters), name)
+		ch <- prometheus.MustNewConstMetric(broadcastQueueDesc, prometheus.GaugeValue, float64(len(h.sessionTopic.changes)), name)
+	}
+}
+
 func init() {
 	prometheus.MustRegister(httpDurations)
 	prometheus.MustRegister(reqCounter)
 	prometheus.MustRegister(wsStat)
+	prometheus.MustRegister(sseStat)
+	prometheus.MustRegister(broadcastCoalesced)
+	prometheus.MustRegister(broadcastDropped)
+	prometheus.MustRegister(authFailures)
+	prometheus.MustRegister(authLockouts)
+	prometheus.MustRegister(sessionsOpened)
+	prometheus.MustRegister(sessionsClosed)
+	prometheus.MustRegister(sessionUnmasks)
+	prometheus.MustRegister(leaderExpirations)
+	prometheus.MustRegister(pollsCompleted)
+	prometheus.MustRegister(pollsOutOfBucket)
+	prometheus.MustRegister(votesCast)
+	prometheus.MustRegister(runningTeams)
 }
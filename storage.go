@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	storageBolt   = "bolt"
+	storageSqlite = "sqlite"
+)
+
+// storage creates the stores of a team. Every team is a shard of the storage,
+// several teams may share a storage unless -db_per_team is set.
+type storage interface {
+	users(shard string, maxUsers int) (userStore, error)
+	links(shard string, maxLinks int) (linkStore, error)
+	audit(shard string, c *clock) (auditStore, error)
+	invites(shard string, c *clock) (inviteStore, error)
+	policies(shard string) (policyOverrideStore, error)
+	polls(shard string) (pollStore, error)
+	snapshots(shard string) (snapshotStore, error)
+	// teams keeps teams managed at runtime, it is a part of the system shard.
+	teams() (teamConfigStore, error)
+	// usage reports the size of every bucket of the team.
+	usage(shard string) ([]*bucketUsage, error)
+	// replaceTeam replaces voters, links and policy overrides of the team in one
+	// transaction, scrum masters are kept. Links get new ids.
+	replaceTeam(shard string, users []*user, links []*link, overrides []*policyOverride) error
+	// migrate brings the schema up to date and moves data of renamed teams.
+	migrate(opts *migrateOptions) ([]string, error)
+	// backup writes a consistent snapshot of the whole storage.
+	backup(w io.Writer) (int64, error)
+	// ping returns an error unless the storage can be read.
+	ping() error
+	close() error
+}
+
+// openStorage opens a storage of the kind at the path without an extension,
+// the file will be created if it doesn't exist.
+func openStorage(kind string, path string) (storage, error) {
+	switch kind {
+	case storageBolt:
+		return openBoltStorage(storageFile(kind, path))
+	case storageSqlite:
+		return openSqliteStorage(storageFile(kind, path))
+	}
+	return nil, fmt.Errorf("unknown storage %q, wanted %s or %s", kind, storageBolt, storageSqlite)
+}
+
+func storageKindOf(s storage) string {
+	if _, ok := s.(*sqliteStorage); ok {
+		return storageSqlite
+	}
+	return storageBolt
+}
+
+func storageFile(kind string, path string) string {
+	if kind == storageSqlite {
+		return path + ".sqlite"
+	}
+	return path + ".db"
+}
+
+type bucketUsage struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Bytes   int    `json:"bytes"`
+}
+
+// teamStorages maps team names to their storage.
+type teamStorages map[string]storage
+
+// openTeamStorages opens storages in the directory, teams share one storage unless
+// perTeam is set. A storage file of a renamed team is moved to the current name,
+// on a dry run it is opened where it is and the move is returned as pending.
+func openTeamStorages(kind string, dir string, perTeam bool, teams map[string]*team, dryRun bool) (teamStorages, []string, error) {
+	stores := make(teamStorages)
+	var moves []string
+	var shared storage
+	for _, name := range sortedTeamNames(teams) {
+		if !perTeam && shared != nil {
+			stores[name] = shared
+			continue
+		}
+
+		path := filepath.Join(dir, dbPath)
+		if perTeam {
+			path = teamStoragePath(dir, name)
+			if from := teams[name].RenamedFrom; len(from) > 0 {
+				move, err := renameStorageFile(kind, teamStoragePath(dir, from), path, dryRun)
+				if err != nil {
+					stores.close()
+					return nil, nil, err
+				}
+				if len(move) > 0 {
+					moves = append(moves, move)
+					if dryRun {
+						path = teamStoragePath(dir, from)
+					}
+				}
+			}
+		}
+		// It will be created if it doesn't exist.
+		store, err := openStorage(kind, path)
+		if err != nil {
+			stores.close()
+			return nil, nil, err
+		}
+		stores[name], shared = store, store
+	}
+	return stores, moves, nil
+}
+
+func teamStoragePath(dir string, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%s", strings.ToLower(name), dbPath))
+}
+
+// renameStorageFile moves the file unless the target already exists, it
+// returns the move or nothing if there is none. The file stays on a dry run.
+func renameStorageFile(kind string, from string, to string, dryRun bool) (string, error) {
+	from, to = storageFile(kind, from), storageFile(kind, to)
+	if _, err := os.Stat(to); err == nil {
+		return "", nil
+	}
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return "", nil
+	}
+	move := fmt.Sprintf("move of storage %s to %s", from, to)
+	if dryRun {
+		return move, nil
+	}
+	logs.info("moving storage", "from", from, "to", to)
+	// Sqlite keeps uncommitted pages next to the database file.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(from + suffix); err == nil {
+			if err := os.Rename(from+suffix, to+suffix); err != nil {
+				return "", err
+			}
+		}
+	}
+	return move, os.Rename(from, to)
+}
+
+// migrate migrates every storage once with renames of the teams it keeps.
+func (s teamStorages) migrate(teams map[string]*team, dryRun bool) ([]string, error) {
+	renames := make(map[storage]map[string]string)
+	var order []storage
+	for _, name := range sortedTeamNames(teams) {
+		store := s[name]
+		if _, ok := renames[store]; !ok {
+			renames[store] = make(map[string]string)
+			order = append(order, store)
+		}
+		if from := teams[name].RenamedFrom; len(from) > 0 {
+			renames[store][from] = name
+		}
+	}
+
+	var steps []string
+	for _, store := range order {
+		applied, err := store.migrate(&migrateOptions{renames: renames[store], dryRun: dryRun})
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, applied...)
+	}
+	return steps, nil
+}
+
+// open opens the storage of a team added to a running server and migrates it,
+// teams share a storage unless perTeam is set.
+func (s teamStorages) open(kind string, dir string, perTeam bool, t *team) (storage, []string, error) {
+	if store, ok := s[t.Name]; ok {
+		return store, nil, nil
+	}
+	var store storage
+	if !perTeam {
+		for _, shared := range s {
+			store = shared
+			break
+		}
+	}
+	if store == nil {
+		path := filepath.Join(dir, dbPath)
+		if perTeam {
+			path = teamStoragePath(dir, t.Name)
+			if len(t.RenamedFrom) > 0 {
+				if _, err := renameStorageFile(kind, teamStoragePath(dir, t.RenamedFrom), path, false); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		var err error
+		if store, err = openStorage(kind, path); err != nil {
+			return nil, nil, err
+		}
+	}
+	s[t.Name] = store
+	steps, err := s.migrate(map[string]*team{t.Name: t}, false)
+	if err != nil {
+		s.release(t.Name)
+		return nil, nil, err
+	}
+	return store, steps, nil
+}
+
+// release closes the storage of a removed team unless other teams share it.
+func (s teamStorages) release(name string) {
+	store, ok := s[name]
+	if !ok {
+		return
+	}
+	delete(s, name)
+	for _, other := range s {
+		if other == store {
+			return
+		}
+	}
+	store.close()
+}
+
+func (s teamStorages) close() {
+	closed := make(map[storage]bool)
+	for _, store := range s {
+		if !closed[store] {
+			closed[store] = true
+			store.close()
+		}
+	}
+}
+
+func sortedTeamNames(teams map[string]*team) []string {
+	names := make([]string, 0, len(teams))
+	for name := range teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func openBoltStorage(path string) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) users(shard string, maxUsers int) (userStore, error) {
+	return newBoltUserStore(s.db, shard, maxUsers)
+}
+
+func (s *boltStorage) links(shard string, maxLinks int) (linkStore, error) {
+	return newBoltLinkStore(s.db, shard, maxLinks)
+}
+
+func (s *boltStorage) audit(shard string, c *clock) (auditStore, error) {
+	return newBoltAuditStore(s.db, shard, c)
+}
+
+func (s *boltStorage) invites(shard string, c *clock) (inviteStore, error) {
+	return newBoltInviteStore(s.db, shard, c)
+}
+
+func (s *boltStorage) policies(shard string) (policyOverrideStore, error) {
+	return newBoltPolicyOverrideStore(s.db, shard)
+}
+
+func (s *boltStorage) polls(shard string) (pollStore, error) {
+	return newBoltPollStore(s.db, shard)
+}
+
+func (s *boltStorage) snapshots(shard string) (snapshotStore, error) {
+	return newBoltSnapshotStore(s.db, shard)
+}
+
+func (s *boltStorage) teams() (teamConfigStore, error) {
+	return newBoltTeamConfigStore(s.db)
+}
+
+func (s *boltStorage) usage(shard string) ([]*bucketUsage, error) {
+	var usage []*bucketUsage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range teamBucketNames {
+			u := &bucketUsage{Name: name}
+			if b := tx.Bucket([]byte(fmt.Sprintf("%s_%s", shard, name))); b != nil {
+				st := b.Stats()
+				u.Records = st.KeyN
+				u.Bytes = st.LeafInuse + st.BranchInuse + st.InlineBucketInuse
+			}
+			usage = append(usage, u)
+		}
+		return nil
+	})
+	return usage, err
+}
+
+func (s *boltStorage) replaceTeam(shard string, users []*user, links []*link, overrides []*policyOverride) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("%s_%s", shard, usersBucketName)))
+		if err != nil {
+			return err
+		}
+		// Keys can't be deleted while the cursor iterates over them.
+		var voters [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			u := new(user)
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			if u.Role != roleMaster {
+				voters = append(voters, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range voters {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, u := range users {
+			buf, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(u.Name), buf); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range []string{linksBucketName, policyBucketName} {
+			if err := tx.DeleteBucket([]byte(fmt.Sprintf("%s_%s", shard, name))); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if b, err = tx.CreateBucket([]byte(fmt.Sprintf("%s_%s", shard, linksBucketName))); err != nil {
+			return err
+		}
+		for _, l := range links {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			l.ID = int(id)
+			buf, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(itob(l.ID), buf); err != nil {
+				return err
+			}
+		}
+		if b, err = tx.CreateBucket([]byte(fmt.Sprintf("%s_%s", shard, policyBucketName))); err != nil {
+			return err
+		}
+		for _, o := range overrides {
+			if err := putPolicyOverride(b, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) ping() error {
+	return s.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func (s *boltStorage) close() error {
+	return s.db.Close()
+}
+
+// createBucket creates the bucket of a bolt store if it doesn't exist.
+func createBucket(db *bolt.DB, bucket []byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+}
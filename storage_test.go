@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStorage runs the same suite against every backend, so they stay interchangeable.
+func TestStorage(t *testing.T) {
+	for _, kind := range []string{storageBolt, storageSqlite} {
+		t.Run(kind, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "storage")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := openStorage(kind, filepath.Join(dir, "test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+
+			t.Run("users", func(t *testing.T) { testUserStorage(t, s) })
+			t.Run("links", func(t *testing.T) { testLinkStorage(t, s) })
+			t.Run("audit", func(t *testing.T) { testAuditStorage(t, s) })
+			t.Run("invites", func(t *testing.T) { testInviteStorage(t, s) })
+			t.Run("policies", func(t *testing.T) { testPolicyStorage(t, s) })
+			t.Run("polls", func(t *testing.T) { testPollStorage(t, s) })
+			t.Run("teams", func(t *testing.T) { testTeamConfigStorage(t, s) })
+			t.Run("snapshots", func(t *testing.T) { testSnapshotStorage(t, s) })
+			t.Run("replace", func(t *testing.T) { testReplaceTeamStorage(t, s) })
+			t.Run("migrate", func(t *testing.T) { testMigrateStorage(t, s) })
+			t.Run("backup", func(t *testing.T) { testBackupStorage(t, s, kind, dir) })
+		})
+	}
+}
+
+func testUserStorage(t *testing.T, s storage) {
+	a, err := s.users("a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.users("b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.getMaxUsers() != 2 {
+		t.Fatalf("expected max users 2, got %d", a.getMaxUsers())
+	}
+
+	for _, n := range []string{"vb", "va"} {
+		if err := a.create(newUser(n, roleVoter)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, err := a.get("va"); err != nil || u == nil || u.Role != roleVoter {
+		t.Fatalf("expected voter va, got %v %v", u, err)
+	}
+	if u, err := a.get("vc"); err != nil || u != nil {
+		t.Fatalf("expected no user, got %v %v", u, err)
+	}
+	if u, err := b.get("va"); err != nil || u != nil {
+		t.Fatalf("users must be isolated per team, got %v %v", u, err)
+	}
+
+	// Creating an existing user updates it.
+	u := newUser("va", roleMaster)
+	u.setPasscode("secret")
+	if err := a.create(u); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := a.get("va"); u.Role != roleMaster || !u.checkPasscode("secret") {
+		t.Fatalf("expected updated user, got %v", u)
+	}
+	if err := a.create(newUser("vc", roleVoter)); err == nil {
+		t.Fatal("expected the limit of users to be enforced")
+	}
+	// Adding never replaces a user.
+	if err := a.add(newUser("va", roleVoter)); err != errUsernameTaken {
+		t.Fatalf("expected the name to be taken, got %v", err)
+	}
+	if u, _ := a.get("va"); u.Role != roleMaster || !u.checkPasscode("secret") {
+		t.Fatalf("expected the user to be kept, got %v", u)
+	}
+	if err := b.add(newUser("va", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hash is replaced only while it is the old one.
+	old := u.PasscodeHash
+	u.setPasscode("other")
+	if err := a.rehash("va", "stale", u.PasscodeHash); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := a.get("va"); u.PasscodeHash != old {
+		t.Fatalf("expected a changed hash to be kept, got %v", u)
+	}
+	if err := a.rehash("va", old, u.PasscodeHash); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := a.get("va"); u.Role != roleMaster || !u.checkPasscode("other") {
+		t.Fatalf("expected the hash to be replaced, got %v", u)
+	}
+	if err := a.rehash("vd", old, u.PasscodeHash); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := a.get("vd"); u != nil {
+		t.Fatalf("expected a missing user to stay missing, got %v", u)
+	}
+
+	users, err := a.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Name != "va" || users[1].Name != "vb" {
+		t.Fatalf("expected users va and vb, got %v", users)
+	}
+
+	if err := a.delete("vb"); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := a.list(); len(users) != 1 {
+		t.Fatalf("expected one user after delete, got %d", len(users))
+	}
+}
+
+func testLinkStorage(t *testing.T, s storage) {
+	a, err := s.links("a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.links("b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &link{URI: "https://a.example.com", DisplayName: "A"}
+	second := &link{URI: "https://b.example.com", DisplayName: "B"}
+	for _, l := range []*link{first, second} {
+		if err := a.create(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.ID == 0 || second.ID <= first.ID {
+		t.Fatalf("expected increasing ids, got %d and %d", first.ID, second.ID)
+	}
+	if err := a.create(&link{URI: "https://c.example.com", DisplayName: "C"}); err == nil {
+		t.Fatal("expected links limit error")
+	}
+	if links, _ := b.list(); len(links) != 0 {
+		t.Fatalf("links must be isolated per team, got %v", links)
+	}
+
+	if err := a.deleteByID(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	links, err := a.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || *links[0] != *second {
+		t.Fatalf("expected only the second link, got %v", links)
+	}
+}
+
+func testAuditStorage(t *testing.T, s storage) {
+	c := new(clock)
+	a, err := s.audit("a", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.audit("b", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := c.Now()
+	for i, action := range []string{"users.add", "session.open", "users.remove"} {
+		e := &auditEntry{Time: start.Add(time.Duration(i) * time.Minute), Actor: "sm", Action: action, Target: "va", IP: "10.0.0.1", Result: auditResultOK}
+		if err := a.append(e); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID == 0 {
+			t.Fatalf("expected id to be assigned, got %v", e)
+		}
+	}
+	e := &auditEntry{Actor: "sm", Action: "users.add", Result: auditResultDenied, Error: "denied"}
+	if err := b.append(e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Time.IsZero() {
+		t.Fatalf("expected time to be assigned, got %v", e)
+	}
+
+	all, err := a.list(&auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].Action != "users.remove" || all[2].Action != "users.add" {
+		t.Fatalf("expected 3 entries newest first, got %v", all)
+	}
+	if !all[2].Time.Equal(start) {
+		t.Fatalf("expected time %v, got %v", start, all[2].Time)
+	}
+
+	users, _ := a.list(&auditFilter{Action: "users."})
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users entries, got %d", len(users))
+	}
+	since, _ := a.list(&auditFilter{Since: start.Add(time.Minute), Until: start.Add(2 * time.Minute)})
+	if len(since) != 1 || since[0].Action != "session.open" {
+		t.Fatalf("expected session.open in the time range, got %v", since)
+	}
+	page, _ := a.list(&auditFilter{Before: all[0].ID, Limit: 1})
+	if len(page) != 1 || page[0].ID != all[1].ID {
+		t.Fatalf("expected the second entry on the next page, got %v", page)
+	}
+	denied, _ := b.list(&auditFilter{Result: auditResultDenied})
+	if len(denied) != 1 || denied[0].Error != "denied" {
+		t.Fatalf("expected denied entry of team b, got %v", denied)
+	}
+
+	var n int
+	a.each(&auditFilter{}, func(e *auditEntry) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("each must stop when fn returns false, called %d times", n)
+	}
+}
+
+func testInviteStorage(t *testing.T, s storage) {
+	c := new(clock)
+	a, err := s.invites("a", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.invites("b", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := a.create(roleVoter, "sm", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.get(i.Token); got == nil || got.Role != roleVoter || got.CreatedBy != "sm" {
+		t.Fatalf("expected the invite, got %v", got)
+	}
+	if got, _ := b.get(i.Token); got != nil {
+		t.Fatalf("invites must be isolated per team, got %v", got)
+	}
+
+	if err := a.use(i.Token, func(*invite) error { return errInviteInvalid }); err == nil {
+		t.Fatal("expected join error")
+	}
+	if err := a.use(i.Token, func(*invite) error { return nil }); err != nil {
+		t.Fatalf("failed join must give the use back, got %v", err)
+	}
+	if err := a.use(i.Token, func(*invite) error { return nil }); err != errInviteInvalid {
+		t.Fatalf("expected used up invite, got %v", err)
+	}
+
+	unlimited, err := a.create(roleVoter, "sm", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invites, _ := a.list(); len(invites) != 1 || invites[0].Token != unlimited.Token {
+		t.Fatalf("expected only the unlimited invite, got %v", invites)
+	}
+
+	c.SetOffset(2 * time.Hour)
+	if got, _ := a.get(unlimited.Token); got != nil {
+		t.Fatalf("expired invite must not be returned, got %v", got)
+	}
+
+	c.SetOffset(0)
+	if err := a.delete(unlimited.Token); err != nil {
+		t.Fatal(err)
+	}
+	if invites, _ := a.list(); len(invites) != 0 {
+		t.Fatalf("expected no invites, got %v", invites)
+	}
+}
+
+func testPolicyStorage(t *testing.T, s storage) {
+	a, err := s.policies("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.policies("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := &policyOverride{policyRule{PType: "p", Rule: []string{"voter", "links", "add", "allow"}}, policyOpAdd}
+	removed := &policyOverride{policyRule{PType: "g", Rule: []string{"va", "voter"}}, policyOpRemove}
+	for _, o := range []*policyOverride{added, removed} {
+		if err := a.put(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if overrides, _ := b.list(); len(overrides) != 0 {
+		t.Fatalf("overrides must be isolated per team, got %v", overrides)
+	}
+
+	if err := a.delete(added.line()); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := a.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 1 || overrides[0].line() != removed.line() || overrides[0].Op != policyOpRemove {
+		t.Fatalf("expected the tombstone only, got %v", overrides)
+	}
+
+	if err := a.replace([]*policyOverride{added}); err != nil {
+		t.Fatal(err)
+	}
+	overrides, _ = a.list()
+	if len(overrides) != 1 || overrides[0].line() != added.line() || overrides[0].Op != policyOpAdd {
+		t.Fatalf("expected the added rule only, got %v", overrides)
+	}
+}
+
+func testTeamConfigStorage(t *testing.T, s storage) {
+	store, err := s.teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []*teamRecord{
+		{Name: "b", Deleted: true},
+		{Name: "a", Team: &team{Name: "a", Port: 8001, Preference: &preference{MaxFib: 8}}},
+	}
+	for _, rec := range records {
+		if err := store.put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records[0].Deleted = false
+	if err := store.put(records[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := store.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "a" || list[0].Team.Preference.MaxFib != 8 || list[1].Name != "b" || list[1].Deleted {
+		t.Fatalf("expected records to be replaced by name, got %+v", list)
+	}
+}
+
+func testReplaceTeamStorage(t *testing.T, s storage) {
+	users, _ := s.users("replaced", 10)
+	links, _ := s.links("replaced", 10)
+	policies, _ := s.policies("replaced")
+	users.create(newUser("master", roleMaster))
+	users.create(newUser("va", roleVoter))
+	links.create(&link{URI: "https://a.example.com", DisplayName: "A"})
+	policies.put(&policyOverride{policyRule{PType: "p", Rule: []string{"voter", "links", "add", "allow"}}, policyOpAdd})
+
+	replaced := &link{URI: "https://b.example.com", DisplayName: "B"}
+	override := &policyOverride{policyRule{PType: "p", Rule: []string{"voter", "users", "add", "allow"}}, policyOpAdd}
+	if err := s.replaceTeam("replaced", []*user{newUser("vb", roleVoter)}, []*link{replaced}, []*policyOverride{override}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, _ := users.list()
+	if len(list) != 2 || list[0].Name != "master" || list[1].Name != "vb" {
+		t.Fatalf("expected the master and the new voter, got %v", list)
+	}
+	if l, _ := links.list(); len(l) != 1 || l[0].URI != replaced.URI || l[0].ID != replaced.ID || replaced.ID == 0 {
+		t.Fatalf("expected the new link with an id, got %v", l)
+	}
+	if o, _ := policies.list(); len(o) != 1 || o[0].line() != override.line() {
+		t.Fatalf("expected the new override, got %v", o)
+	}
+	if err := links.create(&link{URI: "https://c.example.com", DisplayName: "C"}); err != nil {
+		t.Fatalf("expected links to be created after a replace, got %v", err)
+	}
+}
+
+func testSnapshotStorage(t *testing.T, s storage) {
+	store, err := s.snapshots("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap, err := store.load(); err != nil || snap != nil {
+		t.Fatalf("expected no snapshot, got %+v %v", snap, err)
+	}
+	for _, leader := range []string{"a", "b"} {
+		if err := store.save(&sessionSnapshot{Leader: leader, Voters: []string{"a", "b"}, Votes: map[string]int{"a": 3, "b": StatusNotVoted}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap == nil || snap.Leader != "b" || snap.Votes["a"] != 3 || snap.Votes["b"] != StatusNotVoted {
+		t.Fatalf("expected the last snapshot, got %+v", snap)
+	}
+	if err := store.save(nil); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err := store.load(); err != nil || snap != nil {
+		t.Fatalf("expected the snapshot to be deleted, got %+v %v", snap, err)
+	}
+}
+
+func testMigrateStorage(t *testing.T, s storage) {
+	old, err := s.users("old", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.create(newUser("va", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+	links, err := s.links("old", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &link{URI: "https://a.example.com", DisplayName: "A"}
+	if err := links.create(first); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &migrateOptions{renames: map[string]string{"old": "new"}, dryRun: true}
+	steps, err := s.migrate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) < 2 || steps[len(steps)-1] != "rename team old to new" {
+		t.Fatalf("expected schema and rename steps, got %v", steps)
+	}
+	if u, _ := old.get("va"); u == nil {
+		t.Fatal("dry run must not change data")
+	}
+
+	opts.dryRun = false
+	if _, err := s.migrate(opts); err != nil {
+		t.Fatal(err)
+	}
+	if steps, _ := s.migrate(opts); len(steps) != 0 {
+		t.Fatalf("migrations must be applied once, got %v", steps)
+	}
+
+	renamed, err := s.users("new", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := renamed.get("va"); u == nil {
+		t.Fatal("expected user of the renamed team")
+	}
+	// Stores of the previous name must be reopened, their buckets are gone.
+	if old, err = s.users("old", 10); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := old.get("va"); u != nil {
+		t.Fatalf("expected no users of the previous name, got %v", u)
+	}
+	renamedLinks, err := s.links("new", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := &link{URI: "https://b.example.com", DisplayName: "B"}
+	if err := renamedLinks.create(second); err != nil {
+		t.Fatal(err)
+	}
+	if second.ID <= first.ID {
+		t.Fatalf("renamed team must keep link ids, got %d after %d", second.ID, first.ID)
+	}
+
+	// A team can't be renamed onto a team with data.
+	if err := old.create(newUser("vb", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.migrate(opts); err == nil {
+		t.Fatal("expected rename conflict error")
+	}
+}
+
+func testBackupStorage(t *testing.T, s storage, kind string, dir string) {
+	users, err := s.users("backup", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.create(newUser("va", roleVoter)); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, backupName("backup", kind, time.Now()))
+	if err := writeBackup(s, path); err != nil {
+		t.Fatal(err)
+	}
+	version, err := snapshotSchemaVersion(kind, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == 0 {
+		t.Fatal("expected schema version of the migrated storage")
+	}
+
+	restored, err := openStorage(kind, path[:len(path)-len(storageFile(kind, ""))])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.close()
+	restoredUsers, err := restored.users("backup", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := restoredUsers.get("va"); u == nil {
+		t.Fatal("expected user in the snapshot")
+	}
+
+	junk := filepath.Join(dir, "junk")
+	if err := ioutil.WriteFile(junk, bytes.Repeat([]byte("junk"), 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapshotSchemaVersion(kind, junk); err == nil {
+		t.Fatal("expected error of a file which is not a snapshot")
+	}
+}
+
+func testPollStorage(t *testing.T, s storage) {
+	a, err := s.polls("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.polls("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		rec := &pollRecord{
+			Time:    start.Add(time.Duration(i) * time.Hour),
+			Name:    fmt.Sprintf("%d. poll", i),
+			Leader:  "va",
+			Votes:   map[string]int{"va": i, "vb": 3},
+			Average: float64(i+3) / 2,
+		}
+		if err := a.append(rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.ID == 0 {
+			t.Fatal("expected id to be assigned")
+		}
+	}
+	b.append(&pollRecord{Time: start, Name: "other", Votes: map[string]int{}})
+
+	var names []string
+	a.each(func(rec *pollRecord) bool {
+		names = append(names, rec.Name)
+		return true
+	})
+	if len(names) != 5 || names[0] != "4. poll" {
+		t.Fatalf("expected 5 polls newest first, got %v", names)
+	}
+	var first *pollRecord
+	a.each(func(rec *pollRecord) bool {
+		first = rec
+		return false
+	})
+	if first.Votes["va"] != 4 || first.Average != 3.5 || !first.Time.Equal(start.Add(4*time.Hour)) {
+		t.Fatalf("unexpected poll %+v", first)
+	}
+
+	// The poll older than 1h is purged, then all but the newest 2 in batches of one.
+	if n, err := a.purge(start.Add(time.Hour), 0, 10); err != nil || n != 1 {
+		t.Fatalf("expected one old poll purged, got %d %v", n, err)
+	}
+	if n, err := a.purge(time.Time{}, 2, 1); err != nil || n != 1 {
+		t.Fatalf("expected a single poll purged in a batch, got %d %v", n, err)
+	}
+	if n, err := a.purge(time.Time{}, 2, 10); err != nil || n != 1 {
+		t.Fatalf("expected the rest beyond the limit purged, got %d %v", n, err)
+	}
+	names = nil
+	a.each(func(rec *pollRecord) bool {
+		names = append(names, rec.Name)
+		return true
+	})
+	if len(names) != 2 || names[1] != "3. poll" {
+		t.Fatalf("expected the newest 2 polls, got %v", names)
+	}
+
+	usage, err := s.usage("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range usage {
+		if u.Name == pollsBucketName && (u.Records != 1 || u.Bytes == 0) {
+			t.Fatalf("expected a single poll of team b, got %+v", u)
+		}
+	}
+}
@@ -2,24 +2,49 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/boltdb/bolt"
-	"github.com/casbin/casbin"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type team struct {
 	Name                  string        `json:"name"`
+	RenamedFrom           string        `json:"renamed_from"`
 	Master                string        `json:"master"`
 	Port                  int           `json:"port"`
+	Host                  string        `json:"host"`
+	Suspended             bool          `json:"suspended"`
 	Preference            *preference   `json:"preference"`
 	LeaderMaxIdlePeriod   string        `json:"leader_max_idle_period"`
 	LeaderMaxIdleDuration time.Duration `json:"-"`
+	Retention             *retention    `json:"retention"`
+	Presence              *presence     `json:"presence"`
+	Quota                 *quota        `json:"quota"`
+}
+
+// quota limits what a team may keep and how many requests it serves at once,
+// websockets included.
+type quota struct {
+	Users       int `json:"users"`
+	Links       int `json:"links"`
+	Connections int `json:"connections"`
+}
+
+// retention limits the history of polls, zero values keep it forever.
+type retention struct {
+	MaxAge   string `json:"max_age"`
+	MaxPolls int    `json:"max_polls"`
+}
+
+// presence shows who has the board open, it is on unless disabled.
+type presence struct {
+	Disabled  bool   `json:"disabled"`
+	IdleAfter string `json:"idle_after"`
 }
 
 type preference struct {
@@ -38,11 +63,28 @@ func newDefaultTeam() *team {
 		OutOfBucketLimit: defaultOutBucket,
 		PrimaryAggrFunc:  "closestFib",
 	}
+	t.Retention = &retention{}
+	t.Presence = &presence{IdleAfter: defaultPresenceIdleAfter}
+	t.Quota = &quota{
+		Users:       defaultQuotaUsers,
+		Links:       defaultQuotaLinks,
+		Connections: defaultQuotaConnections,
+	}
 	return t
 }
 
 func (t *team) validate() error {
-	if t.Port <= 3000 {
+	// The name is a path of the storage with -db_per_team and of the team with -listen.
+	if !tenantNameRegex.MatchString(t.Name) {
+		return fmt.Errorf("team name %q is invalid, wanted letters, digits, - or _", t.Name)
+	}
+	if len(t.RenamedFrom) > 0 && !tenantNameRegex.MatchString(t.RenamedFrom) {
+		return fmt.Errorf("previous team name %q is invalid, wanted letters, digits, - or _", t.RenamedFrom)
+	}
+	if strings.EqualFold(t.Name, systemShard) {
+		return fmt.Errorf("team name %s is reserved", t.Name)
+	}
+	if t.Port != 0 && t.Port <= 3000 {
 		return fmt.Errorf("wanted port be greater of 3000, but got %d", t.Port)
 	}
 	if t.Preference == nil {
@@ -52,9 +94,30 @@ func (t *team) validate() error {
 	if err != nil {
 		return err
 	}
+	if t.Retention != nil {
+		if err := t.Retention.validate(); err != nil {
+			return err
+		}
+	}
+	if t.Presence != nil {
+		return t.Presence.validate()
+	}
 	return nil
 }
 
+// clone returns a deep copy of the team.
+func (t *team) clone() *team {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		panic(err)
+	}
+	c := new(team)
+	if err := json.Unmarshal(buf, c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
 func (t *team) getLeaderDuration() time.Duration {
 	period, err := time.ParseDuration(t.LeaderMaxIdlePeriod)
 	if err != nil {
@@ -79,6 +142,41 @@ func (t *team) extend(src *team) {
 	if src.Preference != nil {
 		t.Preference.extend(src.Preference)
 	}
+	if t.Retention == nil {
+		t.Retention = &retention{}
+	}
+	if t.Presence == nil {
+		t.Presence = &presence{}
+	}
+	if len(t.Presence.IdleAfter) == 0 && src.Presence != nil {
+		t.Presence.IdleAfter = src.Presence.IdleAfter
+	}
+	if t.Quota == nil {
+		t.Quota = &quota{}
+	}
+	if src.Quota != nil {
+		t.Quota.extend(src.Quota)
+	}
+}
+
+// getQuota returns the quota of the team, defaults if it isn't extended.
+func (t *team) getQuota() *quota {
+	if t.Quota == nil {
+		return newDefaultTeam().Quota
+	}
+	return t.Quota
+}
+
+func (q *quota) extend(src *quota) {
+	if q.Users <= 0 {
+		q.Users = src.Users
+	}
+	if q.Links <= 0 {
+		q.Links = src.Links
+	}
+	if q.Connections <= 0 {
+		q.Connections = src.Connections
+	}
 }
 
 func (p *preference) extend(src *preference) {
@@ -93,98 +191,227 @@ func (p *preference) extend(src *preference) {
 	}
 }
 
+func (r *retention) validate() error {
+	if len(r.MaxAge) > 0 {
+		age, err := time.ParseDuration(r.MaxAge)
+		if err != nil {
+			return err
+		}
+		if age <= 0 {
+			return fmt.Errorf("wanted retention max_age be positive, but got %s", r.MaxAge)
+		}
+	}
+	if r.MaxPolls < 0 {
+		return fmt.Errorf("wanted retention max_polls be positive, but got %d", r.MaxPolls)
+	}
+	return nil
+}
+
+func (r *retention) getMaxAge() time.Duration {
+	if len(r.MaxAge) == 0 {
+		return 0
+	}
+	age, err := time.ParseDuration(r.MaxAge)
+	if err != nil {
+		panic(err)
+	}
+	return age
+}
+
+func (p *presence) validate() error {
+	if p.Disabled {
+		return nil
+	}
+	idle, err := time.ParseDuration(p.IdleAfter)
+	if err != nil {
+		return err
+	}
+	if idle <= 0 {
+		return fmt.Errorf("wanted presence idle_after be positive, but got %s", p.IdleAfter)
+	}
+	return nil
+}
+
+func (p *presence) getIdleAfter() time.Duration {
+	idle, err := time.ParseDuration(p.IdleAfter)
+	if err != nil {
+		panic(err)
+	}
+	return idle
+}
+
 type teamServerOpts struct {
 	team        *team
-	db          *bolt.DB
-	enf         *casbin.Enforcer
+	store       storage
+	authConf    string
+	policyConf  string
 	addr        string
-	connlimit   int
+	basePath    string
+	origins     *originPolicy
 	templates   string
 	staticDir   string
 	sigshutdown chan bool
 	sigstop     <-chan bool
 }
 
-func startTeamServer(opts *teamServerOpts) {
-	users, err := newUserStore(opts.db, opts.team.Name, usersLimitPerTeam)
+// newTeamHandler opens stores of the team and routes its endpoints, paths are
+// relative to opts.basePath which pages prefix their links with.
+func newTeamHandler(opts *teamServerOpts) (*endpoints, http.Handler, error) {
+	users, err := opts.store.users(opts.team.Name, opts.team.getQuota().Users)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
-	links, err := newLinkStore(opts.db, opts.team.Name, linksLimitPerTeam)
+	links, err := opts.store.links(opts.team.Name, opts.team.getQuota().Links)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
-	templates := newTemplateMgr(opts.templates, &page{
-		Version: version, // Referencing global variable :(
-		Team:    opts.team.Name,
-	})
-
-	h := newEndpoints(&endpointsConfig{
-		team:        opts.team,
-		enforcer:    opts.enf,
-		clock:       new(clock),
-		templateMgr: templates,
-		userStore:   users,
-		linkStore:   links,
-	})
+	overrides, err := opts.store.policies(opts.team.Name)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r := mux.NewRouter()
+	policies := newPolicyStore(overrides, opts.policyConf)
+	enforcer, err := newPolicyEnforcer(opts.authConf, policies)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r.Use(metricMiddleware([]string{"/metrics"}))
-	r.Use(connLimitMiddleware(opts.connlimit))
+	clk := new(clock)
+	audit, err := opts.store.audit(opts.team.Name, clk)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", newFsWrapper(opts.staticDir, 1*time.Hour)))
+	invites, err := opts.store.invites(opts.team.Name, clk)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r.HandleFunc("/", h.pageIndexHandler)
-	r.HandleFunc("/ui/users", h.pageUsersHandler)
-	r.HandleFunc("/ui/login", h.pageLoginHandler)
-	r.HandleFunc("/ui/links", h.pageLinksHandler)
-	r.HandleFunc("/ui/docs", h.pageDocHandler)
+	polls, err := opts.store.polls(opts.team.Name)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r.HandleFunc("/session", h.sessionHandler)
-	r.HandleFunc("/session/open", h.sessionOpenHandler)
-	r.HandleFunc("/session/close", h.sessionCloseHandler)
-	r.HandleFunc("/session/vote", h.sessionVoteHandler)
-	r.HandleFunc("/session/reset", h.sessionResetHandler)
-	r.HandleFunc("/session/unmask", h.sessionUmaskHandler)
-	r.HandleFunc("/session/changes", h.acceptChangeLogListener)
-	if onlineEnabledFlag {
-		r.HandleFunc("/session/live_users", h.acceptOnlineListener)
+	snapshots, err := opts.store.snapshots(opts.team.Name)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	r.HandleFunc("/users/auth", h.usersAuthHandler)
-	r.HandleFunc("/users", h.usersHandler)
-	r.HandleFunc("/users/add", h.usersAddHandler)
-	r.HandleFunc("/users/remove", h.usersRemoveHandler)
+	templates, err := newTemplateMgr(opts.templates, &page{
+		Version: version, // Referencing global variable :(
+		Team:    opts.team.Name,
+		Base:    opts.basePath,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r.HandleFunc("/links", h.linksListHandler)
-	r.HandleFunc("/links/add", h.linksAddHandler)
-	r.HandleFunc("/links/remove", h.linksRemoveHandler)
+	h, err := newEndpoints(&endpointsConfig{
+		team:          opts.team,
+		enforcer:      enforcer,
+		clock:         clk,
+		templateMgr:   templates,
+		userStore:     users,
+		linkStore:     links,
+		policyStore:   policies,
+		auditStore:    audit,
+		inviteStore:   invites,
+		pollStore:     polls,
+		snapshotStore: snapshots,
+		storage:       opts.store,
+		origins:       opts.origins,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &janitor{team: opts.team.Name, retention: opts.team.Retention, polls: polls, clock: clk}
+	go j.start(janitorInterval, opts.sigstop)
 
-	r.Handle("/metrics", promhttp.Handler())
+	return h, newTeamRouter(h, opts), nil
+}
 
+// serve listens on addr until sigstop is closed, then reports to sigshutdown.
+func serve(name string, addr string, handler http.Handler, sigstop <-chan bool, sigshutdown chan bool) {
 	srv := &http.Server{
-		Addr:           opts.addr,
-		Handler:        r,
+		Addr:           addr,
+		Handler:        handler,
 		ReadTimeout:    20 * time.Second,
-		WriteTimeout:   20 * time.Second,
+		WriteTimeout:   serverWriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 
 	go func() {
-		<-opts.sigstop
-		if err := srv.Shutdown(context.Background()); err != nil {
-			log.Printf("server team - %s shutdown: %v", opts.team.Name, err)
+		<-sigstop
+		// Open boards are closed by their handlers, requests still running
+		// after the drain period are cut.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownDrainPeriod)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logs.error("server failed to shut down", "server", name, "err", err)
+			srv.Close()
 		}
 	}()
 
-	if err := srv.ListenAndServe(); err != nil {
-		log.Printf("server team - %s listen: %v", opts.team.Name, err)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logs.error("server failed to listen", "server", name, "err", err)
 	}
 
-	opts.sigshutdown <- true
+	sigshutdown <- true
+}
+
+func newTeamRouter(h *endpoints, opts *teamServerOpts) http.Handler {
+	r := mux.NewRouter()
+
+	r.Use(metricMiddleware(opts.team.Name, append([]string{"/metrics"}, probePaths...)))
+	r.Use(connLimitMiddleware(h.conns, append([]string{"/metrics"}, probePaths...)))
+	r.Use(securityMiddleware(opts.origins))
+
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", newFsWrapper(opts.staticDir, 1*time.Hour)))
+
+	r.HandleFunc("/", h.pageIndexHandler).Methods("GET")
+	r.HandleFunc("/ui/users", h.pageUsersHandler).Methods("GET")
+	r.HandleFunc("/ui/login", h.pageLoginHandler).Methods("GET")
+	r.HandleFunc("/ui/links", h.pageLinksHandler).Methods("GET")
+	r.HandleFunc("/ui/docs", h.pageDocHandler).Methods("GET")
+	r.HandleFunc("/ui/invite/{token}", h.pageInviteHandler).Methods("GET")
+
+	r.HandleFunc("/session", h.sessionHandler).Methods("GET")
+	r.HandleFunc("/session/open", h.sessionOpenHandler).Methods("POST")
+	r.HandleFunc("/session/close", h.sessionCloseHandler).Methods("POST")
+	r.HandleFunc("/session/vote", h.sessionVoteHandler).Methods("POST")
+	r.HandleFunc("/session/reset", h.sessionResetHandler).Methods("POST")
+	r.HandleFunc("/session/unmask", h.sessionUmaskHandler).Methods("POST")
+	r.HandleFunc("/session/changes", h.acceptChangeLogListener).Methods("GET")
+	r.HandleFunc("/session/events", h.sessionEventsHandler).Methods("GET")
+
+	r.HandleFunc("/users/auth", h.usersAuthHandler).Methods("POST")
+	r.HandleFunc("/users", h.usersHandler).Methods("GET")
+	r.HandleFunc("/users/add", h.usersAddHandler).Methods("POST")
+	r.HandleFunc("/users/remove", h.usersRemoveHandler).Methods("POST")
+	r.HandleFunc("/users/unlock", h.usersUnlockHandler).Methods("POST")
+	r.HandleFunc("/users/invite", h.usersInviteHandler).Methods("POST")
+	r.HandleFunc("/users/invites", h.usersInvitesHandler).Methods("GET")
+	r.HandleFunc("/users/invites/revoke", h.usersInviteRevokeHandler).Methods("POST")
+	r.HandleFunc("/users/join", h.usersJoinHandler).Methods("POST")
+
+	r.HandleFunc("/links", h.linksListHandler).Methods("GET")
+	r.HandleFunc("/links/add", h.linksAddHandler).Methods("POST")
+	r.HandleFunc("/links/remove", h.linksRemoveHandler).Methods("POST")
+
+	r.HandleFunc("/policies", h.policiesListHandler).Methods("GET")
+	r.HandleFunc("/policies/add", h.policiesAddHandler).Methods("POST")
+	r.HandleFunc("/policies/remove", h.policiesRemoveHandler).Methods("POST")
+
+	r.HandleFunc("/audit", h.auditHandler).Methods("GET")
+	r.HandleFunc("/storage/usage", h.storageUsageHandler).Methods("GET")
+	r.HandleFunc("/team/export", h.teamExportHandler).Methods("GET")
+	r.HandleFunc("/team/import", h.teamImportHandler).Methods("POST")
+
+	r.Handle("/metrics", promhttp.Handler())
+	addProbeRoutes(r, h.readiness)
+	return logRequests(r, opts.team.Name, append([]string{"/metrics"}, probePaths...))
 }
 
 type fsWrapper struct {
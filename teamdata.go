@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// teamExportVersion is the version of the export document, importers
+// accept documents of this version and older.
+const teamExportVersion = 1
+
+const (
+	importModeMerge   = "merge"
+	importModeReplace = "replace"
+)
+
+// teamExport is a portable document of a team's data.
+type teamExport struct {
+	Version    int           `json:"version"`
+	Team       string        `json:"team"`
+	ExportedAt time.Time     `json:"exported_at"`
+	Settings   *teamSettings `json:"settings"`
+	Users      []*user       `json:"users"`
+	Links      []*link       `json:"links"`
+	History    []*auditEntry `json:"history"`
+	Polls      []*pollRecord `json:"polls"`
+}
+
+type teamSettings struct {
+	Preference          *preference       `json:"preference"`
+	LeaderMaxIdlePeriod string            `json:"leader_max_idle_period"`
+	Policies            []*policyOverride `json:"policies"`
+}
+
+type importReport struct {
+	Mode      string         `json:"mode"`
+	Imported  map[string]int `json:"imported"`
+	Conflicts []string       `json:"conflicts"`
+}
+
+func (r *importReport) conflict(format string, args ...interface{}) {
+	r.Conflicts = append(r.Conflicts, fmt.Sprintf(format, args...))
+}
+
+// auditActionHistoryImport is the action of history entries of an imported
+// document, the importer is their actor.
+const auditActionHistoryImport = "history.import"
+
+// teamData exports and imports data of a team from its stores.
+type teamData struct {
+	team     *team
+	storage  storage
+	users    userStore
+	links    linkStore
+	audit    auditStore
+	polls    pollStore
+	policies policyOverrideStore
+}
+
+func newTeamData(s storage, t *team, c *clock) (*teamData, error) {
+	d := &teamData{team: t, storage: s}
+	var err error
+	if d.users, err = s.users(t.Name, t.getQuota().Users); err != nil {
+		return nil, err
+	}
+	if d.links, err = s.links(t.Name, t.getQuota().Links); err != nil {
+		return nil, err
+	}
+	if d.audit, err = s.audit(t.Name, c); err != nil {
+		return nil, err
+	}
+	if d.polls, err = s.polls(t.Name); err != nil {
+		return nil, err
+	}
+	if d.policies, err = s.policies(t.Name); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *teamData) export(now time.Time) (*teamExport, error) {
+	doc := &teamExport{
+		Version:    teamExportVersion,
+		Team:       d.team.Name,
+		ExportedAt: now,
+		Settings: &teamSettings{
+			Preference:          d.team.Preference,
+			LeaderMaxIdlePeriod: d.team.LeaderMaxIdlePeriod,
+		},
+		History: make([]*auditEntry, 0),
+		Polls:   make([]*pollRecord, 0),
+	}
+	var err error
+	if doc.Users, err = d.users.list(); err != nil {
+		return nil, err
+	}
+	if doc.Links, err = d.links.list(); err != nil {
+		return nil, err
+	}
+	if doc.Settings.Policies, err = d.policies.list(); err != nil {
+		return nil, err
+	}
+	err = d.audit.each(&auditFilter{}, func(e *auditEntry) bool {
+		doc.History = append(doc.History, e)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = d.polls.each(func(rec *pollRecord) bool {
+		doc.Polls = append(doc.Polls, rec)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (doc *teamExport) validate() error {
+	if doc.Version <= 0 || doc.Version > teamExportVersion {
+		return newClientError(fmt.Sprintf("export version %d is not supported, wanted at most %d", doc.Version, teamExportVersion))
+	}
+	for _, u := range doc.Users {
+		if u.Role == roleMaster {
+			// Masters are not imported and may have reserved names.
+			continue
+		}
+		if u.Role != roleVoter {
+			return newClientError(fmt.Sprintf("user %s has unknown role %s", u.Name, u.Role))
+		}
+		if err := validateUsername(u.Name); err != nil {
+			return err
+		}
+		if !validPasscodeHash(u.PasscodeHash) {
+			return newClientError(fmt.Sprintf("user %s has no valid passcode hash", u.Name))
+		}
+	}
+	for _, l := range doc.Links {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+	if doc.Settings != nil {
+		for _, o := range doc.Settings.Policies {
+			if err := o.validate(); err != nil {
+				return err
+			}
+			if o.Op != policyOpAdd && o.Op != policyOpRemove {
+				return newClientError("policy op must be add or remove")
+			}
+		}
+	}
+	return nil
+}
+
+// importTeam applies the document of the importer after it is validated as a
+// whole. Replace swaps users, links and policies of the team in one transaction.
+// History and polls are always merged, so importing the document again
+// completes an import which failed after the swap. Records which can't be
+// imported are reported as conflicts.
+func (d *teamData) importTeam(doc *teamExport, mode string, importer string, ip string) (*importReport, error) {
+	if mode != importModeMerge && mode != importModeReplace {
+		return nil, newClientError("mode must be merge or replace")
+	}
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+
+	report := &importReport{Mode: mode, Imported: make(map[string]int), Conflicts: make([]string, 0)}
+	importHistory := func(doc *teamExport, report *importReport) error {
+		return d.importHistory(doc, report, importer, ip)
+	}
+	steps := []func(*teamExport, *importReport) error{
+		d.importSettings, d.importUsers, d.importLinks, d.importPolicies, importHistory, d.importPolls,
+	}
+	if mode == importModeReplace {
+		steps = []func(*teamExport, *importReport) error{
+			d.importSettings, d.replaceMembers, importHistory, d.importPolls,
+		}
+	}
+	for _, step := range steps {
+		if err := step(doc, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// importSettings only reports differences, settings are configured in teams.json.
+func (d *teamData) importSettings(doc *teamExport, report *importReport) error {
+	s := doc.Settings
+	if s == nil {
+		return nil
+	}
+	if s.Preference != nil && d.team.Preference != nil && *s.Preference != *d.team.Preference {
+		report.conflict("settings: preference differs from teams.json and is not imported")
+	}
+	if len(s.LeaderMaxIdlePeriod) > 0 && s.LeaderMaxIdlePeriod != d.team.LeaderMaxIdlePeriod {
+		report.conflict("settings: leader_max_idle_period differs from teams.json and is not imported")
+	}
+	return nil
+}
+
+// replaceMembers replaces voters, links and policies with those of the document,
+// records over the quota of the team are reported.
+func (d *teamData) replaceMembers(doc *teamExport, report *importReport) error {
+	existing, err := d.users.list()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, u := range existing {
+		if u.Role == roleMaster {
+			names[u.Name] = true
+		}
+	}
+	var users []*user
+	for _, u := range doc.Users {
+		switch {
+		case u.Role == roleMaster:
+			report.conflict("user %s: scrum masters are configured in teams.json", u.Name)
+		case names[u.Name]:
+			report.conflict("user %s already exists", u.Name)
+		case len(names) >= d.users.getMaxUsers():
+			report.conflict("user %s: maximum %d allowed users is reached", u.Name, d.users.getMaxUsers())
+		default:
+			names[u.Name] = true
+			users = append(users, u)
+		}
+	}
+
+	uris := make(map[string]bool)
+	var links []*link
+	for _, l := range doc.Links {
+		switch {
+		case uris[l.URI]:
+			report.conflict("link %s already exists", l.URI)
+		case len(links) >= d.links.getMaxLinks():
+			report.conflict("link %s: maximum %d allowed links is reached", l.URI, d.links.getMaxLinks())
+		default:
+			uris[l.URI] = true
+			links = append(links, &link{URI: l.URI, DisplayName: l.DisplayName})
+		}
+	}
+
+	// Policies are kept unless the document has settings.
+	overrides, err := d.policies.list()
+	if err != nil {
+		return err
+	}
+	if doc.Settings != nil {
+		overrides = doc.Settings.Policies
+	}
+	if err := d.storage.replaceTeam(d.team.Name, users, links, overrides); err != nil {
+		return err
+	}
+	report.Imported["users"] = len(users)
+	report.Imported["links"] = len(links)
+	if doc.Settings != nil {
+		report.Imported["policies"] = len(overrides)
+	}
+	return nil
+}
+
+func (d *teamData) importUsers(doc *teamExport, report *importReport) error {
+	existing, err := d.users.list()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]*user)
+	for _, u := range existing {
+		current[u.Name] = u
+	}
+
+	for _, u := range doc.Users {
+		if u.Role == roleMaster {
+			report.conflict("user %s: scrum masters are configured in teams.json", u.Name)
+			continue
+		}
+		if c, ok := current[u.Name]; ok {
+			if *c != *u {
+				report.conflict("user %s already exists", u.Name)
+			}
+			continue
+		}
+		if err := d.users.create(u); err != nil {
+			if _, ok := err.(*errClientError); !ok {
+				return err
+			}
+			report.conflict("user %s: %v", u.Name, err)
+			continue
+		}
+		report.Imported["users"]++
+	}
+	return nil
+}
+
+func (d *teamData) importLinks(doc *teamExport, report *importReport) error {
+	existing, err := d.links.list()
+	if err != nil {
+		return err
+	}
+	uris := make(map[string]bool)
+	for _, l := range existing {
+		uris[l.URI] = true
+	}
+
+	for _, l := range doc.Links {
+		if uris[l.URI] {
+			report.conflict("link %s already exists", l.URI)
+			continue
+		}
+		imported := &link{URI: l.URI, DisplayName: l.DisplayName}
+		if err := d.links.create(imported); err != nil {
+			if _, ok := err.(*errClientError); !ok {
+				return err
+			}
+			report.conflict("link %s: %v", l.URI, err)
+			continue
+		}
+		uris[l.URI] = true
+		report.Imported["links"]++
+	}
+	return nil
+}
+
+func (d *teamData) importPolicies(doc *teamExport, report *importReport) error {
+	if doc.Settings == nil {
+		return nil
+	}
+
+	existing, err := d.policies.list()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string)
+	for _, o := range existing {
+		current[o.line()] = o.Op
+	}
+	for _, o := range doc.Settings.Policies {
+		if op, ok := current[o.line()]; ok {
+			if op != o.Op {
+				report.conflict("policy %s is overridden with %s", o.line(), op)
+			}
+			continue
+		}
+		if err := d.policies.put(o); err != nil {
+			return err
+		}
+		report.Imported["policies"]++
+	}
+	return nil
+}
+
+// importHistory records entries of the document as done by the importer at the
+// time of the import, anyone allowed to import could make them up otherwise.
+// The original entry is kept in the target.
+func (d *teamData) importHistory(doc *teamExport, report *importReport, importer string, ip string) error {
+	target := func(e *auditEntry) string {
+		return fmt.Sprintf("%s %s %s by %s from %s: %s", e.Time.UTC().Format(time.RFC3339Nano), e.Action, e.Target, e.Actor, e.IP, e.Result)
+	}
+	// Entries the team has, itself or imported before, are skipped.
+	seen := make(map[string]bool)
+	err := d.audit.each(&auditFilter{}, func(e *auditEntry) bool {
+		if e.Action == auditActionHistoryImport {
+			seen[e.Target] = true
+		} else {
+			seen[target(e)] = true
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Entries are appended oldest first, so ids keep the order of time.
+	history := append([]*auditEntry(nil), doc.History...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Time.Before(history[j].Time) })
+	for _, e := range history {
+		if e.Time.IsZero() || seen[target(e)] {
+			continue
+		}
+		imported := &auditEntry{
+			Actor:  importer,
+			Action: auditActionHistoryImport,
+			Target: target(e),
+			IP:     ip,
+			Result: auditResultOK,
+		}
+		if err := d.audit.append(imported); err != nil {
+			return err
+		}
+		seen[imported.Target] = true
+		report.Imported["history"]++
+	}
+	return nil
+}
+
+func (d *teamData) importPolls(doc *teamExport, report *importReport) error {
+	key := func(rec *pollRecord) string {
+		return fmt.Sprintf("%d|%s", rec.Time.UnixNano(), rec.Name)
+	}
+	seen := make(map[string]bool)
+	err := d.polls.each(func(rec *pollRecord) bool {
+		seen[key(rec)] = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	polls := append([]*pollRecord(nil), doc.Polls...)
+	sort.SliceStable(polls, func(i, j int) bool { return polls[i].Time.Before(polls[j].Time) })
+	for _, rec := range polls {
+		if rec.Time.IsZero() || seen[key(rec)] {
+			continue
+		}
+		imported := *rec
+		imported.ID = 0
+		if err := d.polls.append(&imported); err != nil {
+			return err
+		}
+		seen[key(rec)] = true
+		report.Imported["polls"]++
+	}
+	return nil
+}
+
+// exportCommand writes a team document, servers must be stopped.
+func exportCommand(args []string, dbdir string, teams map[string]*team) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	teamName := flags.String("team", "", "Team to export")
+	out := flags.String("out", "", "Document path, defaults to <team>.json")
+	flags.Parse(args)
+
+	d, closeStores, err := openTeamData(dbdir, teams, *teamName)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+
+	doc, err := d.export(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	path := *out
+	if len(path) == 0 {
+		path = *teamName + ".json"
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	fmt.Printf("team %s exported to %s\n", *teamName, path)
+	return nil
+}
+
+// importCommandActor is the importer of history imported with servers stopped.
+const importCommandActor = "import-command"
+
+// importCommand applies a team document, servers must be stopped.
+func importCommand(args []string, dbdir string, teams map[string]*team) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	teamName := flags.String("team", "", "Team to import into")
+	mode := flags.String("mode", importModeMerge, "Import mode, merge or replace")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import -team name [-mode merge|replace] <document>")
+	}
+
+	data, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	doc := new(teamExport)
+	if err := json.NewDecoder(data).Decode(doc); err != nil {
+		return err
+	}
+
+	d, closeStores, err := openTeamData(dbdir, teams, *teamName)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+
+	report, err := d.importTeam(doc, *mode, importCommandActor, "")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func openTeamData(dbdir string, teams map[string]*team, name string) (*teamData, func(), error) {
+	t, ok := teams[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown team %q", name)
+	}
+	stores, _, err := openTeamStorages(*storageKind, dbdir, *databasePerTeam, teams, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := stores.migrate(teams, false); err != nil {
+		stores.close()
+		return nil, nil, err
+	}
+	d, err := newTeamData(stores[name], t, new(clock))
+	if err != nil {
+		stores.close()
+		return nil, nil, err
+	}
+	return d, stores.close, nil
+}
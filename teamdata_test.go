@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestTeamData(t *testing.T, dir string, name string) *teamData {
+	s, err := openBoltStorage(filepath.Join(dir, name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := newDefaultTeam()
+	tm.Name = name
+	d, err := newTeamData(s, tm, new(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestTeamExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teamdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := newTestTeamData(t, dir, "src")
+	for _, u := range []*user{newUser("master", roleMaster), newUser("va", roleVoter), newUser("vb", roleVoter)} {
+		if err := src.users.create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.links.create(&link{URI: "https://a.example.com", DisplayName: "A"})
+	src.links.create(&link{URI: "https://b.example.com", DisplayName: "B"})
+	src.policies.put(&policyOverride{policyRule{PType: "p", Rule: []string{"voter", "links", "add", "allow"}}, policyOpAdd})
+	src.audit.append(&auditEntry{Actor: "master", Action: "users.add", Target: "va", Result: auditResultOK})
+	src.audit.append(&auditEntry{Actor: "master", Action: "users.add", Target: "vb", Result: auditResultOK})
+
+	doc, err := src.export(testClock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = new(teamExport)
+	if err := json.Unmarshal(buf, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestTeamData(t, dir, "dst")
+	dst.team.Preference.MaxFib = 8
+	taken := newUser("vb", roleVoter)
+	taken.setPasscode("other")
+	dst.users.create(taken)
+	dst.links.create(&link{URI: "https://a.example.com", DisplayName: "A"})
+
+	report, err := dst.importTeam(doc, importModeMerge, "importer", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"users": 1, "links": 1, "policies": 1, "history": 2}
+	for k, n := range want {
+		if report.Imported[k] != n {
+			t.Fatalf("expected %d imported %s, got %v", n, k, report.Imported)
+		}
+	}
+	// The master, the taken user, the existing link and the preference.
+	if len(report.Conflicts) != 4 {
+		t.Fatalf("expected 4 conflicts, got %v", report.Conflicts)
+	}
+	u, _ := dst.users.get("va")
+	if u == nil || !u.checkPasscode("va") {
+		t.Fatalf("expected imported user with the same passcode, got %v", u)
+	}
+	// History of the document is recorded as imported, it can't be trusted.
+	history, err := dst.audit.list(&auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range history {
+		if e.Actor != "importer" || e.Action != auditActionHistoryImport || e.IP != "10.0.0.1" || !strings.Contains(e.Target, "users.add") {
+			t.Fatalf("expected history imported by the importer, got %+v", e)
+		}
+	}
+
+	// History isn't duplicated on repeated imports.
+	report, err = dst.importTeam(doc, importModeMerge, "importer", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported["history"] != 0 || report.Imported["users"] != 0 {
+		t.Fatalf("expected nothing new to import, got %v", report.Imported)
+	}
+
+	report, err = dst.importTeam(doc, importModeReplace, "importer", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported["users"] != 2 || report.Imported["links"] != 2 {
+		t.Fatalf("expected all users and links to be replaced, got %v", report.Imported)
+	}
+	if u, _ := dst.users.get("vb"); u == nil || !u.checkPasscode("vb") {
+		t.Fatalf("expected the replaced user, got %v", u)
+	}
+
+	doc.Version = teamExportVersion + 1
+	if _, err := dst.importTeam(doc, importModeMerge, "importer", "10.0.0.1"); err == nil {
+		t.Fatal("expected error of a newer document version")
+	}
+}
+
+func TestTeamExportEndpoints(t *testing.T) {
+	voter := &testerModel{"exportee", "exportee", "voter"}
+	addVoter(t, voter)
+	defer testHandler.userStore.delete(voter.Name)
+
+	export := func(user *testerModel, status int) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", "/team/export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("authorization", signinUser(t, user))
+		w := httptest.NewRecorder()
+		http.HandlerFunc(testHandler.teamExportHandler).ServeHTTP(w, r)
+		assertStatus(t, w, status)
+		return w
+	}
+	export(voter, http.StatusForbidden)
+
+	w := export(master, http.StatusOK)
+	doc := new(teamExport)
+	if err := json.Unmarshal(w.Body.Bytes(), doc); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, u := range doc.Users {
+		if u.Name == voter.Name {
+			found = len(u.PasscodeHash) > 0
+		}
+	}
+	if doc.Version != teamExportVersion || !found {
+		t.Fatalf("expected the voter with a passcode hash in the export")
+	}
+
+	r, err := http.NewRequest("POST", "/team/import?mode=merge", bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("authorization", signinUser(t, master))
+	w = httptest.NewRecorder()
+	http.HandlerFunc(testHandler.teamImportHandler).ServeHTTP(w, r)
+	assertStatus(t, w, http.StatusOK)
+
+	report := new(importReport)
+	if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported["users"] != 0 || report.Imported["history"] != 0 {
+		t.Fatalf("expected nothing to import into the same team, got %v", report.Imported)
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"strings"
 )
 
 type page struct {
@@ -16,43 +18,61 @@ type page struct {
 	Data    interface{}
 	Version string
 	Team    string
+	// Base prefixes links of a team served under a path of a shared listener.
+	Base string
 }
 
 type templateMgr struct {
 	templates map[string]*template.Template
+	policies  map[string]string
 	defaults  *page
 }
 
-func newTemplateMgr(templateDir string, defaults *page) *templateMgr {
+func newTemplateMgr(templateDir string, defaults *page) (*templateMgr, error) {
 	m := new(templateMgr)
 	m.defaults = defaults
 
 	root, err := template.New("root").Delims("[[", "]]").Parse(`[[define "root" ]] [[ template "base" . ]] [[ end ]]`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	layoutFiles, err := filepath.Glob(filepath.Join(templateDir, "*.tpl"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	htmlFiles, err := filepath.Glob(filepath.Join(templateDir, "*.html"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	m.templates = make(map[string]*template.Template)
+	m.policies = make(map[string]string)
 	for _, file := range htmlFiles {
 		name := filepath.Base(file)
 		files := append(layoutFiles[:], file)
 		tpl, err := template.Must(root.Clone()).Delims("[[", "]]").ParseFiles(files...)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		m.templates[name] = tpl
+
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m.policies[name] = contentSecurityPolicy(bytes.Contains(src, []byte(handlebarsCompiler)))
+	}
+	return m, nil
+}
+
+// loaded returns an error unless pages can be rendered.
+func (m *templateMgr) loaded() error {
+	if len(m.templates) == 0 {
+		return errors.New("no templates are loaded")
 	}
-	return m
+	return nil
 }
 
 func (m *templateMgr) render(w http.ResponseWriter, p *page, etag string) error {
@@ -62,16 +82,21 @@ func (m *templateMgr) render(w http.ResponseWriter, p *page, etag string) error
 		return nil
 	}
 
+	setSecurityHeaders(w, m.policies[p.Name])
+
 	if len(p.Team) == 0 && m.defaults != nil {
 		p.Team = m.defaults.Team
 	}
+	if len(p.Base) == 0 && m.defaults != nil {
+		p.Base = m.defaults.Base
+	}
 	if len(p.Version) == 0 && m.defaults != nil {
 		p.Version = m.defaults.Version
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0))
 	if err := t.Execute(buf, p); err != nil {
-		log.Print(err)
+		logs.error("page failed to render", "page", p.Name, "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
 	}
@@ -89,3 +114,36 @@ func (m *templateMgr) render(w http.ResponseWriter, p *page, etag string) error
 	_, err := buf.WriteTo(w)
 	return err
 }
+
+// handlebarsCompiler is the Handlebars build which compiles templates in the
+// browser, it does so with new Function.
+const handlebarsCompiler = "/handlebars.js"
+
+const scriptSources = "'self' https://code.jquery.com https://cdnjs.cloudflare.com https://cdn.jsdelivr.net https://unpkg.com"
+
+// contentSecurityPolicy returns the policy of a page, eval is allowed only on
+// pages loading the Handlebars compiler.
+func contentSecurityPolicy(eval bool) string {
+	scripts := "script-src " + scriptSources
+	if eval {
+		scripts += " 'unsafe-eval'"
+	}
+	return strings.Join([]string{
+		"default-src 'self'",
+		scripts,
+		"style-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com https://cdnjs.cloudflare.com",
+		"img-src 'self' data:",
+		"connect-src 'self' ws: wss:",
+		"frame-ancestors 'none'",
+		"form-action 'self'",
+		"base-uri 'self'",
+	}, "; ")
+}
+
+func setSecurityHeaders(w http.ResponseWriter, policy string) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", policy)
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "same-origin")
+}
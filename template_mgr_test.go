@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestPagePolicies renders every page and checks its scripts are allowed by
+// the policy of the page, and eval is allowed only where scripts need it.
+func TestPagePolicies(t *testing.T) {
+	router := newTeamRouter(testHandler, &teamServerOpts{team: testTeam, origins: newOriginPolicy(nil), staticDir: staticDir})
+	admin := &adminEndpoints{template: loadTestTemplates(t, &page{})}
+	pages := map[string]http.Handler{
+		"session.html":   withPath(router, "/"),
+		"users.html":     withPath(router, "/ui/users"),
+		"login.html":     withPath(router, "/ui/login"),
+		"links.html":     withPath(router, "/ui/links"),
+		"docs.html":      withPath(router, "/ui/docs"),
+		"invite.html":    withPath(router, "/ui/invite/unknown"),
+		"admin.html":     http.HandlerFunc(admin.pageAdminHandler),
+		"dashboard.html": http.HandlerFunc(admin.pageDashboardHandler),
+	}
+	files, err := filepath.Glob(filepath.Join(templateDir, "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(pages) {
+		t.Fatalf("expected every page to be checked, got %d pages of %d", len(pages), len(files))
+	}
+
+	scriptTag := regexp.MustCompile(`<script([^>]*)>`)
+	scriptSrc := regexp.MustCompile(`src="([^"]+)"`)
+	evals := regexp.MustCompile(`Handlebars\.compile|new Function|\beval\(`)
+	for name, h := range pages {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assertStatus(t, w, http.StatusOK)
+
+		var scriptPolicy []string
+		for _, directive := range strings.Split(w.Header().Get("Content-Security-Policy"), ";") {
+			if fields := strings.Fields(directive); len(fields) > 0 && fields[0] == "script-src" {
+				scriptPolicy = fields[1:]
+			}
+		}
+		allowed := make(map[string]bool, len(scriptPolicy))
+		for _, source := range scriptPolicy {
+			allowed[source] = true
+		}
+
+		needsEval := false
+		for _, tag := range scriptTag.FindAllStringSubmatch(w.Body.String(), -1) {
+			src := scriptSrc.FindStringSubmatch(tag[1])
+			if src == nil {
+				if !strings.Contains(tag[1], `type="application/json"`) {
+					t.Fatalf("%s: inline scripts are blocked, got %s", name, tag[0])
+				}
+				continue
+			}
+			u, err := url.Parse(src[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(u.Host) > 0 {
+				if !allowed[u.Scheme+"://"+u.Host] {
+					t.Fatalf("%s: %s is blocked by %v", name, src[1], scriptPolicy)
+				}
+				continue
+			}
+			js, err := ioutil.ReadFile(filepath.Join(staticDir, filepath.Base(u.Path)))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			needsEval = needsEval || evals.Match(js)
+		}
+		if needsEval != allowed["'unsafe-eval'"] {
+			t.Fatalf("%s: scripts need eval %v, policy is %v", name, needsEval, scriptPolicy)
+		}
+	}
+}
+
+// withPath serves the handler at the path whatever the request path is.
+func withPath(h http.Handler, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = path
+		h.ServeHTTP(w, r)
+	})
+}
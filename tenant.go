@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	routeByPath = "path"
+	routeByHost = "host"
+	// tenantPathPrefix is followed by the team name in path routing.
+	tenantPathPrefix = "/t/"
+)
+
+var tenantNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tenantRouter serves many teams from one listener. Each team keeps its own
+// handler with stores, limits and templates, the router only picks it by the
+// path prefix /t/{team}/ or by the Host header.
+type tenantRouter struct {
+	routeBy string
+	mux     sync.RWMutex
+	teams   map[string]http.Handler
+	// probes answers probes of the listener itself in path routing.
+	probes http.Handler
+}
+
+func newTenantRouter(routeBy string) (*tenantRouter, error) {
+	if routeBy != routeByPath && routeBy != routeByHost {
+		return nil, fmt.Errorf("unknown routing %q, wanted %s or %s", routeBy, routeByPath, routeByHost)
+	}
+	return &tenantRouter{routeBy: routeBy, teams: make(map[string]http.Handler)}, nil
+}
+
+// basePath returns the path prefix the team is served under.
+func (t *tenantRouter) basePath(team *team) string {
+	if t.routeBy == routeByPath {
+		return tenantPathPrefix + team.Name
+	}
+	return ""
+}
+
+func (t *tenantRouter) key(team *team) (string, error) {
+	if t.routeBy == routeByPath {
+		if !tenantNameRegex.MatchString(team.Name) {
+			return "", fmt.Errorf("team %s can't be routed by path, wanted letters, digits, - or _", team.Name)
+		}
+		return team.Name, nil
+	}
+	if len(team.Host) == 0 {
+		return "", fmt.Errorf("team %s can't be routed by host, host is missing", team.Name)
+	}
+	return strings.ToLower(team.Host), nil
+}
+
+func (t *tenantRouter) add(team *team, handler http.Handler) error {
+	key, err := t.key(team)
+	if err != nil {
+		return err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if _, ok := t.teams[key]; ok {
+		return fmt.Errorf("team %s is routed as %s twice", team.Name, key)
+	}
+	t.teams[key] = handler
+	return nil
+}
+
+// serveProbes answers /healthz, /readyz and /version outside of teams with the
+// checks. With host routing probes go to the team of the host.
+func (t *tenantRouter) serveProbes(checks func() []*readinessCheck) {
+	r := mux.NewRouter()
+	addProbeRoutes(r, checks)
+	t.mux.Lock()
+	t.probes = logRequests(r, "", probePaths)
+	t.mux.Unlock()
+}
+
+// remove stops routing requests to the team.
+func (t *tenantRouter) remove(team *team) {
+	key, err := t.key(team)
+	if err != nil {
+		return
+	}
+	t.mux.Lock()
+	delete(t.teams, key)
+	t.mux.Unlock()
+}
+
+func (t *tenantRouter) lookup(key string) (http.Handler, bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	handler, ok := t.teams[key]
+	return handler, ok
+}
+
+func (t *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if t.routeBy == routeByHost {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		handler, ok := t.lookup(strings.ToLower(host))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, tenantPathPrefix) {
+		t.mux.RLock()
+		probes := t.probes
+		t.mux.RUnlock()
+		for _, path := range probePaths {
+			if probes != nil && r.URL.Path == path {
+				probes.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	name, rest := r.URL.Path[len(tenantPathPrefix):], ""
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	handler, ok := t.lookup(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(rest) == 0 {
+		http.Redirect(w, r, tenantPathPrefix+name+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = rest
+	r2.URL.RawPath = ""
+	handler.ServeHTTP(w, r2)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestTenants(t *testing.T, routeBy string) *tenantRouter {
+	tenants, err := newTenantRouter(routeBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alpha", "beta"} {
+		team := &team{Name: name, Host: name + ".example.com"}
+		err := tenants.add(team, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(team.Name + " " + r.URL.Path))
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tenants
+}
+
+func serveTestTenant(tenants http.Handler, host string, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Host = host
+	w := httptest.NewRecorder()
+	tenants.ServeHTTP(w, r)
+	return w
+}
+
+func TestTenantRoutingByPath(t *testing.T) {
+	tenants := newTestTenants(t, routeByPath)
+
+	for path, body := range map[string]string{
+		"/t/alpha/":                "alpha /",
+		"/t/alpha/session/changes": "alpha /session/changes",
+		"/t/beta/ui/users":         "beta /ui/users",
+	} {
+		w := serveTestTenant(tenants, "localhost:8000", path)
+		assertStatus(t, w, http.StatusOK)
+		if w.Body.String() != body {
+			t.Fatalf("expected %s to be served as %q, got %q", path, body, w.Body.String())
+		}
+	}
+
+	w := serveTestTenant(tenants, "localhost:8000", "/t/alpha")
+	assertStatus(t, w, http.StatusMovedPermanently)
+	if w.Header().Get("Location") != "/t/alpha/" {
+		t.Fatalf("expected redirect to the team root, got %s", w.Header().Get("Location"))
+	}
+	assertStatus(t, serveTestTenant(tenants, "localhost:8000", "/t/gamma/"), http.StatusNotFound)
+	assertStatus(t, serveTestTenant(tenants, "localhost:8000", "/session"), http.StatusNotFound)
+
+	if err := tenants.add(&team{Name: "alpha"}, http.NotFoundHandler()); err == nil {
+		t.Fatal("expected a team to be routed once")
+	}
+	if err := tenants.add(&team{Name: "a team"}, http.NotFoundHandler()); err == nil {
+		t.Fatal("expected a name unfit for a path to be rejected")
+	}
+}
+
+func TestTenantRoutingByHost(t *testing.T) {
+	tenants := newTestTenants(t, routeByHost)
+
+	w := serveTestTenant(tenants, "Beta.example.com:8000", "/session")
+	assertStatus(t, w, http.StatusOK)
+	if w.Body.String() != "beta /session" {
+		t.Fatalf("expected beta to serve the request, got %q", w.Body.String())
+	}
+	assertStatus(t, serveTestTenant(tenants, "gamma.example.com", "/session"), http.StatusNotFound)
+
+	if err := tenants.add(&team{Name: "gamma"}, http.NotFoundHandler()); err == nil {
+		t.Fatal("expected a team without host to be rejected")
+	}
+	if _, err := newTenantRouter("port"); err == nil {
+		t.Fatal("expected unknown routing to be rejected")
+	}
+}
+
+func TestTenantPageLinks(t *testing.T) {
+	templates := loadTestTemplates(t, &page{Team: "alpha", Base: "/t/alpha"})
+	w := httptest.NewRecorder()
+	if err := templates.render(w, &page{Name: "login.html"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	for _, link := range []string{`content="/t/alpha"`, `href="/t/alpha/static/base.css"`, `src="/t/alpha/static/login.js"`, `href="/t/alpha/ui/docs"`} {
+		if !strings.Contains(body, link) {
+			t.Fatalf("expected page to have %s", link)
+		}
+	}
+	if strings.Contains(body, `src="/static/`) {
+		t.Fatal("expected page links to be relative to the team")
+	}
+}
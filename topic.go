@@ -1,14 +1,29 @@
 package main
 
-import "github.com/gorilla/websocket"
-
+// msgWriter is a message of a topic, every client gets it as seen by its principal.
 type msgWriter interface {
-	write(c *websocket.Conn, p *principal) error
+	get(p *principal) interface{}
 }
 
+// client is a listener of a topic. Topics never block on a client, messages are
+// queued in a bounded buffer and a client which can't keep up is disconnected.
 type client struct {
 	id  string
 	msg chan msgWriter
+	// gone is closed when the topic drops the client for being too slow.
+	gone chan bool
+
+	// coalesced counts messages superseded in a row, it is owned by the topic.
+	coalesced int
+	dropped   bool
+}
+
+func newClient(id string) *client {
+	c := new(client)
+	c.id = id
+	c.msg = make(chan msgWriter, clientBufferSize)
+	c.gone = make(chan bool)
+	return c
 }
 
 type topic interface {
@@ -16,3 +31,35 @@ type topic interface {
 	leave(c *client)
 	sync() msgWriter
 }
+
+// deliver queues the message without blocking. Only the latest message of a topic
+// matters, so a full buffer drops the oldest one. It returns false once the client
+// lagged behind for more than clientMaxCoalesced messages.
+func (c *client) deliver(m msgWriter) bool {
+	select {
+	case c.msg <- m:
+		c.coalesced = 0
+		return true
+	default:
+	}
+
+	select {
+	case <-c.msg:
+	default:
+	}
+	// Only the topic sends, so there is room after taking a message out.
+	c.msg <- m
+	c.coalesced++
+	broadcastCoalesced.Inc()
+	return c.coalesced <= clientMaxCoalesced
+}
+
+// drop disconnects a client which is too slow, the client still leaves the topic.
+func (c *client) drop() {
+	if c.dropped {
+		return
+	}
+	c.dropped = true
+	close(c.gone)
+	broadcastDropped.Inc()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSessionTopicSlowClients(t *testing.T) {
+	const (
+		active  = 300
+		stalled = 50
+		changes = 200
+	)
+	topic := newSessionTopic(newSession(testClock), notificationBufferSize)
+	dropped := testutil.ToFloat64(broadcastDropped)
+
+	var latest int64
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	received := make([]int64, active)
+	for i := 0; i < active; i++ {
+		c := newClient("active")
+		topic.enter(c)
+		wg.Add(1)
+		go func(i int, c *client) {
+			defer wg.Done()
+			for {
+				select {
+				case m := <-c.msg:
+					atomic.StoreInt64(&received[i], m.(*modelMasker).sm.Version)
+				case <-c.gone:
+					t.Errorf("active client %d was dropped", i)
+					return
+				case <-done:
+					return
+				}
+			}
+		}(i, c)
+	}
+	slow := make([]*client, stalled)
+	for i := range slow {
+		slow[i] = newClient("stalled")
+		topic.enter(slow[i])
+	}
+
+	// Stalled clients must not slow down writers.
+	start := time.Now()
+	for i := 0; i < changes; i++ {
+		m, err := topic.write(func(s *session, m *modelMasker) error {
+			s.touch()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest = m.sm.Version
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected writes to never block, took %s", elapsed)
+	}
+
+	for i, c := range slow {
+		select {
+		case <-c.gone:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected stalled client %d to be dropped", i)
+		}
+		if len(c.msg) > clientBufferSize {
+			t.Fatalf("expected buffer of stalled client to be bounded, got %d", len(c.msg))
+		}
+	}
+	if got := testutil.ToFloat64(broadcastDropped) - dropped; got != stalled {
+		t.Fatalf("expected %d dropped clients, got %v", stalled, got)
+	}
+
+	// Superseded models may be skipped, but everybody catches up with the latest one.
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < active; i++ {
+		for atomic.LoadInt64(&received[i]) != latest {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected client %d to get version %d, got %d", i, latest, atomic.LoadInt64(&received[i]))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -1,18 +1,36 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/boltdb/bolt"
 	"github.com/casbin/casbin"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const defaultMaxUsers = 20
 const usersBucketName = "users"
 
+// Prefixes version hashes of passcodes. Hashes of one round of salted SHA-256
+// are still checked, they are replaced once the user signs in.
+const (
+	passcodeHashPrefix       = "bcrypt:"
+	legacyPasscodeHashPrefix = "sha256:"
+)
+
+// passcodeCost is the bcrypt cost of new hashes, hashes of a lower cost are
+// replaced too.
+var passcodeCost = bcrypt.DefaultCost
+
 type role string
 
 const (
@@ -21,27 +39,144 @@ const (
 )
 
 type user struct {
-	Name     string `json:"name"`
-	Role     role   `json:"role"`
-	Passcode string `json:"passcode,omitempty"`
+	Name         string `json:"name"`
+	Role         role   `json:"role"`
+	PasscodeHash string `json:"passcode_hash,omitempty"`
 }
 
 func newUser(username string, userRole role) *user {
 	newUser := new(user)
 	newUser.Name = username
-	newUser.Passcode = username // being lazy
+	newUser.setPasscode(username) // being lazy
 	newUser.Role = role(userRole)
 	return newUser
 }
 
-type userStore struct {
+func (u *user) setPasscode(c string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(c), passcodeCost)
+	if err != nil {
+		panic(err)
+	}
+	u.PasscodeHash = passcodeHashPrefix + string(hash)
+}
+
+func (u *user) checkPasscode(c string) bool {
+	if strings.HasPrefix(u.PasscodeHash, passcodeHashPrefix) {
+		hash := strings.TrimPrefix(u.PasscodeHash, passcodeHashPrefix)
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(c)) == nil
+	}
+	salt, ok := legacyPasscodeSalt(u.PasscodeHash)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(legacyPasscodeHash(salt, c)), []byte(u.PasscodeHash)) == 1
+}
+
+// passcodeOutdated reports whether the hash is legacy or of a lower cost.
+func (u *user) passcodeOutdated() bool {
+	if !strings.HasPrefix(u.PasscodeHash, passcodeHashPrefix) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(strings.TrimPrefix(u.PasscodeHash, passcodeHashPrefix)))
+	return err != nil || cost < passcodeCost
+}
+
+// validPasscodeHash reports whether the hash is of any known version.
+func validPasscodeHash(hash string) bool {
+	if strings.HasPrefix(hash, passcodeHashPrefix) {
+		_, err := bcrypt.Cost([]byte(strings.TrimPrefix(hash, passcodeHashPrefix)))
+		return err == nil
+	}
+	_, ok := legacyPasscodeSalt(hash)
+	return ok
+}
+
+func legacyPasscodeHash(salt string, c string) string {
+	sum := sha256.Sum256([]byte(salt + c))
+	return fmt.Sprintf("%s%s:%s", legacyPasscodeHashPrefix, salt, hex.EncodeToString(sum[:]))
+}
+
+func legacyPasscodeSalt(hash string) (string, bool) {
+	if !strings.HasPrefix(hash, legacyPasscodeHashPrefix) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(hash, legacyPasscodeHashPrefix), ":")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) != 2*sha256.Size {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// passcodeCache remembers passcodes which matched the hash of a user, so a
+// token sent with every request costs a bcrypt check once. Passcodes are kept
+// as HMACs with a random key of the process.
+type passcodeCache struct {
+	key   []byte
+	mux   sync.Mutex
+	users map[string]*verifiedPasscode
+}
+
+type verifiedPasscode struct {
+	hash string
+	mac  []byte
+}
+
+func newPasscodeCache() *passcodeCache {
+	c := new(passcodeCache)
+	c.key = make([]byte, 32)
+	if _, err := rand.Read(c.key); err != nil {
+		panic(err)
+	}
+	c.users = make(map[string]*verifiedPasscode)
+	return c
+}
+
+// check returns whether the passcode matches the hash of the user, a change
+// of the hash forgets the passcode.
+func (c *passcodeCache) check(u *user, passcode string) bool {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(passcode))
+	mac := h.Sum(nil)
+
+	c.mux.Lock()
+	v, ok := c.users[u.Name]
+	c.mux.Unlock()
+	if ok && v.hash == u.PasscodeHash && hmac.Equal(v.mac, mac) {
+		return true
+	}
+	if !u.checkPasscode(passcode) {
+		return false
+	}
+	c.mux.Lock()
+	c.users[u.Name] = &verifiedPasscode{hash: u.PasscodeHash, mac: mac}
+	c.mux.Unlock()
+	return true
+}
+
+type userStore interface {
+	getMaxUsers() int
+	// create adds or replaces the user unless the limit of users is reached.
+	create(u *user) error
+	// add adds the user unless the name is taken or the limit of users is
+	// reached, the check and the insert are one transaction.
+	add(u *user) error
+	// get returns nil if the user doesn't exist.
+	get(username string) (*user, error)
+	// rehash replaces the passcode hash of the user if it is still old, a user
+	// changed or removed meanwhile is kept as it is.
+	rehash(username string, old string, hash string) error
+	delete(username string) error
+	list() ([]*user, error)
+}
+
+type boltUserStore struct {
 	db       *bolt.DB
 	bucket   []byte
 	maxUsers int
 }
 
-func newUserStore(db *bolt.DB, shard string, maxUsers int) (*userStore, error) {
-	s := new(userStore)
+func newBoltUserStore(db *bolt.DB, shard string, maxUsers int) (*boltUserStore, error) {
+	s := new(boltUserStore)
 	s.db = db
 	s.bucket = []byte(fmt.Sprintf("%s_%s", shard, usersBucketName))
 
@@ -68,11 +203,19 @@ func newUserStore(db *bolt.DB, shard string, maxUsers int) (*userStore, error) {
 	return s, nil
 }
 
-func (s *userStore) getMaxUsers() int {
+func (s *boltUserStore) getMaxUsers() int {
 	return s.maxUsers
 }
 
-func (s *userStore) create(u *user) error {
+func (s *boltUserStore) create(u *user) error {
+	return s.put(u, true)
+}
+
+func (s *boltUserStore) add(u *user) error {
+	return s.put(u, false)
+}
+
+func (s *boltUserStore) put(u *user, replace bool) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.bucket)
 
@@ -82,7 +225,12 @@ func (s *userStore) create(u *user) error {
 			n++
 		}
 
-		if s.maxUsers < n {
+		exists := b.Get([]byte(u.Name)) != nil
+		if exists && !replace {
+			return errUsernameTaken
+		}
+		// Replacing an existing user doesn't count against the limit.
+		if !exists && s.maxUsers <= n {
 			return newClientError(fmt.Sprintf("maximum %d allowed users is reached", s.maxUsers))
 		}
 
@@ -94,25 +242,51 @@ func (s *userStore) create(u *user) error {
 	})
 }
 
-func (s *userStore) get(username string) (*user, error) {
-	u := &user{}
+func (s *boltUserStore) get(username string) (*user, error) {
+	var u *user
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.bucket)
 		data := b.Get([]byte(username))
-		json.Unmarshal(data, &u)
-		return nil
+		if data == nil {
+			return nil
+		}
+		u = new(user)
+		return json.Unmarshal(data, u)
 	})
 	return u, err
 }
 
-func (s *userStore) delete(username string) error {
+func (s *boltUserStore) rehash(username string, old string, hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		data := b.Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		u := new(user)
+		if err := json.Unmarshal(data, u); err != nil {
+			return err
+		}
+		if u.PasscodeHash != old {
+			return nil
+		}
+		u.PasscodeHash = hash
+		buf, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(username), buf)
+	})
+}
+
+func (s *boltUserStore) delete(username string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.bucket)
 		return b.Delete([]byte(username))
 	})
 }
 
-func (s *userStore) list() ([]*user, error) {
+func (s *boltUserStore) list() ([]*user, error) {
 	var users []*user
 	err := s.db.View(func(tx *bolt.Tx) error {
 		// Assume bucket exists and has keys
@@ -137,14 +311,22 @@ func (s *userStore) list() ([]*user, error) {
 	return users, err
 }
 
+// auth checks passcodes of tokens and logins through the guard, so tokens
+// can't be used to guess passcodes past the throttle.
 type auth struct {
-	store    *userStore
-	enforcer *casbin.Enforcer
+	store     userStore
+	enforcer  *casbin.SyncedEnforcer
+	guard     *loginGuard
+	passcodes *passcodeCache
+}
+
+func newAuth(store userStore, enforcer *casbin.SyncedEnforcer, guard *loginGuard) *auth {
+	return &auth{store: store, enforcer: enforcer, guard: guard, passcodes: newPasscodeCache()}
 }
 
 type principal struct {
 	user          *user
-	enforcer      *casbin.Enforcer
+	enforcer      *casbin.SyncedEnforcer
 	authenticated bool
 }
 
@@ -159,7 +341,8 @@ func (p *principal) hasPermission(obj string, act string) bool {
 	return p.enforcer.Enforce(string(p.user.Role), obj, act)
 }
 
-func (a *auth) authenticate(tokenRaw string) (*principal, error) {
+// authenticate returns the principal of the token sent from the address.
+func (a *auth) authenticate(tokenRaw string, ip string) (*principal, error) {
 	p := new(principal)
 	p.enforcer = a.enforcer
 
@@ -177,12 +360,9 @@ func (a *auth) authenticate(tokenRaw string) (*principal, error) {
 	}
 	username, passcode := parts[0], parts[1]
 
-	user, err := a.store.get(username)
+	user, err := a.check(username, passcode, ip)
 	if err != nil {
-		return nil, &systemError{err: err, msg: fmt.Sprintf("auth: failed to get user %s from store", username)}
-	}
-	if user == nil || user.Passcode != passcode {
-		return p, errAuthInvalid
+		return p, err
 	}
 	p.user = user
 	p.authenticated = true
@@ -190,7 +370,8 @@ func (a *auth) authenticate(tokenRaw string) (*principal, error) {
 	return p, nil
 }
 
-func (a *auth) login(username string, passcode string) (string, error) {
+// login returns the token of the user logging in from the address.
+func (a *auth) login(username string, passcode string, ip string) (string, error) {
 	if len(username) == 0 {
 		return "", errAuthMissing
 	}
@@ -198,17 +379,67 @@ func (a *auth) login(username string, passcode string) (string, error) {
 		return "", errAuthMissing
 	}
 
+	u, err := a.check(username, passcode, ip)
+	if err != nil {
+		return "", err
+	}
+
+	token := fmt.Sprintf("%s,%s,%s", u.Name, passcode, string(u.Role))
+	return b64.URLEncoding.EncodeToString([]byte(token)), nil
+}
+
+// check returns the user if the passcode matches. Failures are counted by the
+// guard and the user is throttled once it has too many of them.
+func (a *auth) check(username string, passcode string, ip string) (*user, error) {
+	if err := a.guard.begin(username, ip); err != nil {
+		return nil, err
+	}
 	u, err := a.store.get(username)
 	if err != nil {
-		return "", &systemError{err: err, msg: fmt.Sprintf("auth: failed to get user %s from store", username)}
+		a.guard.end(username, ip, false)
+		return nil, &systemError{err: err, msg: fmt.Sprintf("auth: failed to get user %s from store", username)}
 	}
-	if u == nil {
-		return "", errAuthInvalid
+	if u == nil || !a.passcodes.check(u, passcode) {
+		a.guard.end(username, ip, true)
+		return nil, errAuthInvalid
 	}
-	if u.Passcode != passcode {
-		return "", errAuthInvalid
+	a.guard.end(username, ip, false)
+	if u.passcodeOutdated() {
+		old := u.PasscodeHash
+		u.setPasscode(passcode)
+		if err := a.store.rehash(u.Name, old, u.PasscodeHash); err != nil {
+			logs.warn("passcode hash failed to upgrade", "user", u.Name, "err", err)
+		}
 	}
+	return u, nil
+}
 
-	token := fmt.Sprintf("%s,%s,%s", u.Name, u.Passcode, string(u.Role))
-	return b64.URLEncoding.EncodeToString([]byte(token)), nil
+func validateUsername(n string) error {
+	if len(n) == 0 || strings.Contains(n, " ") {
+		return newClientError("username is invalid")
+	}
+	if len(n) > maxUsernameLength {
+		return newClientError(fmt.Sprintf("username is too long than %d chars", maxUsernameLength))
+	}
+	if !validUserName.MatchString(n) {
+		return newClientError("username must not be number and must contain only letters")
+	}
+	if reservedUserNames.MatchString(n) {
+		return newClientError("username is reserved")
+	}
+	return nil
+}
+
+func validatePasscode(c string) error {
+	if len(c) == 0 {
+		return newClientError("passcode is required")
+	}
+	if len(c) > maxPasscodeLength {
+		return newClientError(fmt.Sprintf("passcode is too long than %d chars", maxPasscodeLength))
+	}
+	// Auth token is a comma separated list.
+	if strings.Contains(c, ",") {
+		return newClientError("passcode must not contain commas")
+	}
+	return nil
 }